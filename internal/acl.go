@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxGrants bounds the number of grants of an Image
+const maxGrants = 16
+
+// permission is the access level of a Principal on an Image, higher levels include lower ones
+type permission int
+
+const (
+	permissionNone  permission = iota
+	permissionRead             // get, download and find similar images
+	permissionWrite            // update name and description
+	permissionOwner            // delete and manage grants
+)
+
+// Grant values of Grant.Permission
+const (
+	grantRead  = "read"
+	grantWrite = "write"
+)
+
+var (
+	// ErrPermissionDenied caller cannot perform the operation on the image
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrInvalidGrant grant is malformed
+	ErrInvalidGrant = errors.New("invalid grant")
+)
+
+func (p permission) String() string {
+	switch p {
+	case permissionRead:
+		return grantRead
+	case permissionWrite:
+		return grantWrite
+	case permissionOwner:
+		return "owner"
+	default:
+		return "none"
+	}
+}
+
+// Grant shares an Image with a user or a group
+type Grant struct {
+	User       string `json:"user,omitempty"`
+	Group      string `json:"group,omitempty"`
+	Permission string `json:"permission"`
+}
+
+func (g Grant) validate() error {
+	if (g.User == "") == (g.Group == "") {
+		return fmt.Errorf("%w: exactly one of user or group is required", ErrInvalidGrant)
+	}
+
+	if g.Permission != grantRead && g.Permission != grantWrite {
+		return fmt.Errorf("%w: permission must be one of [%s, %s]", ErrInvalidGrant, grantRead, grantWrite)
+	}
+
+	return nil
+}
+
+func (g Grant) permission() permission {
+	if g.Permission == grantWrite {
+		return permissionWrite
+	}
+	return permissionRead
+}
+
+// validateGrants checks a set of grants before storing them
+func validateGrants(grants []Grant) error {
+	if len(grants) > maxGrants {
+		return fmt.Errorf("%w: at most %d grants are allowed", ErrInvalidGrant, maxGrants)
+	}
+
+	for _, g := range grants {
+		if err := g.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseGrants decodes the grants of records written in the object metadata, e.g. "user:alice:read,group:design%20team:write".
+// Malformed entries are skipped.
+func parseGrants(v string) []Grant {
+	grants := make([]Grant, 0)
+	for _, entry := range strings.Split(v, ",") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			continue
+		}
+
+		name, err := url.PathUnescape(parts[1])
+		if err != nil {
+			continue
+		}
+
+		g := Grant{Permission: parts[2]}
+		switch parts[0] {
+		case "user":
+			g.User = name
+		case "group":
+			g.Group = name
+		}
+
+		if g.validate() == nil {
+			grants = append(grants, g)
+		}
+	}
+
+	return grants
+}
+
+// permission returns the access level of the Principal on the image, public and unlisted images are readable by anyone
+func (p *Principal) permission(image *Image) permission {
+	level := p.access(image)
+	if level < permissionRead && image.anonymous() {
+		level = permissionRead
+	}
+
+	return level
+}
+
+// access returns the access level granted to the Principal by ownership and grants.
+// Images uploaded before ownership was recorded have no owner: they are readable by everyone,
+// and only admins can modify them.
+func (p *Principal) access(image *Image) permission {
+	if p == nil {
+		return permissionNone
+	}
+
+	if p.can(scopeImagesAdmin) || (p.Subject != "" && p.Subject == image.Owner) {
+		return permissionOwner
+	}
+
+	level := permissionNone
+	if image.Owner == "" {
+		level = permissionRead
+	}
+
+	for _, g := range image.Grants {
+		if (p.Subject != "" && g.User == p.Subject) || (g.Group != "" && p.inGroup(g.Group)) {
+			if l := g.permission(); l > level {
+				level = l
+			}
+		}
+	}
+
+	return level
+}
+
+func (p *Principal) inGroup(group string) bool {
+	for _, g := range p.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns an error when the caller lacks the permission on the image.
+// Images the caller cannot read are reported as not found, so that their existence is not disclosed.
+func (s *server) authorize(c *gin.Context, image *Image, want permission) error {
+	got := principal(c).permission(image)
+	switch {
+	case got >= want:
+		return nil
+	case got == permissionNone:
+		return newNotFoundError(ErrImageNotFound)
+	default:
+		return newForbiddenError(fmt.Errorf("%w: %s permission is required", ErrPermissionDenied, want))
+	}
+}
+
+// redact hides the sharing of the image from callers who cannot manage it: grants are only returned to
+// the owner and admins, the owner is not returned to anonymous callers. The image is left untouched.
+func (s *server) redact(c *gin.Context, image *Image) *Image {
+	p := principal(c)
+	if p.access(image) >= permissionOwner {
+		return image
+	}
+
+	redacted := *image
+	redacted.Grants = nil
+	if p == nil || p.Subject == "" {
+		redacted.Owner = ""
+	}
+
+	return &redacted
+}
+
+// visible filters images listed to the caller, unlisted images are only listed to those having access to them
+func (s *server) visible(c *gin.Context, images []*Image) []*Image {
+	p := principal(c)
+	res := make([]*Image, 0, len(images))
+	for _, i := range images {
+		if i.Visibility == visibilityPublic || p.access(i) >= permissionRead {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+// visibleSimilar filters similar images as visible does
+func (s *server) visibleSimilar(c *gin.Context, images []*similarImage) []*similarImage {
+	p := principal(c)
+	res := make([]*similarImage, 0, len(images))
+	for _, i := range images {
+		if i.Visibility == visibilityPublic || p.access(i.Image) >= permissionRead {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrincipal_permission(t *testing.T) {
+	image := &Image{
+		Owner: "alice",
+		Grants: []Grant{
+			{User: "bob", Permission: grantRead},
+			{Group: "design", Permission: grantWrite},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		image     *Image
+		want      permission
+	}{
+		{name: "Not authenticated", principal: nil, image: image, want: permissionNone},
+		{name: "Anonymous", principal: &Principal{}, image: image, want: permissionNone},
+		{name: "Owner", principal: &Principal{Subject: "alice"}, image: image, want: permissionOwner},
+		{name: "Admin", principal: admin, image: image, want: permissionOwner},
+		{name: "User grant", principal: &Principal{Subject: "bob"}, image: image, want: permissionRead},
+		{name: "Group grant", principal: &Principal{Subject: "carol", Groups: []string{"design"}}, image: image, want: permissionWrite},
+		{name: "Highest grant wins", principal: &Principal{Subject: "bob", Groups: []string{"design"}}, image: image, want: permissionWrite},
+		{name: "Stranger", principal: &Principal{Subject: "eve"}, image: image, want: permissionNone},
+		{name: "Unowned image", principal: &Principal{Subject: "eve"}, image: &Image{}, want: permissionRead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.principal.permission(tt.image))
+		})
+	}
+}
+
+func Test_parseGrants(t *testing.T) {
+	grants := []Grant{
+		{User: "bob", Permission: grantRead},
+		{Group: "design team", Permission: grantWrite},
+	}
+
+	assert.Equal(t, grants, parseGrants("user:bob:read,group:design%20team:write"))
+
+	assert.Empty(t, parseGrants(""))
+	assert.Equal(t, grants[:1], parseGrants("user:bob:read,user:eve:owner,foo"))
+}
+
+func Test_validateGrants(t *testing.T) {
+	assert.NoError(t, validateGrants([]Grant{{User: "bob", Permission: grantRead}}))
+	assert.ErrorIs(t, validateGrants([]Grant{{Permission: grantRead}}), ErrInvalidGrant)
+	assert.ErrorIs(t, validateGrants([]Grant{{User: "bob", Group: "design", Permission: grantRead}}), ErrInvalidGrant)
+	assert.ErrorIs(t, validateGrants([]Grant{{User: "bob", Permission: "owner"}}), ErrInvalidGrant)
+	assert.ErrorIs(t, validateGrants(make([]Grant, maxGrants+1)), ErrInvalidGrant)
+}
+
+func Test_server_acl(t *testing.T) {
+	var (
+		owner  = &Principal{Subject: "alice", Scopes: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete}}
+		reader = &Principal{Subject: "bob", Scopes: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete}}
+		editor = &Principal{Subject: "carol", Groups: []string{"design"}, Scopes: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete}}
+		other  = &Principal{Subject: "eve", Scopes: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete}}
+	)
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		method    string
+		path      string
+		body      string
+		wantCode  int
+	}{
+		{name: "Owner reads", principal: owner, method: "GET", wantCode: 200},
+		{name: "Granted user reads", principal: reader, method: "GET", wantCode: 200},
+		{name: "Stranger cannot see", principal: other, method: "GET", wantCode: 404},
+		{name: "Stranger cannot download", principal: other, method: "GET", path: "/download", wantCode: 404},
+		{name: "Reader cannot update", principal: reader, method: "PATCH", body: `{"name": "foo"}`, wantCode: 403},
+		{name: "Editor updates", principal: editor, method: "PATCH", body: `{"name": "foo"}`, wantCode: 200},
+		{name: "Editor cannot share", principal: editor, method: "PUT", path: "/grants", body: `[]`, wantCode: 403},
+		{name: "Owner shares", principal: owner, method: "PUT", path: "/grants", body: `[{"user": "eve", "permission": "read"}]`, wantCode: 200},
+		{name: "Invalid grant", principal: owner, method: "PUT", path: "/grants", body: `[{"permission": "read"}]`, wantCode: 400},
+		{name: "Reader cannot delete", principal: reader, method: "DELETE", wantCode: 403},
+		{name: "Stranger cannot delete", principal: other, method: "DELETE", wantCode: 404},
+		{name: "Owner deletes", principal: owner, method: "DELETE", wantCode: 204},
+		{name: "Admin deletes", principal: &Principal{Subject: "root", Scopes: []string{scopeImagesDelete, scopeImagesAdmin}}, method: "DELETE", wantCode: 204},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := new(testingImageService)
+			image, _ := service.Create(context.TODO(), &Image{
+				Key:         uuid.New(),
+				ContentType: "image/png",
+				Owner:       "alice",
+				Grants: []Grant{
+					{User: "bob", Permission: grantRead},
+					{Group: "design", Permission: grantWrite},
+				},
+			})
+
+			s := &server{router: gin.New(), Image: service, links: testingLinks}
+			g := s.router.Group("/images", s.handleErrors, withPrincipal(tt.principal))
+			g.GET("/:image", s.BindUUID, s.handleImagesGet)
+			g.GET("/:image/download", s.BindUUID, s.handleImagesDownload)
+			g.PATCH("/:image", s.BindUUID, s.handleImagesUpdate)
+			g.PUT("/:image/grants", s.BindUUID, s.handleImagesGrants)
+			g.DELETE("/:image", s.BindUUID, s.handleImagesDelete)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/images/"+image.Key.String()+tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			s.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantCode, rw.Code, rw.Body.String())
+		})
+	}
+}
+
+func Test_server_handleImagesList_acl(t *testing.T) {
+	service := new(testingImageService)
+	mine, _ := service.Create(context.TODO(), &Image{Key: uuid.New(), ContentType: "image/png", Owner: "alice"})
+	shared, _ := service.Create(context.TODO(), &Image{Key: uuid.New(), ContentType: "image/png", Owner: "bob", Grants: []Grant{{User: "alice", Permission: grantRead}}})
+	hidden, _ := service.Create(context.TODO(), &Image{Key: uuid.New(), ContentType: "image/png", Owner: "bob"})
+	defer func() { _ = service.Delete(context.TODO(), mine.Key, shared.Key, hidden.Key) }()
+
+	s := &server{router: gin.New(), Image: service, links: testingLinks}
+	s.router.GET("/images", s.handleErrors, withPrincipal(&Principal{Subject: "alice"}), s.handleImagesList)
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", "/images", nil))
+	assert.Equal(t, 200, rw.Code)
+
+	var got []*Image
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &got))
+
+	keys := make(map[uuid.UUID]bool)
+	for _, i := range got {
+		keys[i.Key] = true
+	}
+	assert.True(t, keys[mine.Key])
+	assert.True(t, keys[shared.Key])
+	assert.False(t, keys[hidden.Key])
+}
+
+func Test_server_redact(t *testing.T) {
+	tests := []struct {
+		name       string
+		principal  *Principal
+		wantOwner  string
+		wantGrants bool
+	}{
+		{name: "Owner", principal: &Principal{Subject: "alice"}, wantOwner: "alice", wantGrants: true},
+		{name: "Admin", principal: &Principal{Subject: "root", Scopes: []string{scopeImagesAdmin}}, wantOwner: "alice", wantGrants: true},
+		{name: "Granted user", principal: &Principal{Subject: "bob"}, wantOwner: "alice"},
+		{name: "Authenticated stranger", principal: &Principal{Subject: "eve"}, wantOwner: "alice"},
+		{name: "Anonymous", principal: &Principal{}},
+		{name: "Unauthenticated", principal: nil},
+	}
+
+	service := new(testingImageService)
+	image, _ := service.Create(context.TODO(), &Image{
+		Key:         uuid.New(),
+		ContentType: "image/png",
+		Owner:       "alice",
+		Grants:      []Grant{{User: "bob", Permission: grantRead}},
+		Visibility:  visibilityPublic,
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{router: gin.New(), Image: service, links: testingLinks}
+			s.router.GET("/images/:image", s.handleErrors, withPrincipal(tt.principal), s.BindUUID, s.handleImagesGet)
+
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, httptest.NewRequest("GET", "/images/"+image.Key.String(), nil))
+			assert.Equal(t, 200, rw.Code, rw.Body.String())
+
+			var got Image
+			assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &got))
+			assert.Equal(t, tt.wantOwner, got.Owner)
+			assert.Equal(t, tt.wantGrants, len(got.Grants) > 0)
+		})
+	}
+
+	assert.Len(t, image.Grants, 1, "stored image is left untouched")
+}
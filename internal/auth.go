@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PrincipalContextKey is the context key of the authenticated *Principal
+const PrincipalContextKey = "principal"
+
+// Scopes granted to API keys
+const (
+	scopeImagesRead   = "images:read"
+	scopeImagesWrite  = "images:write"
+	scopeImagesDelete = "images:delete"
+	scopeImagesAdmin  = "images:admin" // full access to every image, whatever its owner
+)
+
+// knownScopes are the scopes checked by the routes, see RequireScope
+var knownScopes = []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete, scopeImagesAdmin}
+
+// apiKeyPrefix makes keys recognizable, e.g. by secret scanners
+const apiKeyPrefix = "isk_"
+
+var (
+	// ErrMissingCredentials request does not hold any credentials
+	ErrMissingCredentials = errors.New("missing credentials")
+
+	// ErrInvalidCredentials credentials are unknown or malformed
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrInsufficientScope credentials do not grant the required scope
+	ErrInsufficientScope = errors.New("insufficient scope")
+
+	// ErrInvalidAPIKeyEntry an API key cannot be parsed from the configuration
+	ErrInvalidAPIKeyEntry = errors.New("invalid API key entry")
+
+	// ErrUnknownScope scope is not one of knownScopes
+	ErrUnknownScope = errors.New("unknown scope")
+)
+
+// Principal is the authenticated caller
+type Principal struct {
+	Subject string   // API key name or token subject, empty for anonymous requests
+	Scopes  []string // granted scopes
+	Groups  []string // groups the caller belongs to, used by sharing grants
+	Tenant  string   // tenant the credentials are bound to, empty when they are not, see tenants.resolve
+}
+
+// can tells whether the Principal was granted the scope
+func (p *Principal) can(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// subject returns the Principal subject, empty for anonymous callers
+func (p *Principal) subject() string {
+	if p == nil {
+		return ""
+	}
+	return p.Subject
+}
+
+// APIKey is a configured key. Only the SHA-256 of the key is kept, keys are random so a slow hash is not needed.
+type APIKey struct {
+	Name   string
+	Hash   string // hex encoded SHA-256 of the key
+	Scopes []string
+}
+
+// authenticator resolves the Principal of requests
+type authenticator struct {
+	apiKeys   map[string]*APIKey // by hash
+	tokens    *tokenVerifier     // JWT bearer tokens, nil when not configured
+	anonymous []string           // scopes granted to requests without credentials
+
+	// keyTenants binds API keys to tenants, by key name
+	keyTenants map[string]string
+}
+
+// AuthConfig describes the credentials accepted by Authenticate
+type AuthConfig struct {
+	// APIKeys are entries formatted as <name>:<sha256 of the key>:<comma separated scopes>, see GenerateAPIKey
+	APIKeys     []string `yaml:"api_keys"`
+	APIKeysFile string   `yaml:"api_keys_file"` // file holding one entry per line
+
+	// AnonymousScopes are granted to requests without credentials, none by default
+	AnonymousScopes []string `yaml:"anonymous_scopes"`
+
+	OIDC OIDCConfig `yaml:"oidc"`
+}
+
+// authFromEnv reads AuthConfig from $API_KEYS, entries separated by semicolons, $API_KEYS_FILE,
+// $AUTH_ANONYMOUS_SCOPES and the $OIDC_* variables, starting from a.
+func authFromEnv(a AuthConfig) (AuthConfig, error) {
+	if v, ok := os.LookupEnv("API_KEYS"); ok {
+		a.APIKeys = strings.FieldsFunc(v, func(r rune) bool { return r == ';' })
+	}
+
+	if v, ok := os.LookupEnv("API_KEYS_FILE"); ok {
+		a.APIKeysFile = v
+	}
+
+	if v, ok := os.LookupEnv("AUTH_ANONYMOUS_SCOPES"); ok {
+		a.AnonymousScopes = splitScopes(v)
+	}
+
+	var err error
+	a.OIDC, err = oidcFromEnv(a.OIDC)
+	return a, err
+}
+
+func (a AuthConfig) validate() error {
+	if _, err := newAuthenticator(a); err != nil {
+		return err
+	}
+
+	return a.OIDC.validate()
+}
+
+// newAuthenticator loads the API keys of the AuthConfig
+func newAuthenticator(config AuthConfig) (*authenticator, error) {
+	a := &authenticator{apiKeys: make(map[string]*APIKey), anonymous: config.AnonymousScopes}
+
+	if err := a.load(strings.NewReader(strings.Join(config.APIKeys, "\n"))); err != nil {
+		return nil, fmt.Errorf("invalid API keys: %w", err)
+	}
+
+	if path := config.APIKeysFile; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API keys file: %w", err)
+		}
+		defer f.Close()
+
+		if err := a.load(f); err != nil {
+			return nil, fmt.Errorf("invalid API keys file %s: %w", path, err)
+		}
+	}
+
+	if config.OIDC.enabled() {
+		a.tokens = newTokenVerifier(config.OIDC)
+	}
+
+	return a, nil
+}
+
+// load reads API key entries, one per line. Empty lines and lines starting with # are ignored.
+func (a *authenticator) load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return fmt.Errorf("%w at line %d: expected <name>:<sha256>:<scopes>", ErrInvalidAPIKeyEntry, line)
+		}
+
+		hash := strings.ToLower(parts[1])
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%w at line %d: key hash must be a hex encoded SHA-256", ErrInvalidAPIKeyEntry, line)
+		}
+
+		scopes := splitScopes(parts[2])
+		if err := validateScopes(scopes); err != nil {
+			return fmt.Errorf("%w at line %d: %s", ErrInvalidAPIKeyEntry, line, err)
+		}
+
+		a.apiKeys[hash] = &APIKey{Name: parts[0], Hash: hash, Scopes: scopes}
+	}
+
+	return scanner.Err()
+}
+
+// authenticate returns the Principal holding the given API key
+func (a *authenticator) authenticate(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+	k, ok := a.apiKeys[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Principal{Subject: k.Name, Scopes: k.Scopes, Tenant: a.keyTenants[k.Name]}, nil
+}
+
+// Authenticate reads credentials from the "Authorization: Bearer" or "X-API-Key" headers
+// and set the *Principal into context. Bearer credentials are either API keys or JWT, see tokenVerifier.
+// Requests without credentials get the anonymous scopes. Invalid credentials are rejected with an HTTP 401 response.
+func (s *server) Authenticate(c *gin.Context) {
+	key, bearer := c.GetHeader("X-API-Key"), false
+	if h := c.GetHeader("Authorization"); key == "" && h != "" {
+		const scheme = "bearer "
+		if len(h) <= len(scheme) || !strings.EqualFold(h[:len(scheme)], scheme) {
+			s.unauthorized(c, ErrInvalidCredentials)
+			return
+		}
+		key, bearer = strings.TrimSpace(h[len(scheme):]), true
+	}
+
+	if key == "" {
+		c.Set(PrincipalContextKey, &Principal{Scopes: s.auth.anonymous})
+		return
+	}
+
+	var p *Principal
+	var err error
+	if bearer && s.auth.tokens != nil && isJWT(key) {
+		p, err = s.auth.tokens.verify(c.Request.Context(), key)
+	} else {
+		p, err = s.auth.authenticate(key)
+	}
+
+	if errors.Is(err, ErrInvalidJWKS) { // identity provider is unreachable, credentials may be valid
+		_ = c.Error(newServiceUnavailableError(err))
+		c.Abort()
+		return
+	}
+
+	if err != nil {
+		s.unauthorized(c, err)
+		return
+	}
+
+	c.Set(PrincipalContextKey, p)
+}
+
+// RequireScope rejects requests whose Principal was not granted the scope.
+// Requests without credentials get an HTTP 401 response, others an HTTP 403 response.
+func (s *server) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := principal(c)
+		if p != nil && p.can(scope) {
+			return
+		}
+
+		if p == nil || p.Subject == "" {
+			s.unauthorized(c, ErrMissingCredentials)
+			return
+		}
+
+		_ = c.Error(newForbiddenError(fmt.Errorf("%w: %s is required", ErrInsufficientScope, scope)))
+		c.Abort()
+	}
+}
+
+func (s *server) unauthorized(c *gin.Context, err error) {
+	c.Header("WWW-Authenticate", `Bearer realm="images"`)
+	_ = c.Error(newUnauthorizedError(err))
+	c.Abort()
+}
+
+// principal returns the authenticated caller, nil when authentication did not run
+func principal(c *gin.Context) *Principal {
+	if v, ok := c.Get(PrincipalContextKey); ok {
+		return v.(*Principal)
+	}
+	return nil
+}
+
+// splitScopes reads a list of scopes separated by commas or spaces
+func splitScopes(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// validateScopes ensures API keys are granted at least one scope, and only known ones
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, s := range knownScopes {
+			known = known || s == scope
+		}
+
+		if !known {
+			return fmt.Errorf("%w %q, expected one of [%s]", ErrUnknownScope, scope, strings.Join(knownScopes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// GenerateAPIKey prints a new random API key, and the configuration entry holding its hash.
+// Scopes may be separated by commas or given as separate arguments.
+func GenerateAPIKey(name string, scopes []string) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("%w: name must be non empty and cannot contain ':'", ErrInvalidAPIKeyEntry)
+	}
+
+	scopes = splitScopes(strings.Join(scopes, ","))
+	if err := validateScopes(scopes); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAPIKeyEntry, err)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("cannot generate API key: %w", err)
+	}
+
+	key := apiKeyPrefix + hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(key))
+
+	fmt.Printf("key:   %s\n", key)
+	fmt.Printf("entry: %s:%s:%s\n", name, hex.EncodeToString(sum[:]), strings.Join(scopes, ","))
+	return nil
+}
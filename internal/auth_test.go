@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_authenticator_load(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries string
+		want    map[string]*APIKey
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			entries: "# comment\n\nreader:" + hashKey("foo") + ":images:read\n" +
+				"admin:" + strings.ToUpper(hashKey("bar")) + ":images:read,images:write images:delete",
+			want: map[string]*APIKey{
+				hashKey("foo"): {Name: "reader", Hash: hashKey("foo"), Scopes: []string{scopeImagesRead}},
+				hashKey("bar"): {Name: "admin", Hash: hashKey("bar"), Scopes: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete}},
+			},
+		},
+		{
+			name:    "Missing scopes",
+			entries: "reader:" + hashKey("foo") + ":",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown scope",
+			entries: "reader:" + hashKey("foo") + ":images:read,image:write",
+			wantErr: true,
+		},
+		{
+			name:    "Missing name",
+			entries: ":" + hashKey("foo") + ":images:read",
+			wantErr: true,
+		},
+		{
+			name:    "Plain text key",
+			entries: "reader:foo:images:read",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &authenticator{apiKeys: make(map[string]*APIKey)}
+			err := a.load(strings.NewReader(tt.entries))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidAPIKeyEntry)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, a.apiKeys)
+		})
+	}
+}
+
+func Test_server_Authenticate(t *testing.T) {
+	keys := "reader:" + hashKey("reader-key") + ":images:read\n" +
+		"writer:" + hashKey("writer-key") + ":images:read,images:write"
+
+	tests := []struct {
+		name       string
+		anonymous  string
+		method     string
+		target     string
+		headers    map[string]string
+		wantCode   int
+		wantHeader string
+	}{
+		{
+			name:       "Missing credentials",
+			method:     "GET",
+			wantCode:   401,
+			wantHeader: `Bearer realm="images"`,
+		},
+		{
+			name:      "Anonymous read",
+			anonymous: "images:read",
+			method:    "GET",
+			wantCode:  200,
+		},
+		{
+			name:       "Anonymous write",
+			anonymous:  "images:read",
+			method:     "DELETE",
+			target:     "/images/" + uuid.NewString(),
+			wantCode:   401,
+			wantHeader: `Bearer realm="images"`,
+		},
+		{
+			name:       "Unknown key",
+			method:     "GET",
+			headers:    map[string]string{"X-API-Key": "foo"},
+			wantCode:   401,
+			wantHeader: `Bearer realm="images"`,
+		},
+		{
+			name:       "Unknown scheme",
+			method:     "GET",
+			headers:    map[string]string{"Authorization": "Basic cmVhZGVyLWtleQ=="},
+			wantCode:   401,
+			wantHeader: `Bearer realm="images"`,
+		},
+		{
+			name:     "API key header",
+			method:   "GET",
+			headers:  map[string]string{"X-API-Key": "reader-key"},
+			wantCode: 200,
+		},
+		{
+			name:     "Bearer",
+			method:   "GET",
+			headers:  map[string]string{"Authorization": "Bearer reader-key"},
+			wantCode: 200,
+		},
+		{
+			name:     "Insufficient scope",
+			method:   "DELETE",
+			target:   "/images/" + uuid.NewString(),
+			headers:  map[string]string{"Authorization": "Bearer writer-key"},
+			wantCode: 403,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &authenticator{apiKeys: make(map[string]*APIKey), anonymous: splitScopes(tt.anonymous)}
+			assert.NoError(t, a.load(strings.NewReader(keys)))
+
+			s := &server{
+				router: gin.New(),
+				Image:  new(testingImageService),
+				auth:   a,
+				links:  testingLinks,
+			}
+			s.routes()
+
+			rw := httptest.NewRecorder()
+			if tt.target == "" {
+				tt.target = "/images"
+			}
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			s.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantCode, rw.Code)
+			assert.Equal(t, tt.wantHeader, rw.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestGenerateAPIKey(t *testing.T) {
+	assert.ErrorIs(t, GenerateAPIKey("reader", nil), ErrInvalidAPIKeyEntry, "scopes are required")
+	assert.ErrorIs(t, GenerateAPIKey("reader", []string{"images:read", "image:write"}), ErrInvalidAPIKeyEntry, "scopes must be known")
+	assert.ErrorIs(t, GenerateAPIKey("a:b", []string{"images:read"}), ErrInvalidAPIKeyEntry)
+	assert.NoError(t, GenerateAPIKey("reader", []string{"images:read,images:write"}))
+}
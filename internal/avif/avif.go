@@ -0,0 +1,140 @@
+// Package avif implements just enough of the AVIF (ISO-BMFF) container to read image dimensions.
+// Pixel decoding is not supported, AVIF images are stored as they are.
+package avif
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// maxBoxSize is the biggest box we accept to read in memory when looking for image properties
+const maxBoxSize = 1 << 20 // 1MB
+
+var (
+	// ErrDecodeNotSupported pixel decoding is not implemented
+	ErrDecodeNotSupported = errors.New("avif: decoding is not supported")
+
+	// ErrNoDimensions the file does not contain any image spatial extents property
+	ErrNoDimensions = errors.New("avif: cannot find image dimensions")
+
+	errInvalidBox = errors.New("avif: invalid box")
+)
+
+func init() {
+	image.RegisterFormat("avif", "????ftypavif", Decode, DecodeConfig)
+	image.RegisterFormat("avif", "????ftypavis", Decode, DecodeConfig)
+}
+
+// Decode always returns ErrDecodeNotSupported
+func Decode(io.Reader) (image.Image, error) {
+	return nil, ErrDecodeNotSupported
+}
+
+// DecodeConfig returns the dimensions of an AVIF image without decoding the pixels.
+// The largest 'ispe' property is used, so grid images report their full size rather than a tile size.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	br := bufio.NewReader(r)
+	for {
+		typ, payload, err := nextBox(br)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return image.Config{}, ErrNoDimensions
+			}
+			return image.Config{}, err
+		}
+
+		if typ != "meta" {
+			if _, err := io.Copy(io.Discard, payload); err != nil {
+				return image.Config{}, err
+			}
+			continue
+		}
+
+		if payload.N > maxBoxSize {
+			return image.Config{}, errInvalidBox
+		}
+
+		data, err := io.ReadAll(payload)
+		if err != nil {
+			return image.Config{}, err
+		}
+
+		if len(data) < 4 {
+			return image.Config{}, errInvalidBox
+		}
+
+		// 'meta' is a full box: skip version and flags
+		w, h := findSpatialExtents(data[4:])
+		if w == 0 || h == 0 {
+			return image.Config{}, ErrNoDimensions
+		}
+
+		return image.Config{Width: w, Height: h}, nil
+	}
+}
+
+// nextBox reads the next box header and returns its type and a reader limited to its payload
+func nextBox(r io.Reader) (string, *io.LimitedReader, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, err
+	}
+
+	size := uint64(binary.BigEndian.Uint32(header[:4]))
+	typ := string(header[4:])
+	headerSize := uint64(8)
+
+	if size == 1 { // 64 bits size
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return "", nil, err
+		}
+		size = binary.BigEndian.Uint64(large[:])
+		headerSize += 8
+	}
+
+	if size == 0 { // box extends to the end of the file
+		return typ, &io.LimitedReader{R: r, N: maxBoxSize + 1}, nil
+	}
+
+	if size < headerSize {
+		return "", nil, errInvalidBox
+	}
+
+	return typ, &io.LimitedReader{R: r, N: int64(size - headerSize)}, nil
+}
+
+// findSpatialExtents walks given boxes looking for 'ispe' properties inside 'iprp' and 'ipco' containers
+func findSpatialExtents(data []byte) (width int, height int) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		typ := string(data[4:8])
+		if size < 8 || size > len(data) {
+			return
+		}
+
+		payload := data[8:size]
+		switch typ {
+		case "iprp", "ipco":
+			if w, h := findSpatialExtents(payload); w*h > width*height {
+				width, height = w, h
+			}
+		case "ispe":
+			// full box: version and flags, then width and height
+			if len(payload) >= 12 {
+				w := int(binary.BigEndian.Uint32(payload[4:8]))
+				h := int(binary.BigEndian.Uint32(payload[8:12]))
+				if w*h > width*height {
+					width, height = w, h
+				}
+			}
+		}
+
+		data = data[size:]
+	}
+
+	return
+}
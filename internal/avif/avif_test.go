@@ -0,0 +1,81 @@
+package avif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// box encodes an ISO-BMFF box
+func box(typ string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, uint32(8+len(data)))
+	copy(b[4:], typ)
+	return append(b, data...)
+}
+
+// ispe encodes an image spatial extents property
+func ispe(w, h uint32) []byte {
+	p := make([]byte, 12)
+	binary.BigEndian.PutUint32(p[4:], w)
+	binary.BigEndian.PutUint32(p[8:], h)
+	return box("ispe", p)
+}
+
+func TestDecodeConfig(t *testing.T) {
+	ftyp := box("ftyp", []byte("avif"), make([]byte, 4), []byte("mif1avif"))
+	fullBoxHeader := make([]byte, 4)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    image.Config
+		wantErr error
+	}{
+		{
+			name: "Single image",
+			data: bytes.Join([][]byte{
+				ftyp,
+				box("meta", fullBoxHeader, box("hdlr", make([]byte, 8)), box("iprp", box("ipco", ispe(640, 480)))),
+				box("mdat", make([]byte, 32)),
+			}, nil),
+			want: image.Config{Width: 640, Height: 480},
+		},
+		{
+			name: "Grid image",
+			data: bytes.Join([][]byte{
+				ftyp,
+				box("meta", fullBoxHeader, box("iprp", box("ipco", ispe(512, 512), ispe(2048, 1024)))),
+			}, nil),
+			want: image.Config{Width: 2048, Height: 1024},
+		},
+		{
+			name:    "No dimensions",
+			data:    bytes.Join([][]byte{ftyp, box("mdat", make([]byte, 32))}, nil),
+			wantErr: ErrNoDimensions,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeConfig(bytes.NewReader(tt.data))
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			// registered with the image package
+			got, format, err := image.DecodeConfig(bytes.NewReader(tt.data))
+			assert.NoError(t, err)
+			assert.Equal(t, "avif", format)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
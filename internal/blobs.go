@@ -0,0 +1,338 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	s3 "github.com/minio/minio-go"
+)
+
+// Bucket layout:
+//
+//	<uuid>                 Image record: a JSON object holding the metadata, see record
+//	blobs/<sha256>         image content, shared by every record having the same digest
+//	refs/<sha256>/<uuid>   empty marker telling that the record <uuid> references the blob <sha256>
+//
+// The reference count of a blob is the number of markers under its refs/ prefix. A blob is deleted with
+// its last reference. Records are written after their blob and reference, and deleted before them,
+// so an interruption may leave an orphan blob but never a record without content.
+//
+// Objects written before content-addressed storage hold their content under <uuid> and do not have
+// the blob metadata. They are still served, and can be converted with Migrate. Records written before
+// the JSON body are empty and hold the metadata in the object user metadata, they are rewritten by Update.
+//
+// Every key is relative to imageService.Prefix, which isolates tenants sharing a bucket.
+const (
+	blobsPrefix = "blobs/"
+	refsPrefix  = "refs/"
+
+	metadataBlob = "X-Amz-Meta-Blob" // digest of the blob referenced by a record
+	metadataSize = "X-Amz-Meta-Size" // size of the blob, not of the record
+)
+
+// record is the body of an Image record. S3 limits the user metadata of an object to 2KB,
+// which the placeholders, the description and the grants would exceed.
+type record struct {
+	Name           string  `json:"name"`
+	ContentType    string  `json:"content_type"`
+	Description    string  `json:"description,omitempty"`
+	SHA256         string  `json:"sha256"`
+	PerceptualHash string  `json:"phash,omitempty"`
+	BlurHash       string  `json:"blurhash,omitempty"`
+	LQIP           string  `json:"lqip,omitempty"`
+	DominantColor  string  `json:"dominant_color,omitempty"`
+	AverageColor   string  `json:"average_color,omitempty"`
+	Watermark      bool    `json:"watermark,omitempty"`
+	Owner          string  `json:"owner,omitempty"`
+	Grants         []Grant `json:"grants,omitempty"`
+	Visibility     string  `json:"visibility"`
+}
+
+func newRecord(image *Image) *record {
+	return &record{
+		Name:           image.Name,
+		ContentType:    image.ContentType,
+		Description:    image.Description,
+		SHA256:         image.SHA256,
+		PerceptualHash: image.PerceptualHash,
+		BlurHash:       image.BlurHash,
+		LQIP:           image.LQIP,
+		DominantColor:  image.DominantColor,
+		AverageColor:   image.AverageColor,
+		Watermark:      image.Watermark,
+		Owner:          image.Owner,
+		Grants:         image.Grants,
+		Visibility:     image.Visibility,
+	}
+}
+
+// fill sets the fields of the Image stored by the record
+func (r *record) fill(image *Image) {
+	image.Name = r.Name
+	image.ContentType = r.ContentType
+	image.Description = r.Description
+	image.SHA256 = r.SHA256
+	image.PerceptualHash = r.PerceptualHash
+	image.BlurHash = r.BlurHash
+	image.LQIP = r.LQIP
+	image.DominantColor = r.DominantColor
+	image.AverageColor = r.AverageColor
+	image.Watermark = r.Watermark
+	image.Owner = r.Owner
+	image.Grants = r.Grants
+
+	// Unknown values fall back to the most restrictive visibility
+	if v, err := parseVisibility(r.Visibility); err == nil {
+		image.Visibility = v
+	} else {
+		image.Visibility = visibilityPrivate
+	}
+}
+
+// ErrMissingDigest content digest cannot be computed
+var ErrMissingDigest = errors.New("cannot compute image digest")
+
+func blobKey(digest string) string {
+	return blobsPrefix + digest
+}
+
+func refKey(digest string, id uuid.UUID) string {
+	return refsPrefix + digest + "/" + id.String()
+}
+
+// key returns the bucket key of the given relative key
+func (i *imageService) key(name string) string {
+	return i.Prefix + name
+}
+
+// lock serializes reference updates of given digest within this process and returns the unlock function.
+// Replicas are not synchronized: concurrent uploads and deletions of the same content on different
+// replicas may remove a blob which has just been referenced.
+func (i *imageService) lock(digest string) func() {
+	var n uint64
+	if len(digest) >= 2 {
+		n, _ = strconv.ParseUint(digest[:2], 16, 8)
+	}
+
+	i.locks[n].Lock()
+	return i.locks[n].Unlock
+}
+
+// putBlob uploads the image content unless a blob with the same digest already exists
+func (i *imageService) putBlob(ctx context.Context, image *Image) error {
+	_, err := i.statObject(ctx, i.key(blobKey(image.SHA256)))
+	if err == nil {
+		return nil // already stored
+	}
+
+	if s3.ToErrorResponse(err).StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	key := i.key(blobKey(image.SHA256))
+	ctx, span := i.startSpan(ctx, "PutObjectWithContext", key)
+	_, err = i.Minio.PutObjectWithContext(ctx, i.Minio.BucketName, key, image.Content, image.Size, s3.PutObjectOptions{
+		ContentType: image.ContentType,
+	})
+	endSpan(span, err)
+	return err
+}
+
+// putRef marks the blob as referenced by the given record
+func (i *imageService) putRef(ctx context.Context, digest string, id uuid.UUID) error {
+	key := i.key(refKey(digest, id))
+	ctx, span := i.startSpan(ctx, "PutObjectWithContext", key)
+	_, err := i.Minio.PutObjectWithContext(ctx, i.Minio.BucketName, key, bytes.NewReader(nil), 0, s3.PutObjectOptions{})
+	endSpan(span, err)
+	return err
+}
+
+// putRecord writes the Image metadata, only the blob reference is kept in the object user metadata
+func (i *imageService) putRecord(ctx context.Context, image *Image) error {
+	body, err := json.Marshal(newRecord(image))
+	if err != nil {
+		return err
+	}
+
+	key := i.key(image.Key.String())
+	ctx, span := i.startSpan(ctx, "PutObjectWithContext", key)
+	_, err = i.Minio.PutObjectWithContext(ctx, i.Minio.BucketName, key, bytes.NewReader(body), int64(len(body)), s3.PutObjectOptions{
+		ContentType: "application/json",
+		UserMetadata: map[string]string{
+			"blob": image.SHA256,
+			"size": strconv.FormatInt(image.Size, 10),
+		},
+	})
+	endSpan(span, err)
+	return err
+}
+
+// getRecord reads the body of the record into image, see record
+func (i *imageService) getRecord(ctx context.Context, image *Image) (err error) {
+	key := i.key(image.Key.String())
+	ctx, span := i.startSpan(ctx, "GetObjectWithContext", key)
+	defer func() { endSpan(span, err) }()
+
+	object, err := i.Minio.GetObjectWithContext(ctx, i.Minio.BucketName, key, s3.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	var r record
+	if err := json.NewDecoder(object).Decode(&r); err != nil {
+		if s3.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return ErrImageNotFound
+		}
+		return err
+	}
+
+	r.fill(image)
+	return nil
+}
+
+// refCount returns the number of records referencing the given blob
+func (i *imageService) refCount(ctx context.Context, digest string) (int, error) {
+	ids, err := i.refs(ctx, digest)
+	return len(ids), err
+}
+
+// refs returns the records referencing the given blob
+func (i *imageService) refs(ctx context.Context, digest string) (_ []uuid.UUID, err error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	prefix := i.key(refsPrefix + digest + "/")
+	_, span := i.startSpan(ctx, "ListObjectsV2", prefix)
+	defer func() { endSpan(span, err) }()
+
+	ids := make([]uuid.UUID, 0)
+	for object := range i.Minio.ListObjectsV2(i.Minio.BucketName, prefix, true, done) {
+		if err := object.Err; err != nil {
+			return nil, err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if id, err := uuid.Parse(strings.TrimPrefix(object.Key, prefix)); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// Migrate converts objects written before content-addressed storage into records referencing blobs.
+// It returns the number of migrated images and can safely be run several times.
+func (i *imageService) Migrate(ctx context.Context) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	_, span := i.startSpan(ctx, "ListObjectsV2", i.Prefix)
+	ids := make([]uuid.UUID, 0)
+	for object := range i.Minio.ListObjectsV2(i.Minio.BucketName, i.Prefix, false, done) {
+		if err := object.Err; err != nil {
+			endSpan(span, err)
+			return 0, err
+		}
+
+		if id, err := uuid.Parse(strings.TrimSuffix(strings.TrimPrefix(object.Key, i.Prefix), "/")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	endSpan(span, nil)
+
+	migrated := 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return migrated, err
+		}
+
+		ok, err := i.migrate(ctx, id)
+		if err != nil {
+			return migrated, err
+		}
+
+		if ok {
+			migrated++
+			logger(ctx).Debugf("migrated image %s", id)
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrate converts a single legacy object, it returns false when there is nothing to do
+func (i *imageService) migrate(ctx context.Context, id uuid.UUID) (bool, error) {
+	image, info, err := i.stat(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	if info.Metadata.Get(metadataBlob) != "" {
+		return false, nil // already migrated
+	}
+
+	// Objects uploaded before fingerprinting do not have a digest nor placeholders
+	if image.SHA256 == "" || image.BlurHash == "" {
+		if err := i.fingerprint(ctx, image); err != nil {
+			return false, err
+		}
+	}
+
+	unlock := i.lock(image.SHA256)
+	defer unlock()
+
+	// Server side copy of the content, unless the blob already exists
+	if _, err := i.statObject(ctx, i.key(blobKey(image.SHA256))); err != nil {
+		if s3.ToErrorResponse(err).StatusCode != http.StatusNotFound {
+			return false, err
+		}
+
+		dst, err := s3.NewDestinationInfo(i.Minio.BucketName, i.key(blobKey(image.SHA256)), nil, nil)
+		if err != nil {
+			return false, err
+		}
+
+		if err := i.Minio.CopyObject(dst, s3.NewSourceInfo(i.Minio.BucketName, i.key(id.String()), nil)); err != nil {
+			return false, err
+		}
+	}
+
+	if err := i.putRef(ctx, image.SHA256, id); err != nil {
+		return false, err
+	}
+
+	// Replace the legacy object by a record
+	if err := i.putRecord(ctx, image); err != nil {
+		return false, err
+	}
+	i.index(image)
+
+	return true, nil
+}
+
+// fingerprint reads the content of a legacy object to compute its digest and placeholders
+func (i *imageService) fingerprint(ctx context.Context, image *Image) error {
+	key := i.key(image.Key.String())
+	ctx, span := i.startSpan(ctx, "GetObjectWithContext", key)
+	object, err := i.Minio.GetObjectWithContext(ctx, i.Minio.BucketName, key, s3.GetObjectOptions{})
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	image.Content = object
+	defer func() { image.Content = nil }()
+
+	return image.fingerprint()
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	s3 "github.com/minio/minio-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_imageService_contentAddressed(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, fake := newTestingMinio(t, "images")
+	service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+	ctx := context.Background()
+
+	create := func(name string) *Image {
+		image, err := service.Create(ctx, &Image{
+			Key:         uuid.New(),
+			Name:        name,
+			ContentType: "image/png",
+			Content:     bytes.NewReader(gopher),
+			Size:        int64(len(gopher)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image
+	}
+
+	first, second := create("first.png"), create("second.png")
+	assert.Equal(t, first.SHA256, second.SHA256)
+	assert.ElementsMatch(t, []string{
+		blobKey(first.SHA256),
+		first.Key.String(),
+		refKey(first.SHA256, first.Key),
+		refKey(first.SHA256, second.Key),
+		second.Key.String(),
+	}, fake.keys("images"), "content should be stored once")
+
+	// Records are served with the blob content
+	got, err := service.Get(ctx, second.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, "second.png", got.Name)
+	assert.Equal(t, second.BlurHash, got.BlurHash)
+	assert.Equal(t, second.LQIP, got.LQIP)
+	assert.Equal(t, second.DominantColor, got.DominantColor)
+	assert.NotEmpty(t, got.AverageColor)
+	assert.Equal(t, int64(len(gopher)), got.Size)
+	content, _ := io.ReadAll(got.Content)
+	assert.Equal(t, gopher, content)
+
+	// Updates rewrite the record metadata only, which does not fit in the object user metadata
+	grants := make([]Grant, maxGrants)
+	for n := range grants {
+		grants[n] = Grant{Group: fmt.Sprintf("%s-%d", strings.Repeat("design", 16), n), Permission: grantWrite}
+	}
+	got.Owner, got.Visibility, got.Grants = "alice", visibilityPublic, grants
+	got.Description = strings.Repeat("a long description ", 256)
+	_, err = service.Update(ctx, got)
+	assert.NoError(t, err)
+
+	got, err = service.Get(ctx, second.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", got.Owner)
+	assert.Equal(t, visibilityPublic, got.Visibility)
+	assert.Equal(t, grants, got.Grants)
+	assert.Equal(t, strings.Repeat("a long description ", 256), got.Description)
+	assert.Equal(t, "image/png", got.ContentType)
+	assert.Equal(t, int64(len(gopher)), got.Size)
+
+	list, err := service.List(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	// Records deleted meanwhile are not written back
+	deleted, err := service.Create(ctx, &Image{Key: uuid.New(), ContentType: "image/png", Content: bytes.NewReader([]byte("not an image")), Size: 12})
+	assert.NoError(t, err)
+	assert.NoError(t, service.Delete(ctx, deleted.Key))
+	_, err = service.Update(ctx, deleted)
+	assert.ErrorIs(t, err, ErrImageNotFound)
+	assert.NotContains(t, fake.keys("images"), deleted.Key.String())
+
+	// nor records whose blob was removed by a concurrent deletion
+	orphan, err := service.Create(ctx, &Image{Key: uuid.New(), ContentType: "image/png", Content: bytes.NewReader([]byte("orphan")), Size: 6})
+	assert.NoError(t, err)
+	fake.mu.Lock()
+	delete(fake.objects, "images/"+blobKey(orphan.SHA256))
+	fake.mu.Unlock()
+	_, err = service.Update(ctx, orphan)
+	assert.ErrorIs(t, err, ErrImageNotFound)
+	assert.NoError(t, service.Delete(ctx, orphan.Key))
+
+	// The blob is kept while referenced
+	assert.NoError(t, service.Delete(ctx, first.Key))
+	assert.Contains(t, fake.keys("images"), blobKey(first.SHA256))
+
+	assert.NoError(t, service.Delete(ctx, second.Key))
+	assert.Empty(t, fake.keys("images"))
+
+	_, err = service.Get(ctx, first.Key)
+	assert.ErrorIs(t, err, ErrImageNotFound)
+}
+
+func Test_imageService_Migrate(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, fake := newTestingMinio(t, "images")
+	service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+	ctx := context.Background()
+
+	// Objects written before content-addressed storage
+	legacy := []uuid.UUID{uuid.New(), uuid.New()}
+	for _, id := range legacy {
+		_, err := client.PutObject("images", id.String(), bytes.NewReader(gopher), int64(len(gopher)), s3.PutObjectOptions{
+			ContentType:  "image/png",
+			UserMetadata: map[string]string{"name": "gopher.png", "description": "legacy"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Legacy objects are still served
+	got, err := service.Get(ctx, legacy[0])
+	assert.NoError(t, err)
+	content, _ := io.ReadAll(got.Content)
+	assert.Equal(t, gopher, content)
+
+	migrated, err := service.Migrate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+
+	migrated, err = service.Migrate(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated, "migration should be idempotent")
+
+	got, err = service.Get(ctx, legacy[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "gopher.png", got.Name)
+	assert.Equal(t, "legacy", got.Description)
+	assert.NotEmpty(t, got.BlurHash, "placeholders should be computed while migrating")
+	assert.Equal(t, int64(len(gopher)), got.Size)
+	content, _ = io.ReadAll(got.Content)
+	assert.Equal(t, gopher, content)
+
+	count, err := service.refCount(ctx, got.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, service.Delete(ctx, legacy...))
+	assert.Empty(t, fake.keys("images"))
+}
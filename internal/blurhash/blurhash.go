@@ -0,0 +1,144 @@
+// Package blurhash implements a BlurHash encoder, see https://blurha.sh.
+// A BlurHash is a short string describing the low frequencies of an image, used to render a placeholder.
+package blurhash
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+const characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// ErrInvalidComponents the number of components is not between 1 and 9
+var ErrInvalidComponents = errors.New("blurhash components must be between 1 and 9")
+
+// Encode computes the BlurHash of m using given number of horizontal and vertical components.
+// The cost is proportional to the number of pixels, callers should pass a thumbnail.
+func Encode(m image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", ErrInvalidComponents
+	}
+
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.New("blurhash: empty image")
+	}
+
+	// Convert the pixels to linear RGB once
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(m.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			pixels[y*width+x] = [3]float64{toLinear(c.R), toLinear(c.G), toLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			factors = append(factors, factor(pixels, width, height, i, j))
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+
+		quantised := clamp(int(math.Floor(actual*166-0.5)), 0, 82)
+		maximum = float64(quantised+1) / 166
+		hash.WriteString(encode83(quantised, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+
+	hash.WriteString(encode83(encodeDC(dc), 4))
+	for _, f := range ac {
+		hash.WriteString(encode83(encodeAC(f, maximum), 2))
+	}
+
+	return hash.String(), nil
+}
+
+// factor computes the contribution of the cosine basis function (i, j) to the image
+func factor(pixels [][3]float64, width, height, i, j int) [3]float64 {
+	var f [3]float64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+			p := pixels[y*width+x]
+			f[0] += basis * p[0]
+			f[1] += basis * p[1]
+			f[2] += basis * p[2]
+		}
+	}
+
+	normalisation := 2.0
+	if i == 0 && j == 0 {
+		normalisation = 1
+	}
+
+	scale := normalisation / float64(width*height)
+	return [3]float64{f[0] * scale, f[1] * scale, f[2] * scale}
+}
+
+func encodeDC(f [3]float64) int {
+	return toSRGB(f[0])<<16 | toSRGB(f[1])<<8 | toSRGB(f[2])
+}
+
+func encodeAC(f [3]float64, maximum float64) int {
+	quantise := func(v float64) int {
+		return clamp(int(math.Floor(signPow(v/maximum, 0.5)*9+9.5)), 0, 18)
+	}
+
+	return quantise(f[0])*19*19 + quantise(f[1])*19 + quantise(f[2])
+}
+
+func encode83(value, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = characters[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func toLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func toSRGB(v float64) int {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,76 @@
+package blurhash
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/SkYNewZ/images-server/internal/imagetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name        string
+		m           image.Image
+		xComponents int
+		yComponents int
+		want        string
+		wantErr     error
+	}{
+		{
+			name:        "uniform red",
+			m:           imagetest.Uniform(16, 12, color.NRGBA{R: 255, A: 255}),
+			xComponents: 4,
+			yComponents: 3,
+			want:        "LRTI:j]9fQ]9|co1fQo1fQfQfQfQ",
+		},
+		{
+			name:        "DC only",
+			m:           imagetest.Uniform(8, 8, color.NRGBA{G: 128, B: 255, A: 255}),
+			xComponents: 1,
+			yComponents: 1,
+			want:        "0004*=",
+		},
+		{
+			name:        "invalid components",
+			m:           imagetest.Uniform(1, 1, color.White),
+			xComponents: 10,
+			yComponents: 3,
+			wantErr:     ErrInvalidComponents,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Encode(tt.m, tt.xComponents, tt.yComponents)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEncode_gradient(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 32, 24))
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 32; x++ {
+			m.Set(x, y, color.Gray{Y: uint8(x * 8)})
+		}
+	}
+
+	got, err := Encode(m, 4, 3)
+	assert.NoError(t, err)
+	assert.Len(t, got, 2+4+2*11)
+	assert.Equal(t, "L", got[:1], "size flag should encode 4x3 components")
+
+	// The average of the gradient is a mid gray
+	dc := 0
+	for _, c := range got[2:6] {
+		dc = dc*83 + strings.IndexRune(characters, c)
+	}
+	r, g, b := dc>>16, dc>>8&0xff, dc&0xff
+	assert.Equal(t, r, g)
+	assert.Equal(t, g, b)
+	assert.InDelta(t, 128, r, 40)
+}
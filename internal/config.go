@@ -0,0 +1,356 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SkYNewZ/images-server/internal/minio"
+	"gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces secrets in printed configurations, see Config.redacted
+const redactedValue = "REDACTED"
+
+// Config is the whole server configuration, see LoadConfig
+type Config struct {
+	Server       ServerConfig    `yaml:"server"`
+	Storage      StorageConfig   `yaml:"storage"`
+	Uploads      UploadLimits    `yaml:"uploads"`
+	ContentTypes []string        `yaml:"content_types"`
+	Watermark    WatermarkConfig `yaml:"watermark"`
+	Auth         AuthConfig      `yaml:"auth"`
+	Links        LinkConfig      `yaml:"links"`
+	Quotas       QuotaConfig     `yaml:"quotas"`
+	Tenancy      TenancyConfig   `yaml:"tenancy"`
+	CORS         CORSConfig      `yaml:"cors"`
+	RateLimit    RateLimitConfig `yaml:"rate_limit"`
+	Readiness    ReadinessConfig `yaml:"readiness"`
+	Tracing      TracingConfig   `yaml:"tracing"`
+	Log          LogConfig       `yaml:"log"`
+	Errors       ErrorsConfig    `yaml:"errors"`
+	API          APIConfig       `yaml:"api"`
+}
+
+// ServerConfig describes the HTTP server
+type ServerConfig struct {
+	Port               int           `yaml:"port"`
+	ReadTimeout        time.Duration `yaml:"read_timeout"`
+	WriteTimeout       time.Duration `yaml:"write_timeout"`
+	IdleTimeout        time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout"`     // how long in-flight requests are awaited on shutdown
+	StartupTimeout     time.Duration `yaml:"startup_timeout"`      // how long the storage is awaited at startup, forever when zero
+	MaxMultipartMemory int64         `yaml:"max_multipart_memory"` // bigger uploads are spilled to disk
+
+	// TrustedProxies are the addresses or CIDR allowed to set X-Forwarded-For, the remote address
+	// of other requests is their client address, see clientIP
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+}
+
+// StorageConfig describes the object storage holding the images
+type StorageConfig struct {
+	minio.Config `yaml:",inline"`
+	Bucket       string `yaml:"bucket"` // bucket of single tenant servers, and default bucket of tenants
+}
+
+// defaultConfig returns the options used when nothing is configured
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:               8080,
+			ReadTimeout:        15 * time.Second,
+			WriteTimeout:       15 * time.Second,
+			IdleTimeout:        60 * time.Second,
+			ShutdownTimeout:    10 * time.Second,
+			StartupTimeout:     2 * time.Minute,
+			MaxMultipartMemory: 5 << 20, // 5MB
+		},
+		Storage:      StorageConfig{Bucket: bucketNameImages},
+		Uploads:      defaultUploadLimits(),
+		ContentTypes: defaultContentTypes,
+		Watermark:    defaultWatermarkConfig(),
+		Auth:         AuthConfig{OIDC: defaultOIDCConfig()},
+		Links:        defaultLinkConfig(),
+		Tenancy:      defaultTenancyConfig(),
+		CORS:         defaultCORSConfig(),
+		RateLimit:    defaultRateLimitConfig(),
+		Readiness:    defaultReadinessConfig(),
+		Tracing:      defaultTracingConfig(),
+		Log:          defaultLogConfig(),
+		Errors:       defaultErrorsConfig(),
+	}
+}
+
+// ConfigError lists every invalid setting
+type ConfigError []error
+
+// Error implements error
+func (e ConfigError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+
+	return "invalid configuration:\n\t" + strings.Join(messages, "\n\t")
+}
+
+// Is tells whether one of the errors matches target, see errors.Is
+func (e ConfigError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadConfig reads the Config from, by increasing precedence: defaults, the YAML file named by --config
+// or $CONFIG_FILE, environment variables and command-line flags. Every invalid setting is reported at once
+// in a ConfigError, along with the Config as loaded.
+func LoadConfig(args []string) (Config, error) {
+	c := defaultConfig()
+
+	// Flags are parsed once to find the file, then applied over the file and the environment
+	path := os.Getenv("CONFIG_FILE")
+	scratch := defaultConfig()
+	if err := configFlags(&scratch, &path).Parse(args); err != nil {
+		return c, err
+	}
+
+	var errs ConfigError
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if path != "" {
+		collect(c.load(path))
+	}
+
+	for _, err := range c.fromEnv() {
+		collect(err)
+	}
+
+	collect(configFlags(&c, &path).Parse(args))
+
+	c.Tenancy.setDefaults(c.Storage.Bucket)
+	for _, err := range c.validate() {
+		collect(err)
+	}
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+
+	return c, nil
+}
+
+// configFlags declares the command-line flags overriding the Config, their defaults are the current values
+func configFlags(c *Config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("images-server", flag.ContinueOnError)
+	fs.StringVar(path, "config", *path, "YAML configuration file ($CONFIG_FILE)")
+	fs.IntVar(&c.Server.Port, "port", c.Server.Port, "listening port ($PORT)")
+	fs.StringVar(&c.Storage.Endpoint, "minio-endpoint", c.Storage.Endpoint, "MinIO endpoint ($MINIO_ENDPOINT)")
+	fs.StringVar(&c.Storage.User, "minio-user", c.Storage.User, "MinIO user ($MINIO_USER)")
+	fs.BoolVar(&c.Storage.DisableSSL, "minio-disable-ssl", c.Storage.DisableSSL, "connect to MinIO without TLS ($MINIO_DISABLE_SSL)")
+	fs.StringVar(&c.Storage.Bucket, "bucket", c.Storage.Bucket, "bucket storing the images ($MINIO_BUCKET)")
+	fs.Int64Var(&c.Uploads.MaxBytes, "max-upload-bytes", c.Uploads.MaxBytes, "maximum size of uploaded images ($UPLOAD_MAX_BYTES)")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "minimum level of logs, e.g. debug ($LOG_LEVEL)")
+	return fs
+}
+
+// load reads the YAML file at path over the Config, unknown settings are rejected
+func (c *Config) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid configuration file: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// fromEnv reads every section of the Config from environment variables
+func (c *Config) fromEnv() []error {
+	var errs []error
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	var err error
+	c.Server, err = serverFromEnv(c.Server)
+	collect(err)
+	c.Storage, err = storageFromEnv(c.Storage)
+	collect(err)
+	c.Uploads, err = uploadLimitsFromEnv(c.Uploads)
+	collect(err)
+	c.ContentTypes = contentTypesFromEnv(c.ContentTypes)
+	c.Watermark, err = watermarkFromEnv(c.Watermark)
+	collect(err)
+	c.Auth, err = authFromEnv(c.Auth)
+	collect(err)
+	c.Links, err = linksFromEnv(c.Links)
+	collect(err)
+	c.Quotas, err = quotasFromEnv(c.Quotas)
+	collect(err)
+	c.Tenancy, err = tenancyFromEnv(c.Tenancy)
+	collect(err)
+	c.CORS, err = corsFromEnv(c.CORS)
+	collect(err)
+	c.RateLimit, err = rateLimitFromEnv(c.RateLimit)
+	collect(err)
+	c.Readiness, err = readinessFromEnv(c.Readiness)
+	collect(err)
+	c.Tracing, err = tracingFromEnv(c.Tracing)
+	collect(err)
+	c.Log = logFromEnv(c.Log)
+	c.Errors = errorsFromEnv(c.Errors)
+	c.API, err = apiFromEnv(c.API)
+	collect(err)
+
+	return errs
+}
+
+// validate checks every section of the Config
+func (c Config) validate() []error {
+	var errs []error
+	for _, err := range []error{
+		c.Server.validate(),
+		c.Storage.validate(),
+		c.Watermark.validate(),
+		c.Auth.validate(),
+		c.Links.validate(),
+		c.Tenancy.validate(),
+		c.CORS.validate(),
+		c.RateLimit.validate(),
+		c.Readiness.validate(),
+		c.Tracing.validate(),
+		c.Log.validate(),
+		c.Errors.validate(),
+		c.API.validate(),
+	} {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// redacted returns a copy of the Config without secrets, to be printed
+func (c Config) redacted() Config {
+	if c.Storage.Password != "" {
+		c.Storage.Password = redactedValue
+	}
+
+	if c.Links.Key != "" {
+		c.Links.Key = redactedValue
+	}
+
+	return c
+}
+
+// serverFromEnv reads ServerConfig from $PORT, $TRUSTED_PROXIES and $SERVER_* environment variables,
+// starting from s. $TRUSTED_PROXIES lists the addresses or CIDR of the reverse proxies, separated by commas.
+func serverFromEnv(s ServerConfig) (ServerConfig, error) {
+	if v, ok := os.LookupEnv("PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return s, fmt.Errorf("invalid $PORT: %w", err)
+		}
+		s.Port = port
+	}
+
+	durations := map[string]*time.Duration{
+		"SERVER_READ_TIMEOUT":     &s.ReadTimeout,
+		"SERVER_WRITE_TIMEOUT":    &s.WriteTimeout,
+		"SERVER_IDLE_TIMEOUT":     &s.IdleTimeout,
+		"SERVER_SHUTDOWN_TIMEOUT": &s.ShutdownTimeout,
+		"SERVER_STARTUP_TIMEOUT":  &s.StartupTimeout,
+	}
+	for k, p := range durations {
+		if v, ok := os.LookupEnv(k); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return s, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = d
+		}
+	}
+
+	if v, ok := os.LookupEnv("SERVER_MAX_MULTIPART_MEMORY"); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid $SERVER_MAX_MULTIPART_MEMORY: %w", err)
+		}
+		s.MaxMultipartMemory = i
+	}
+
+	if v, ok := os.LookupEnv("TRUSTED_PROXIES"); ok {
+		s.TrustedProxies = splitList(v)
+	}
+
+	return s, nil
+}
+
+func (s ServerConfig) validate() error {
+	if s.Port <= 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid server port %d", s.Port)
+	}
+
+	if s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 || s.ShutdownTimeout < 0 || s.StartupTimeout < 0 {
+		return fmt.Errorf("invalid server timeouts: must not be negative")
+	}
+
+	if s.MaxMultipartMemory <= 0 {
+		return fmt.Errorf("invalid server max multipart memory: must be positive")
+	}
+
+	_, err := parseTrustedProxies(s.TrustedProxies)
+	return err
+}
+
+// storageFromEnv reads StorageConfig from $MINIO_ENDPOINT, $MINIO_USER, $MINIO_PASSWORD, $MINIO_DISABLE_SSL
+// and $MINIO_BUCKET, starting from s
+func storageFromEnv(s StorageConfig) (StorageConfig, error) {
+	strs := map[string]*string{
+		"MINIO_ENDPOINT": &s.Endpoint,
+		"MINIO_USER":     &s.User,
+		"MINIO_PASSWORD": &s.Password,
+		"MINIO_BUCKET":   &s.Bucket,
+	}
+	for k, p := range strs {
+		if v, ok := os.LookupEnv(k); ok {
+			*p = v
+		}
+	}
+
+	if v, ok := os.LookupEnv("MINIO_DISABLE_SSL"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, fmt.Errorf("invalid $MINIO_DISABLE_SSL: %w", err)
+		}
+		s.DisableSSL = b
+	}
+
+	return s, nil
+}
+
+func (s StorageConfig) validate() error {
+	if s.Bucket == "" {
+		return fmt.Errorf("%w: bucket must be specified", minio.ErrInvalidConfig)
+	}
+
+	return s.Config.Validate()
+}
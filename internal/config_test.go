@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SkYNewZ/images-server/internal/minio"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+// writeConfigFile writes a YAML configuration file and returns its path
+func writeConfigFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 9000
+  read_timeout: 30s
+  trusted_proxies: [10.0.0.0/8]
+storage:
+  endpoint: minio.example.com
+  user: images
+  password: file-secret
+  bucket: from-file
+uploads:
+  max_bytes: 1024
+links:
+  key: 0123456789abcdef0123456789abcdef
+rate_limit:
+  limits:
+    list: 10/1s
+tenancy:
+  tenants:
+    - id: marketing
+      prefix: marketing/
+`)
+
+	os.Setenv("PORT", "9001")
+	os.Setenv("MINIO_PASSWORD", "env-secret")
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	defer os.Unsetenv("PORT")
+	defer os.Unsetenv("MINIO_PASSWORD")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	got, err := LoadConfig([]string{"--config", path, "--port", "9002"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 9002, got.Server.Port, "flags take precedence over the environment")
+	assert.Equal(t, "env-secret", got.Storage.Password, "environment takes precedence over the file")
+	assert.Equal(t, "from-file", got.Storage.Bucket, "file takes precedence over defaults")
+	assert.Equal(t, 30*time.Second, got.Server.ReadTimeout)
+	assert.Equal(t, defaultConfig().Server.WriteTimeout, got.Server.WriteTimeout)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, got.Server.TrustedProxies)
+	assert.Equal(t, int64(1024), got.Uploads.MaxBytes)
+	assert.Equal(t, defaultUploadLimits().MaxPixels, got.Uploads.MaxPixels)
+	assert.Equal(t, RateLimit{Requests: 10, Period: time.Second}, got.RateLimit.Limits[rateLimitList])
+	assert.Equal(t, defaultRateLimitConfig().Limits[rateLimitUpload], got.RateLimit.Limits[rateLimitUpload])
+	assert.Equal(t, "from-file", got.Tenancy.Tenants[0].Bucket, "tenants are stored in the server bucket by default")
+}
+
+func TestLoadConfig_errors(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 0
+  trusted_proxies: [proxy]
+watermark:
+  position: middle
+cors:
+  allowed_origins: ["*"]
+  allow_credentials: true
+`)
+
+	os.Setenv("UPLOAD_MAX_BYTES", "lots")
+	defer os.Unsetenv("UPLOAD_MAX_BYTES")
+
+	_, err := LoadConfig([]string{"--config", path})
+
+	var errs ConfigError
+	if assert.True(t, errors.As(err, &errs), err) {
+		assert.Len(t, errs, 5, "every invalid setting is reported: %s", err)
+	}
+	assert.ErrorIs(t, err, minio.ErrInvalidConfig)
+	assert.ErrorIs(t, err, ErrInvalidWatermark)
+	assert.ErrorIs(t, err, ErrInvalidCORSConfig)
+
+	_, err = LoadConfig([]string{"--config", writeConfigFile(t, "server:\n  prot: 8080\n")})
+	assert.Error(t, err, "unknown settings are rejected")
+
+	_, err = LoadConfig([]string{"--unknown"})
+	assert.Error(t, err)
+}
+
+func TestConfig_redacted(t *testing.T) {
+	c := defaultConfig()
+	c.Storage.Password = "minio-secret"
+	c.Links.Key = "links-secret"
+
+	out, err := yaml.Marshal(c.redacted())
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "minio-secret")
+	assert.NotContains(t, string(out), "links-secret")
+	assert.Contains(t, string(out), redactedValue)
+	assert.Equal(t, "minio-secret", c.Storage.Password, "the configuration is not modified")
+
+	// Printed configurations can be loaded back
+	var loaded Config
+	assert.NoError(t, yaml.UnmarshalStrict(out, &loaded))
+	assert.Equal(t, c.RateLimit.Limits, loaded.RateLimit.Limits)
+	assert.Equal(t, c.Server, loaded.Server)
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+const (
+	defaultJPEGQuality = 85
+	maxSVGRasterSize   = 4096 // SVG are rasterized at their intrinsic size, bounded to this value
+	defaultSVGSize     = 512  // size used when an SVG does not define its dimensions
+)
+
+var (
+	// ErrUnknownFormat requested output format is not supported
+	ErrUnknownFormat = errors.New("unknown output format")
+
+	// ErrNotAcceptable no representation of the image matches the Accept header
+	ErrNotAcceptable = errors.New("no acceptable representation")
+
+	// ErrCannotConvert the image cannot be decoded
+	ErrCannotConvert = errors.New("cannot convert image")
+
+	// ErrInvalidConversion conversion options are invalid
+	ErrInvalidConversion = errors.New("invalid conversion options")
+)
+
+// encoder writes an image.Image using given conversion options
+type encoder func(w io.Writer, m image.Image, c conversion) error
+
+// encoders lists available output formats by content type
+var encoders = map[string]encoder{
+	"image/jpeg": encodeJPEG,
+	"image/png":  encodePNG,
+}
+
+// outputFormats maps ?format= values to content types
+var outputFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"png":  "image/png",
+}
+
+// extensions is used to rename converted files
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// conversion describes the representation of an Image requested by a client.
+// A zero conversion returns the original image.
+type conversion struct {
+	ContentType string // target content type, empty to keep the original
+	Quality     int    // JPEG quality from 1 to 100
+
+	// Watermark is composited onto the image when set, the original is never served in that case
+	Watermark *watermark
+}
+
+// parseConversion reads conversion options from the request.
+// ?format= takes precedence over the Accept header.
+func parseConversion(req *http.Request, original *Image) (conversion, error) {
+	var c conversion
+	q := req.URL.Query()
+
+	if v := q.Get("quality"); v != "" {
+		quality, err := strconv.Atoi(v)
+		if err != nil || quality < 1 || quality > 100 {
+			return c, fmt.Errorf("%w: quality must be an integer between 1 and 100", ErrInvalidConversion)
+		}
+		c.Quality = quality
+	}
+
+	if v := q.Get("format"); v != "" {
+		contentType, ok := outputFormats[strings.ToLower(v)]
+		if !ok {
+			return c, fmt.Errorf("%w: %q, use one of [jpeg, png]", ErrUnknownFormat, v)
+		}
+		c.ContentType = contentType
+	} else {
+		contentType, err := negotiateContentType(req.Header.Get("Accept"), original.ContentType)
+		if err != nil {
+			return c, err
+		}
+		c.ContentType = contentType
+	}
+
+	if c.ContentType != "image/jpeg" {
+		c.Quality = 0 // only meaningful for JPEG
+	}
+
+	if c.ContentType == original.ContentType && c.Quality == 0 {
+		c.ContentType = "" // nothing to do
+	}
+
+	return c, nil
+}
+
+// acceptRange is a media range of an Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns media ranges sorted by preference
+func parseAccept(header string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	return ranges
+}
+
+// acceptQuality returns the quality given to contentType by the Accept header.
+// Only explicit media types are considered when exact is true.
+func acceptQuality(ranges []acceptRange, contentType string, exact bool) float64 {
+	best := 0.0
+	specificity := -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediaType == contentType:
+			s = 2
+		case !exact && r.mediaType == strings.SplitN(contentType, "/", 2)[0]+"/*":
+			s = 1
+		case !exact && r.mediaType == "*/*":
+			s = 0
+		}
+
+		if s > specificity {
+			best, specificity = r.q, s
+		}
+	}
+
+	return best
+}
+
+// negotiateContentType picks the content type to serve according to the Accept header.
+// The original is served when acceptable, otherwise the preferred encodable content type is used.
+func negotiateContentType(header string, original string) (string, error) {
+	if header == "" {
+		return original, nil
+	}
+
+	ranges := parseAccept(header)
+	if acceptQuality(ranges, original, false) > 0 {
+		return original, nil
+	}
+
+	candidates := make([]string, 0, len(encoders))
+	for c := range encoders {
+		candidates = append(candidates, c)
+	}
+	sort.Strings(candidates)
+
+	best, bestQ := "", 0.0
+	for _, c := range candidates {
+		if q := acceptQuality(ranges, c, false); q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+
+	if best == "" {
+		return "", ErrNotAcceptable
+	}
+
+	return best, nil
+}
+
+// apply returns the converted Image, the original Image is returned when there is nothing to do.
+// Only the first frame of animated images is converted.
+func (c conversion) apply(original *Image) (*Image, error) {
+	if c.ContentType == "" && c.Watermark == nil {
+		return original, nil
+	}
+
+	// Watermarked images keep their format when we can encode it
+	if c.ContentType == "" {
+		c.ContentType = original.ContentType
+		if _, ok := encoders[c.ContentType]; !ok {
+			c.ContentType = "image/png"
+		}
+	}
+
+	enc, ok := encoders[c.ContentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, c.ContentType)
+	}
+
+	m, err := decode(original)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Watermark != nil {
+		m = c.Watermark.draw(m)
+	}
+
+	var buf bytes.Buffer
+	if err := enc(&buf, m, c); err != nil {
+		return nil, err
+	}
+
+	converted := *original
+	converted.Content = &buf
+	converted.ContentType = c.ContentType
+	converted.Size = int64(buf.Len())
+	converted.Name = convertedName(original.Name, c.ContentType)
+	return &converted, nil
+}
+
+// convertedName renames a file converted to contentType
+func convertedName(name string, contentType string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + extensions[contentType]
+}
+
+// decode reads the pixels of given Image, rasterizing SVG images
+func decode(i *Image) (image.Image, error) {
+	if i.ContentType == "image/svg+xml" {
+		return rasterizeSVG(i.Content)
+	}
+
+	m, _, err := image.Decode(i.Content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCannotConvert, err)
+	}
+
+	return m, nil
+}
+
+// rasterizeSVG renders an SVG document at its intrinsic size
+func rasterizeSVG(r io.Reader) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(r, oksvg.WarnErrorMode)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCannotConvert, err)
+	}
+
+	w, h := icon.ViewBox.W, icon.ViewBox.H
+	if w <= 0 || h <= 0 {
+		w, h = defaultSVGSize, defaultSVGSize
+	}
+
+	if scale := maxSVGRasterSize / math.Max(w, h); scale < 1 {
+		w, h = w*scale, h*scale
+	}
+
+	width, height := int(math.Ceil(w)), int(math.Ceil(h))
+	icon.SetTarget(0, 0, float64(width), float64(height))
+
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	scanner := rasterx.NewScannerGV(width, height, m, m.Bounds())
+	icon.Draw(rasterx.NewDasher(width, height, scanner), 1)
+	return m, nil
+}
+
+func encodeJPEG(w io.Writer, m image.Image, c conversion) error {
+	quality := c.Quality
+	if quality == 0 {
+		quality = defaultJPEGQuality
+	}
+
+	// JPEG has no alpha channel, flatten on a white background
+	flat := image.NewRGBA(m.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), m, m.Bounds().Min, draw.Over)
+
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: quality})
+}
+
+func encodePNG(w io.Writer, m image.Image, _ conversion) error {
+	e := png.Encoder{CompressionLevel: png.BestCompression}
+	return e.Encode(w, m)
+}
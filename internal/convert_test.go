@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_negotiateContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		original string
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "No Accept header",
+			accept:   "",
+			original: "image/png",
+			want:     "image/png",
+		},
+		{
+			name:     "Browser Accept header",
+			accept:   "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8",
+			original: "image/png",
+			want:     "image/png",
+		},
+		{
+			name:     "Original accepted through wildcard",
+			accept:   "image/*",
+			original: "image/gif",
+			want:     "image/gif",
+		},
+		{
+			name:     "Original not acceptable",
+			accept:   "image/png;q=0.5, image/jpeg",
+			original: "image/tiff",
+			want:     "image/jpeg",
+		},
+		{
+			name:     "Original explicitly refused",
+			accept:   "image/tiff;q=0, image/*",
+			original: "image/tiff",
+			want:     "image/jpeg",
+		},
+		{
+			name:     "Nothing acceptable",
+			accept:   "text/html",
+			original: "image/png",
+			wantErr:  ErrNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateContentType(tt.accept, tt.original)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_parseConversion(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		accept   string
+		original string
+		want     conversion
+		wantErr  error
+	}{
+		{
+			name:     "Original",
+			url:      "/",
+			original: "image/png",
+			want:     conversion{},
+		},
+		{
+			name:     "Explicit format wins over Accept",
+			url:      "/?format=JPG&quality=50",
+			accept:   "image/png",
+			original: "image/png",
+			want:     conversion{ContentType: "image/jpeg", Quality: 50},
+		},
+		{
+			name:     "Quality re-encodes JPEG",
+			url:      "/?quality=10",
+			original: "image/jpeg",
+			want:     conversion{ContentType: "image/jpeg", Quality: 10},
+		},
+		{
+			name:     "Quality is ignored for PNG",
+			url:      "/?quality=10",
+			original: "image/png",
+			want:     conversion{},
+		},
+		{
+			name:     "Invalid quality",
+			url:      "/?format=jpeg&quality=101",
+			original: "image/png",
+			wantErr:  ErrInvalidConversion,
+		},
+		{
+			name:     "Unknown format",
+			url:      "/?format=bmp",
+			original: "image/png",
+			wantErr:  ErrUnknownFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			got, err := parseConversion(req, &Image{ContentType: tt.original})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_conversion_apply(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 40 20"><rect width="40" height="20" fill="red"/></svg>`
+
+	tests := []struct {
+		name            string
+		conversion      conversion
+		original        *Image
+		wantContentType string
+		wantName        string
+		wantFormat      string
+		wantSize        image.Point
+	}{
+		{
+			name:            "Nothing to do",
+			conversion:      conversion{},
+			original:        &Image{Name: "gopher.png", ContentType: "image/png", Content: bytes.NewReader(gopher), Size: int64(len(gopher))},
+			wantContentType: "image/png",
+			wantName:        "gopher.png",
+			wantFormat:      "png",
+			wantSize:        image.Pt(1300, 1392),
+		},
+		{
+			name:            "PNG to JPEG",
+			conversion:      conversion{ContentType: "image/jpeg", Quality: 50},
+			original:        &Image{Name: "gopher.png", ContentType: "image/png", Content: bytes.NewReader(gopher), Size: int64(len(gopher))},
+			wantContentType: "image/jpeg",
+			wantName:        "gopher.jpg",
+			wantFormat:      "jpeg",
+			wantSize:        image.Pt(1300, 1392),
+		},
+		{
+			name:            "SVG rasterization",
+			conversion:      conversion{ContentType: "image/png"},
+			original:        &Image{Name: "logo.svg", ContentType: "image/svg+xml", Content: strings.NewReader(svg), Size: int64(len(svg))},
+			wantContentType: "image/png",
+			wantName:        "logo.png",
+			wantFormat:      "png",
+			wantSize:        image.Pt(40, 20),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.conversion.apply(tt.original)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, tt.wantContentType, got.ContentType)
+			assert.Equal(t, tt.wantName, got.Name)
+
+			data, err := io.ReadAll(got.Content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.original {
+				assert.Equal(t, got.Size, int64(len(data)))
+			}
+
+			cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantFormat, format)
+			assert.Equal(t, tt.wantSize, image.Pt(cfg.Width, cfg.Height))
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrInvalidCORSConfig CORS configuration is invalid
+var ErrInvalidCORSConfig = errors.New("invalid CORS configuration")
+
+// CORSConfig describes the cross-origin requests allowed to browsers
+type CORSConfig struct {
+	// AllowedOrigins are origins such as "https://app.example.com". A single "*" matches any part of the origin,
+	// e.g. "https://*.example.com", and "*" alone any origin. CORS is disabled when empty.
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`   // response headers readable by scripts
+	AllowCredentials bool          `yaml:"allow_credentials"` // cookies and Authorization headers
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// defaultCORSConfig returns the options used when nothing is configured, allowing every route and header of the API
+func defaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key", defaultTenantHeader, RequestIDHeader},
+		ExposedHeaders: []string{"Content-Disposition", RequestIDHeader, "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After", "Deprecation", "Sunset", "Link"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// enabled tells whether cross-origin requests are allowed
+func (c CORSConfig) enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+// corsFromEnv reads CORSConfig from $CORS_ALLOWED_ORIGINS, $CORS_ALLOWED_METHODS, $CORS_ALLOWED_HEADERS
+// and $CORS_EXPOSED_HEADERS, separated by commas, $CORS_ALLOW_CREDENTIALS and $CORS_MAX_AGE, starting from c.
+func corsFromEnv(c CORSConfig) (CORSConfig, error) {
+	lists := map[string]*[]string{
+		"CORS_ALLOWED_ORIGINS": &c.AllowedOrigins,
+		"CORS_ALLOWED_METHODS": &c.AllowedMethods,
+		"CORS_ALLOWED_HEADERS": &c.AllowedHeaders,
+		"CORS_EXPOSED_HEADERS": &c.ExposedHeaders,
+	}
+	for k, p := range lists {
+		if v, ok := os.LookupEnv(k); ok {
+			*p = splitList(v)
+		}
+	}
+
+	if v, ok := os.LookupEnv("CORS_ALLOW_CREDENTIALS"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid $CORS_ALLOW_CREDENTIALS: %w", err)
+		}
+		c.AllowCredentials = b
+	}
+
+	if v, ok := os.LookupEnv("CORS_MAX_AGE"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid $CORS_MAX_AGE: %w", err)
+		}
+		c.MaxAge = d
+	}
+
+	return c, nil
+}
+
+func (c CORSConfig) validate() error {
+	for _, o := range c.AllowedOrigins {
+		if strings.Count(o, "*") > 1 {
+			return fmt.Errorf("%w: origin %q holds more than one wildcard", ErrInvalidCORSConfig, o)
+		}
+
+		// Browsers send credentials to any origin otherwise
+		if o == "*" && c.AllowCredentials {
+			return fmt.Errorf("%w: credentials cannot be allowed to any origin", ErrInvalidCORSConfig)
+		}
+	}
+
+	if c.MaxAge < 0 {
+		return fmt.Errorf("%w: max age must not be negative", ErrInvalidCORSConfig)
+	}
+
+	return nil
+}
+
+// allowed tells whether the origin matches one of the allowed origins
+func (c CORSConfig) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.AllowedOrigins {
+		o = strings.ToLower(o)
+		if i := strings.Index(o, "*"); i >= 0 {
+			prefix, suffix := o[:i], o[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+			continue
+		}
+
+		if o == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CORS allows browsers of the configured origins to call the API. Preflight requests are answered here
+// with an HTTP 204 response, before routing rejects the OPTIONS method.
+func (s *server) CORS(c *gin.Context) {
+	if !s.cors.enabled() {
+		return
+	}
+
+	c.Writer.Header().Add("Vary", "Origin")
+	origin := c.GetHeader("Origin")
+	if origin == "" || !s.cors.allowed(origin) {
+		return
+	}
+
+	if len(s.cors.AllowedOrigins) == 1 && s.cors.AllowedOrigins[0] == "*" {
+		c.Header("Access-Control-Allow-Origin", "*")
+	} else {
+		c.Header("Access-Control-Allow-Origin", origin)
+	}
+
+	if s.cors.AllowCredentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+
+	if c.Request.Method != http.MethodOptions || c.GetHeader("Access-Control-Request-Method") == "" {
+		if len(s.cors.ExposedHeaders) > 0 {
+			c.Header("Access-Control-Expose-Headers", strings.Join(s.cors.ExposedHeaders, ", "))
+		}
+		return
+	}
+
+	c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+	c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+	c.Header("Access-Control-Allow-Methods", strings.Join(s.cors.AllowedMethods, ", "))
+	if len(s.cors.AllowedHeaders) > 0 {
+		c.Header("Access-Control-Allow-Headers", strings.Join(s.cors.AllowedHeaders, ", "))
+	}
+	if s.cors.MaxAge > 0 {
+		c.Header("Access-Control-Max-Age", strconv.Itoa(int(s.cors.MaxAge.Seconds())))
+	}
+
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+// splitList reads a list of values separated by commas
+func splitList(v string) []string {
+	var values []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			values = append(values, s)
+		}
+	}
+
+	return values
+}
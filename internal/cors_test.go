@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORSConfig_allowed(t *testing.T) {
+	config := CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.preview.example.com", "http://localhost:*"}}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://app.example.com", want: true},
+		{origin: "https://APP.example.com", want: true},
+		{origin: "http://app.example.com", want: false},
+		{origin: "https://app.example.com.evil.com", want: false},
+		{origin: "https://pr-42.preview.example.com", want: true},
+		{origin: "https://preview.example.com", want: false},
+		{origin: "http://localhost:3000", want: true},
+		{origin: "null", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			assert.Equal(t, tt.want, config.allowed(tt.origin))
+		})
+	}
+
+	assert.True(t, CORSConfig{AllowedOrigins: []string{"*"}}.allowed("https://anything.example.org"))
+}
+
+func TestCORSConfig_validate(t *testing.T) {
+	assert.NoError(t, CORSConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true}.validate())
+	assert.ErrorIs(t, CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}.validate(), ErrInvalidCORSConfig)
+	assert.ErrorIs(t, CORSConfig{AllowedOrigins: []string{"https://*.*.example.com"}}.validate(), ErrInvalidCORSConfig)
+	assert.ErrorIs(t, CORSConfig{MaxAge: -time.Second}.validate(), ErrInvalidCORSConfig)
+}
+
+func Test_corsFromEnv(t *testing.T) {
+	os.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com, https://admin.example.com")
+	os.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	os.Setenv("CORS_MAX_AGE", "1h")
+	defer os.Unsetenv("CORS_ALLOWED_ORIGINS")
+	defer os.Unsetenv("CORS_ALLOW_CREDENTIALS")
+	defer os.Unsetenv("CORS_MAX_AGE")
+
+	got, err := corsFromEnv(defaultCORSConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://app.example.com", "https://admin.example.com"}, got.AllowedOrigins)
+	assert.True(t, got.AllowCredentials)
+	assert.Equal(t, time.Hour, got.MaxAge)
+	assert.Equal(t, defaultCORSConfig().AllowedMethods, got.AllowedMethods)
+
+	os.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	got, err = corsFromEnv(defaultCORSConfig())
+	assert.NoError(t, err)
+	assert.ErrorIs(t, got.validate(), ErrInvalidCORSConfig)
+}
+
+func Test_server_CORS(t *testing.T) {
+	config := defaultCORSConfig()
+	config.AllowedOrigins = []string{"https://app.example.com"}
+	config.AllowCredentials = true
+
+	s := &server{router: gin.New(), auth: &authenticator{}, cors: config}
+	s.router.HandleMethodNotAllowed = true
+	s.router.Use(s.CORS)
+	s.routes()
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		origin      string
+		preflight   bool
+		wantCode    int
+		wantOrigin  string
+		wantMethods bool
+	}{
+		{name: "Preflight list", method: "OPTIONS", target: "/images", origin: "https://app.example.com", preflight: true, wantCode: 204, wantOrigin: "https://app.example.com", wantMethods: true},
+		{name: "Preflight delete", method: "OPTIONS", target: "/images/62c1a546-62b6-4cbc-bffb-03919b17dc3a", origin: "https://app.example.com", preflight: true, wantCode: 204, wantOrigin: "https://app.example.com", wantMethods: true},
+		{name: "Preflight grants", method: "OPTIONS", target: "/images/62c1a546-62b6-4cbc-bffb-03919b17dc3a/grants", origin: "https://app.example.com", preflight: true, wantCode: 204, wantOrigin: "https://app.example.com", wantMethods: true},
+		{name: "Preflight of another origin", method: "OPTIONS", target: "/images", origin: "https://evil.example.com", preflight: true, wantCode: 405},
+		{name: "OPTIONS without preflight", method: "OPTIONS", target: "/images", origin: "https://app.example.com", wantCode: 405, wantOrigin: "https://app.example.com"},
+		{name: "Actual request", method: "GET", target: "/images", origin: "https://app.example.com", wantCode: 401, wantOrigin: "https://app.example.com"},
+		{name: "Same origin", method: "GET", target: "/_health", wantCode: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", "DELETE")
+				req.Header.Set("Access-Control-Request-Headers", "authorization")
+			}
+
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantCode, rw.Code)
+			assert.Equal(t, tt.wantOrigin, rw.Header().Get("Access-Control-Allow-Origin"))
+			assert.Contains(t, rw.Header().Values("Vary"), "Origin")
+			if tt.wantOrigin != "" {
+				assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+			}
+
+			if tt.wantMethods {
+				assert.Equal(t, "GET, POST, PATCH, PUT, DELETE", rw.Header().Get("Access-Control-Allow-Methods"))
+				assert.Contains(t, rw.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+				assert.Equal(t, "600", rw.Header().Get("Access-Control-Max-Age"))
+			} else if tt.wantOrigin != "" {
+				assert.Contains(t, rw.Header().Get("Access-Control-Expose-Headers"), "RateLimit-Remaining")
+			}
+		})
+	}
+
+	// Disabled by default
+	s = &server{router: gin.New()}
+	s.router.Use(s.CORS)
+	s.router.GET("/_health", s.handleHealthCheck)
+
+	req := httptest.NewRequest("GET", "/_health", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"))
+}
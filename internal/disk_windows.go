@@ -0,0 +1,8 @@
+package internal
+
+import "errors"
+
+// freeDiskSpace is not supported on Windows, disable the disk check there
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("disk space cannot be checked on windows")
+}
@@ -1,39 +1,375 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	s3 "github.com/minio/minio-go"
 )
 
 var _ error = (*Error)(nil)
 
+// Formats of error bodies, see ErrorsConfig
+const (
+	errorFormatJSON    = "json"
+	errorFormatProblem = "problem"
+)
+
+// mimeProblemJSON is the media type of Problem bodies
+const mimeProblemJSON = "application/problem+json"
+
+// ErrInvalidErrorsConfig error responses configuration is invalid
+var ErrInvalidErrorsConfig = errors.New("invalid errors configuration")
+
+// ErrRouteNotFound no route matches the request
+var ErrRouteNotFound = errors.New("route not found")
+
+// ErrMethodNotAllowed the route does not accept the method of the request
+var ErrMethodNotAllowed = errors.New("method not allowed")
+
+// ErrorsConfig describes the body of error responses
+type ErrorsConfig struct {
+	// Format is "json" for Error bodies, or "problem" for application/problem+json bodies, see Problem.
+	// Clients may ask for the other one with the Accept header.
+	Format string `yaml:"format"`
+
+	// TypeBase prefixes error IDs to build problem types, e.g. "https://docs.example.com/errors/".
+	// Problem types are "about:blank" when empty.
+	TypeBase string `yaml:"type_base"`
+}
+
+// defaultErrorsConfig returns the options used when nothing is configured
+func defaultErrorsConfig() ErrorsConfig {
+	return ErrorsConfig{Format: errorFormatJSON}
+}
+
+// errorsFromEnv reads ErrorsConfig from $ERRORS_FORMAT and $ERRORS_TYPE_BASE, starting from e
+func errorsFromEnv(e ErrorsConfig) ErrorsConfig {
+	if v, ok := os.LookupEnv("ERRORS_FORMAT"); ok {
+		e.Format = v
+	}
+
+	if v, ok := os.LookupEnv("ERRORS_TYPE_BASE"); ok {
+		e.TypeBase = v
+	}
+
+	return e
+}
+
+func (e ErrorsConfig) validate() error {
+	if e.Format != errorFormatJSON && e.Format != errorFormatProblem {
+		return fmt.Errorf("%w: unknown format %q, expected %q or %q", ErrInvalidErrorsConfig, e.Format, errorFormatJSON, errorFormatProblem)
+	}
+
+	return nil
+}
+
+// problem tells whether errors are written as Problem bodies, preferring the one explicitly accepted by clients
+func (e ErrorsConfig) problem(accept string) bool {
+	ranges := parseAccept(accept)
+	problem, plain := acceptQuality(ranges, mimeProblemJSON, true), acceptQuality(ranges, binding.MIMEJSON, true)
+	if problem != plain {
+		return problem > plain
+	}
+
+	return e.Format == errorFormatProblem
+}
+
+// problemType returns the type of the problems identified by id
+func (e ErrorsConfig) problemType(id string) string {
+	if e.TypeBase == "" {
+		return "about:blank"
+	}
+
+	return e.TypeBase + id
+}
+
+// unexpectedErrorMessage replaces the message of errors we did not expect, they are logged instead
+const unexpectedErrorMessage = "Unexpected error occurred. Check logs for more details"
+
+// Stable error identifiers, clients switch on them rather than on messages
+const (
+	errorIDBadRequest          = "bad_request"
+	errorIDValidationFailed    = "validation_failed"
+	errorIDUnauthorized        = "unauthorized"
+	errorIDForbidden           = "forbidden"
+	errorIDNotFound            = "not_found"
+	errorIDImageNotFound       = "image_not_found"
+	errorIDMethodNotAllowed    = "method_not_allowed"
+	errorIDNotAcceptable       = "not_acceptable"
+	errorIDConflict            = "conflict"
+	errorIDPayloadTooLarge     = "payload_too_large"
+	errorIDUnsupportedMedia    = "unsupported_media_type"
+	errorIDUnprocessableEntity = "unprocessable_entity"
+	errorIDRateLimited         = "rate_limited"
+	errorIDInternal            = "internal_error"
+	errorIDBadGateway          = "bad_gateway"
+	errorIDServiceUnavailable  = "service_unavailable"
+	errorIDGatewayTimeout      = "gateway_timeout"
+	errorIDStorageError        = "storage_error"
+	errorIDStorageUnavailable  = "storage_unavailable"
+	errorIDStorageTimeout      = "storage_timeout"
+	errorIDInsufficientStorage = "insufficient_storage"
+)
+
+// statusErrorIDs identify errors by status, unless errorIDs knows better
+var statusErrorIDs = map[int]string{
+	http.StatusBadRequest:            errorIDBadRequest,
+	http.StatusUnauthorized:          errorIDUnauthorized,
+	http.StatusForbidden:             errorIDForbidden,
+	http.StatusNotFound:              errorIDNotFound,
+	http.StatusMethodNotAllowed:      errorIDMethodNotAllowed,
+	http.StatusNotAcceptable:         errorIDNotAcceptable,
+	http.StatusConflict:              errorIDConflict,
+	http.StatusRequestEntityTooLarge: errorIDPayloadTooLarge,
+	http.StatusUnsupportedMediaType:  errorIDUnsupportedMedia,
+	http.StatusUnprocessableEntity:   errorIDUnprocessableEntity,
+	http.StatusTooManyRequests:       errorIDRateLimited,
+	http.StatusInternalServerError:   errorIDInternal,
+	http.StatusBadGateway:            errorIDBadGateway,
+	http.StatusServiceUnavailable:    errorIDServiceUnavailable,
+	http.StatusGatewayTimeout:        errorIDGatewayTimeout,
+	http.StatusInsufficientStorage:   errorIDInsufficientStorage,
+}
+
+// errorIDs identify the errors of the API, checked in order with errors.Is
+var errorIDs = []struct {
+	err error
+	id  string
+}{
+	{ErrImageNotFound, errorIDImageNotFound},
+	{ErrUnsupportedContentType, errorIDUnsupportedMedia},
+	{ErrStorageUnavailable, errorIDStorageUnavailable},
+	{ErrCannotFindFile, errorIDValidationFailed},
+	{ErrDuplicateImage, "duplicate_image"},
+	{ErrUserQuotaExceeded, "user_quota_exceeded"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrRateLimited, errorIDRateLimited},
+	{ErrImageTooLarge, "image_too_large"},
+	{ErrImageDimensions, "invalid_image_dimensions"},
+	{ErrCannotReadDimensions, "unreadable_image"},
+	{ErrMissingCredentials, "missing_credentials"},
+	{ErrInvalidCredentials, "invalid_credentials"},
+	{ErrInvalidToken, "invalid_token"},
+	{ErrInvalidJWKS, "identity_provider_unavailable"},
+	{ErrInsufficientScope, "insufficient_scope"},
+	{ErrPermissionDenied, "permission_denied"},
+	{ErrInvalidGrant, "invalid_grant"},
+	{ErrUnknownFormat, "unknown_format"},
+	{ErrNotAcceptable, errorIDNotAcceptable},
+	{ErrCannotConvert, "cannot_convert"},
+	{ErrInvalidConversion, "invalid_conversion"},
+	{ErrUnknownTenant, "unknown_tenant"},
+	{ErrTenantRequired, "tenant_required"},
+	{ErrTenantMismatch, "tenant_mismatch"},
+	{ErrInvalidVisibility, "invalid_visibility"},
+	{ErrInvalidSignature, "invalid_signature"},
+	{ErrWatermarkNotConfigured, "watermark_not_configured"},
+}
+
+// Error is the body of error responses
 type Error struct {
-	Code    int    `json:"code"`
-	Message string `json:"message,omitempty"`
+	Code      int          `json:"code"`
+	ID        string       `json:"error"` // stable identifier, e.g. "image_not_found"
+	Message   string       `json:"message,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Details   []FieldError `json:"details,omitempty"` // invalid fields of validation failures
+}
+
+// Problem is the RFC 7807 representation of an Error, extended with its identifier, request ID and details
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	ID        string       `json:"error"`
+	RequestID string       `json:"request_id,omitempty"`
+	Details   []FieldError `json:"details,omitempty"`
+}
+
+// FieldError describes an invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 // Error implements error
 func (e Error) Error() string {
-	return fmt.Sprintf("code=%d message=%s", e.Code, e.Message)
+	return fmt.Sprintf("code=%d error=%s message=%s", e.Code, e.ID, e.Message)
 }
 
-func newNotFoundError(err error) *Error {
-	return &Error{
-		Code:    http.StatusNotFound,
+// newError builds the Error of the given status, identified after err, see errorIDs
+func newError(code int, err error) *Error {
+	e := &Error{
+		Code:    code,
+		ID:      statusErrorIDs[code],
 		Message: err.Error(),
 	}
+
+	for _, known := range errorIDs {
+		if errors.Is(err, known.err) {
+			e.ID = known.id
+			break
+		}
+	}
+
+	if e.Details = fieldErrors(err); len(e.Details) > 0 {
+		e.ID = errorIDValidationFailed
+		e.Message = "validation failed"
+	}
+
+	return e
+}
+
+// fieldErrors returns the invalid fields of binding errors
+func fieldErrors(err error) []FieldError {
+	var validation validator.ValidationErrors
+	var unmarshal *json.UnmarshalTypeError
+	var violations requestViolations
+	switch {
+	case errors.As(err, &violations):
+		return violations
+	case errors.As(err, &validation):
+		details := make([]FieldError, 0, len(validation))
+		for _, fe := range validation {
+			message := fmt.Sprintf("failed on the %q rule", fe.Tag())
+			if fe.Param() != "" {
+				message = fmt.Sprintf("failed on the %q rule with %q", fe.Tag(), fe.Param())
+			}
+			details = append(details, FieldError{Field: fe.Field(), Message: message})
+		}
+		return details
+	case errors.As(err, &unmarshal):
+		return []FieldError{{Field: unmarshal.Field, Message: "must be a " + unmarshal.Type.String()}}
+	case errors.Is(err, ErrCannotFindFile):
+		return []FieldError{{Field: "file", Message: "is required"}}
+	}
+
+	return nil
 }
 
-func newBadRequestError(err error) *Error {
-	return &Error{
-		Code:    http.StatusBadRequest,
-		Message: err.Error(),
+// newStorageError hides errors of the storage behind HTTP 502, 503 or 504 responses, nil for other errors
+func newStorageError(err error) *Error {
+	var netErr net.Error
+	resp := s3.ToErrorResponse(err)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout(),
+		resp.StatusCode == http.StatusGatewayTimeout, resp.Code == "RequestTimeout":
+		return &Error{Code: http.StatusGatewayTimeout, ID: errorIDStorageTimeout, Message: "storage timed out"}
+	case errors.As(err, &netErr), resp.StatusCode == http.StatusServiceUnavailable, resp.Code == "SlowDown",
+		resp.Code == "AccessDenied", resp.Code == "InvalidAccessKeyId", resp.Code == "SignatureDoesNotMatch",
+		resp.Code == "NoSuchBucket":
+		return &Error{Code: http.StatusServiceUnavailable, ID: errorIDStorageUnavailable, Message: "storage is unavailable"}
+	case resp.Code != "":
+		return &Error{Code: http.StatusBadGateway, ID: errorIDStorageError, Message: "storage failed"}
 	}
+
+	return nil
 }
 
-func newUnsupportedMediaType(err error) *Error {
-	return &Error{
-		Code:    http.StatusUnsupportedMediaType,
-		Message: err.Error(),
+// toError converts any error to an Error. Unexpected errors are logged, their message is not sent to clients.
+func toError(c *gin.Context, err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		copied := *e
+		if copied.ID == "" {
+			copied.ID = statusErrorIDs[copied.Code]
+		}
+		return &copied
+	}
+
+	logger(c.Request.Context()).Errorln(err)
+	if e = newStorageError(err); e != nil {
+		return e
+	}
+
+	return &Error{Code: http.StatusInternalServerError, ID: errorIDInternal, Message: unexpectedErrorMessage}
+}
+
+// abortWithError writes the error and stops the handlers chain, see writeError
+func (s *server) abortWithError(c *gin.Context, err error) {
+	s.writeError(c, toError(c, err))
+	c.Abort()
+}
+
+// writeError writes the error with the ID of the request, as an Error or as a Problem, see ErrorsConfig
+func (s *server) writeError(c *gin.Context, e *Error) {
+	e.RequestID = c.GetString(RequestIDContextKey)
+	if !s.errorBodies.problem(c.GetHeader("Accept")) {
+		c.JSON(e.Code, e)
+		return
 	}
+
+	c.Header("Content-Type", mimeProblemJSON)
+	c.JSON(e.Code, &Problem{
+		Type:      s.errorBodies.problemType(e.ID),
+		Title:     http.StatusText(e.Code),
+		Status:    e.Code,
+		Detail:    e.Message,
+		Instance:  c.Request.URL.Path,
+		ID:        e.ID,
+		RequestID: e.RequestID,
+		Details:   e.Details,
+	})
+}
+
+func newNotFoundError(err error) *Error {
+	return newError(http.StatusNotFound, err)
+}
+
+func newBadRequestError(err error) *Error {
+	return newError(http.StatusBadRequest, err)
+}
+
+func newUnsupportedMediaType(err error) *Error {
+	return newError(http.StatusUnsupportedMediaType, err)
+}
+
+func newRequestEntityTooLargeError(err error) *Error {
+	return newError(http.StatusRequestEntityTooLarge, err)
+}
+
+func newUnprocessableEntityError(err error) *Error {
+	return newError(http.StatusUnprocessableEntity, err)
+}
+
+func newNotAcceptableError(err error) *Error {
+	return newError(http.StatusNotAcceptable, err)
+}
+
+func newConflictError(err error) *Error {
+	return newError(http.StatusConflict, err)
+}
+
+func newUnauthorizedError(err error) *Error {
+	return newError(http.StatusUnauthorized, err)
+}
+
+func newForbiddenError(err error) *Error {
+	return newError(http.StatusForbidden, err)
+}
+
+func newServiceUnavailableError(err error) *Error {
+	return newError(http.StatusServiceUnavailable, err)
+}
+
+func newInsufficientStorageError(err error) *Error {
+	return newError(http.StatusInsufficientStorage, err)
+}
+
+func newMethodNotAllowedError(err error) *Error {
+	return newError(http.StatusMethodNotAllowed, err)
+}
+
+func newTooManyRequestsError(err error) *Error {
+	return newError(http.StatusTooManyRequests, err)
 }
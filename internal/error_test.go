@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	s3 "github.com/minio/minio-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newError(t *testing.T) {
+	err := newNotFoundError(fmt.Errorf("%w: foo", ErrImageNotFound))
+	assert.Equal(t, &Error{Code: 404, ID: "image_not_found", Message: "image not found: foo"}, err)
+
+	err = newNotFoundError(errors.New("no route"))
+	assert.Equal(t, "not_found", err.ID, "identified by status otherwise")
+
+	err = newBadRequestError(binding.Validator.ValidateStruct(struct {
+		Distance int `binding:"max=64"`
+	}{Distance: 100}))
+	assert.Equal(t, &Error{
+		Code:    400,
+		ID:      "validation_failed",
+		Message: "validation failed",
+		Details: []FieldError{{Field: "Distance", Message: `failed on the "max" rule with "64"`}},
+	}, err)
+
+	err = newBadRequestError(ErrCannotFindFile)
+	assert.Equal(t, []FieldError{{Field: "file", Message: "is required"}}, err.Details)
+}
+
+func Test_newStorageError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		want   int
+		wantID string
+	}{
+		{name: "Throttled", err: s3.ErrorResponse{Code: "SlowDown", StatusCode: 503}, want: 503, wantID: "storage_unavailable"},
+		{name: "Credentials", err: s3.ErrorResponse{Code: "InvalidAccessKeyId", StatusCode: 403}, want: 503, wantID: "storage_unavailable"},
+		{name: "Timeout", err: s3.ErrorResponse{Code: "RequestTimeout", StatusCode: 400}, want: 504, wantID: "storage_timeout"},
+		{name: "Deadline", err: context.DeadlineExceeded, want: 504, wantID: "storage_timeout"},
+		{name: "Unreachable", err: &url.Error{Op: "Get", URL: "http://minio", Err: errors.New("connection refused")}, want: 503, wantID: "storage_unavailable"},
+		{name: "Other", err: s3.ErrorResponse{Code: "InternalError", StatusCode: 500}, want: 502, wantID: "storage_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newStorageError(tt.err)
+			if assert.NotNil(t, got) {
+				assert.Equal(t, tt.want, got.Code)
+				assert.Equal(t, tt.wantID, got.ID)
+			}
+		})
+	}
+
+	assert.Nil(t, newStorageError(errors.New("oops")), "not a storage error")
+}
+
+func Test_server_handleErrors_storage(t *testing.T) {
+	s := &server{router: gin.New()}
+	s.router.GET("/images", s.Log, s.handleErrors, func(c *gin.Context) {
+		_ = c.Error(s3.ErrorResponse{Code: "SlowDown", Message: "Please reduce your request rate", StatusCode: 503})
+	})
+
+	req := httptest.NewRequest("GET", "/images", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	assert.Equal(t, 503, rr.Code)
+	assert.JSONEq(t, `{"code":503,"error":"storage_unavailable","message":"storage is unavailable","request_id":"abc-123"}`, rr.Body.String(),
+		"messages of the storage are not leaked")
+}
+
+func Test_server_writeError(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		accept      string
+		want        string
+		contentType string
+	}{
+		{
+			name:        "Error",
+			format:      errorFormatJSON,
+			want:        `{"code":404,"error":"image_not_found","message":"image not found","request_id":"abc-123"}`,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "Problem accepted",
+			format:      errorFormatJSON,
+			accept:      "application/problem+json, application/json;q=0.5",
+			want:        `{"type":"https://docs.example.com/errors/image_not_found","title":"Not Found","status":404,"detail":"image not found","instance":"/images/foo","error":"image_not_found","request_id":"abc-123"}`,
+			contentType: mimeProblemJSON,
+		},
+		{
+			name:        "Problem configured",
+			format:      errorFormatProblem,
+			accept:      "*/*",
+			want:        `{"type":"https://docs.example.com/errors/image_not_found","title":"Not Found","status":404,"detail":"image not found","instance":"/images/foo","error":"image_not_found","request_id":"abc-123"}`,
+			contentType: mimeProblemJSON,
+		},
+		{
+			name:        "Error accepted",
+			format:      errorFormatProblem,
+			accept:      "application/json",
+			want:        `{"code":404,"error":"image_not_found","message":"image not found","request_id":"abc-123"}`,
+			contentType: "application/json; charset=utf-8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{router: gin.New(), errorBodies: ErrorsConfig{Format: tt.format, TypeBase: "https://docs.example.com/errors/"}}
+			s.router.Use(s.Log)
+			s.router.GET("/images/:image", s.BindUUID)
+
+			req := httptest.NewRequest("GET", "/images/foo", nil)
+			req.Header.Set(RequestIDHeader, "abc-123")
+			req.Header.Set("Accept", tt.accept)
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+
+			assert.Equal(t, 404, rr.Code)
+			assert.Equal(t, tt.contentType, rr.Header().Get("Content-Type"))
+			assert.JSONEq(t, tt.want, rr.Body.String())
+		})
+	}
+}
+
+func Test_server_handleNoRoute(t *testing.T) {
+	s := &server{router: gin.New()}
+	s.router.HandleMethodNotAllowed = true
+	s.routes()
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest("GET", "/unknown", nil))
+	assert.Equal(t, 404, rr.Code)
+	assert.JSONEq(t, `{"code":404,"error":"not_found","message":"route not found"}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest("POST", "/_health", nil))
+	assert.Equal(t, 405, rr.Code)
+	assert.JSONEq(t, `{"code":405,"error":"method_not_allowed","message":"method not allowed"}`, rr.Body.String())
+}
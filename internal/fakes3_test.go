@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SkYNewZ/images-server/internal/minio"
+	s3 "github.com/minio/minio-go"
+)
+
+// maxUserMetadata is the size limit of the user metadata of an S3 object
+const maxUserMetadata = 2 << 10
+
+// fakeS3 is an in-memory S3 server implementing the subset of the API used by imageService
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]bool
+	objects map[string]*fakeObject // bucket/key
+	heads   int                    // HEAD requests of objects, i.e. StatObject calls
+}
+
+type fakeObject struct {
+	data     []byte
+	header   http.Header
+	modified time.Time
+}
+
+// newTestingMinio starts a fake S3 server and returns a client using the given bucket
+func newTestingMinio(t *testing.T, bucketName string) (*minio.Client, *fakeS3) {
+	t.Helper()
+
+	f := &fakeS3{buckets: map[string]bool{bucketName: true}, objects: make(map[string]*fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client, err := s3.NewWithRegion(strings.TrimPrefix(srv.URL, "http://"), "access", "secret", false, "us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &minio.Client{Client: client, BucketName: bucketName}, f
+}
+
+// keys returns stored keys of given bucket, sorted
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0)
+	for k := range f.objects {
+		if strings.HasPrefix(k, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(k, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stats returns the number of StatObject calls served so far
+func (f *fakeS3) stats() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.heads
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	if !f.buckets[bucket] && !(r.Method == http.MethodPut && key == "") {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodPut:
+		f.buckets[bucket] = true
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r, bucket)
+	case key == "" && r.Method == http.MethodPost && hasQuery(r, "delete"):
+		f.deleteMultiple(w, r, bucket)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copy(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		f.put(w, r, bucket, key)
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		if r.Method == http.MethodHead {
+			f.heads++
+		}
+		f.get(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) put(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = decodeAWSChunked(r.Body)
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	header, metadata := make(http.Header), 0
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" {
+			header[k] = v
+		}
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			metadata += len(k) - len("X-Amz-Meta-") + len(strings.Join(v, ""))
+		}
+	}
+
+	if metadata > maxUserMetadata {
+		f.error(w, http.StatusBadRequest, "MetadataTooLarge")
+		return
+	}
+
+	o := &fakeObject{data: data, header: header, modified: time.Now().UTC()}
+	f.objects[bucket+"/"+key] = o
+	w.Header().Set("ETag", o.etag())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) copy(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	src, ok := f.objects[source]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	o := &fakeObject{data: src.data, header: src.header.Clone(), modified: time.Now().UTC()}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		o.header = make(http.Header)
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" {
+				o.header[k] = v
+			}
+		}
+	}
+
+	f.objects[bucket+"/"+key] = o
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>",
+		o.etag(), o.modified.Format(time.RFC3339))
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	o, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", o.etag())
+	w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+
+	data, status := o.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		start, _ = strconv.Atoi(bounds[0])
+		end = len(o.data) - 1
+		if len(bounds) == 2 && bounds[1] != "" {
+			end, _ = strconv.Atoi(bounds[1])
+		}
+		if start > len(o.data) {
+			start = len(o.data)
+		}
+		if end >= len(o.data) {
+			end = len(o.data) - 1
+		}
+
+		data, status = o.data[start:end+1], http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+
+	type result struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []struct{ Prefix string }
+	}
+
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	res := result{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	seen := make(map[string]bool)
+
+	keys := make([]string, 0)
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !strings.HasPrefix(k, bucket+"/") {
+			continue
+		}
+
+		key := strings.TrimPrefix(k, bucket+"/")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, struct{ Prefix string }{p})
+				}
+				continue
+			}
+		}
+
+		o := f.objects[k]
+		res.Contents = append(res.Contents, content{
+			Key:          key,
+			LastModified: o.modified.Format(time.RFC3339),
+			ETag:         o.etag(),
+			Size:         int64(len(o.data)),
+		})
+	}
+
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) deleteMultiple(w http.ResponseWriter, r *http.Request, bucket string) {
+	var req struct {
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var res bytes.Buffer
+	res.WriteString("<DeleteResult>")
+	for _, o := range req.Objects {
+		delete(f.objects, bucket+"/"+o.Key)
+		_, _ = fmt.Fprintf(&res, "<Deleted><Key>%s</Key></Deleted>", o.Key)
+	}
+	res.WriteString("</DeleteResult>")
+
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(res.Bytes())
+}
+
+func (o *fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// decodeAWSChunked decodes a body signed with the streaming signature: "<hex size>;chunk-signature=...\r\n<data>\r\n"
+func decodeAWSChunked(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			if size == 0 {
+				_ = pw.Close()
+				return
+			}
+
+			if _, err := io.CopyN(pw, br, size); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			if _, err := br.Discard(2); err != nil { // trailing \r\n
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	return pr
+}
+
+func hasQuery(r *http.Request, key string) bool {
+	_, ok := r.URL.Query()[key]
+	return ok
+}
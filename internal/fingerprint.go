@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// duplicateDistance is the maximum perceptual hash distance for two images to be considered duplicates
+	duplicateDistance = 2
+
+	// defaultSimilarDistance is the maximum perceptual hash distance used by GET /images/:image/similar
+	defaultSimilarDistance = 10
+)
+
+// Supported values of the on_duplicate upload option
+const (
+	onDuplicateAllow          = "allow"
+	onDuplicateReject         = "reject"
+	onDuplicateReturnExisting = "return_existing"
+)
+
+// ErrDuplicateImage the uploaded image already exists
+var ErrDuplicateImage = errors.New("duplicate image")
+
+// fingerprint computes the SHA-256 digest, the perceptual hash and the placeholders of the Image content.
+// The perceptual hash and the placeholders are left empty when the image cannot be decoded.
+func (i *Image) fingerprint() error {
+	r, ok := i.Content.(io.ReadSeeker)
+	if !ok {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	i.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if m, err := decode(i); err == nil {
+		i.PerceptualHash = formatHash(differenceHash(m))
+		if err := i.placeholders(m); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.Seek(0, io.SeekStart)
+	return err
+}
+
+// differenceHash computes the 64 bits dHash of given image: the image is reduced to a 9x8 grayscale
+// and each bit tells whether a pixel is brighter than its right neighbour
+func differenceHash(m image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(small, small.Bounds(), m, m.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y < small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// hashDistance returns the Hamming distance between two formatted perceptual hashes
+func hashDistance(a, b string) (int, bool) {
+	x, ok := parseHash(a)
+	if !ok {
+		return 0, false
+	}
+
+	y, ok := parseHash(b)
+	if !ok {
+		return 0, false
+	}
+
+	return bits.OnesCount64(x ^ y), true
+}
+
+// parseHash parses a formatted perceptual hash, images which cannot be decoded have none
+func parseHash(h string) (uint64, bool) {
+	if h == "" {
+		return 0, false
+	}
+
+	x, err := strconv.ParseUint(h, 16, 64)
+	return x, err == nil
+}
+
+// similarImage is an Image with its perceptual distance to another one
+type similarImage struct {
+	*Image
+	Distance int `json:"distance"`
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/draw"
+)
+
+// makePNG encodes a horizontal gradient, optionally scaled, as PNG
+func makePNG(t *testing.T, width, height int, reverse bool) []byte {
+	t.Helper()
+
+	m := image.NewGray(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		v := uint8(x * 255 / width)
+		if reverse {
+			v = 255 - v
+		}
+		for y := 0; y < height; y++ {
+			m.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImage_fingerprint(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Image{ContentType: "image/png", Content: bytes.NewReader(gopher)}
+	assert.NoError(t, i.fingerprint())
+	assert.Len(t, i.SHA256, 64)
+	assert.Len(t, i.PerceptualHash, 16)
+
+	// A resized copy looks the same
+	m, _ := png.Decode(bytes.NewReader(gopher))
+	small := image.NewNRGBA(image.Rect(0, 0, 650, 696))
+	draw.CatmullRom.Scale(small, small.Bounds(), m, m.Bounds(), draw.Src, nil)
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, small)
+
+	resized := &Image{ContentType: "image/png", Content: bytes.NewReader(buf.Bytes())}
+	assert.NoError(t, resized.fingerprint())
+	assert.NotEqual(t, i.SHA256, resized.SHA256)
+
+	d, ok := hashDistance(i.PerceptualHash, resized.PerceptualHash)
+	assert.True(t, ok)
+	assert.LessOrEqual(t, d, duplicateDistance)
+
+	// Undecodable content only gets a digest
+	avif := &Image{ContentType: "image/avif", Content: bytes.NewReader([]byte("foo"))}
+	assert.NoError(t, avif.fingerprint())
+	assert.Len(t, avif.SHA256, 64)
+	assert.Empty(t, avif.PerceptualHash)
+}
+
+func Test_hashDistance(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   string
+		want   int
+		wantOk bool
+	}{
+		{name: "Same", a: "00000000000000ff", b: "00000000000000ff", want: 0, wantOk: true},
+		{name: "Different", a: "0000000000000000", b: "ffffffffffffffff", want: 64, wantOk: true},
+		{name: "Missing", a: "", b: "ffffffffffffffff", wantOk: false},
+		{name: "Invalid", a: "foo", b: "ffffffffffffffff", wantOk: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := hashDistance(tt.a, tt.b)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_server_handleImagesCreate_onDuplicate(t *testing.T) {
+	service := new(testingImageService)
+	original := makePNG(t, 64, 32, false)
+
+	existing := &Image{Key: uuid.New(), Name: "gradient.png", ContentType: "image/png", Content: bytes.NewReader(original)}
+	assert.NoError(t, existing.fingerprint())
+	_, _ = service.Create(context.TODO(), existing)
+	defer func() { _ = service.Delete(context.TODO(), existing.Key) }()
+
+	tests := []struct {
+		name        string
+		content     []byte
+		onDuplicate string
+		wantCode    int
+		wantKey     *uuid.UUID
+	}{
+		{name: "Reject duplicate", content: original, onDuplicate: "reject", wantCode: 409},
+		{name: "Return existing", content: original, onDuplicate: "return_existing", wantCode: 200, wantKey: &existing.Key},
+		{name: "Return existing resized", content: makePNG(t, 128, 64, false), onDuplicate: "return_existing", wantCode: 200, wantKey: &existing.Key},
+		{name: "Not a duplicate", content: makePNG(t, 64, 32, true), onDuplicate: "reject", wantCode: 201},
+		{name: "Allow", content: original, onDuplicate: "allow", wantCode: 201},
+		{name: "Default is allow", content: original, wantCode: 201},
+		{name: "Invalid option", content: original, onDuplicate: "foo", wantCode: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{
+				router:       gin.New(),
+				Image:        service,
+				limits:       defaultUploadLimits(),
+				contentTypes: defaultContentTypes,
+				links:        testingLinks,
+			}
+			s.router.POST("/foo", s.handleErrors, withPrincipal(admin), s.handleImagesCreate)
+
+			fields := map[string]string{}
+			if tt.onDuplicate != "" {
+				fields["on_duplicate"] = tt.onDuplicate
+			}
+
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, makeUploadRequest(t, "/foo", "gradient.png", "image/png", tt.content, fields))
+			assert.Equal(t, tt.wantCode, rw.Code)
+
+			var got Image
+			_ = json.Unmarshal(rw.Body.Bytes(), &got)
+			if tt.wantKey != nil {
+				assert.Equal(t, *tt.wantKey, got.Key)
+			}
+
+			if rw.Code == 201 {
+				_ = service.Delete(context.TODO(), got.Key)
+			}
+		})
+	}
+}
+
+func Test_server_handleImagesSimilar(t *testing.T) {
+	service := new(testingImageService)
+
+	var keys []uuid.UUID
+	for _, content := range [][]byte{makePNG(t, 64, 32, false), makePNG(t, 32, 16, false), makePNG(t, 64, 32, true)} {
+		i := &Image{Key: uuid.New(), ContentType: "image/png", Content: bytes.NewReader(content)}
+		assert.NoError(t, i.fingerprint())
+		_, _ = service.Create(context.TODO(), i)
+		keys = append(keys, i.Key)
+	}
+	defer func() { _ = service.Delete(context.TODO(), keys...) }()
+
+	s := &server{router: gin.New(), Image: service, links: testingLinks}
+	s.router.GET("/foo/:image/similar", s.handleErrors, withPrincipal(admin), s.BindUUID, s.handleImagesSimilar)
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", "/foo/"+keys[0].String()+"/similar", nil))
+	assert.Equal(t, 200, rw.Code)
+
+	var got []similarImage
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &got))
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, keys[1], got[0].Key)
+	}
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", "/foo/"+keys[0].String()+"/similar?distance=65", nil))
+	assert.Equal(t, 400, rw.Code)
+}
+
+func Test_imageService_Similar(t *testing.T) {
+	client, fake := newTestingMinio(t, "images")
+	service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+	ctx := context.Background()
+
+	create := func(content []byte) *Image {
+		image, err := service.Create(ctx, &Image{Key: uuid.New(), ContentType: "image/png", Content: bytes.NewReader(content), Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image
+	}
+
+	original := makePNG(t, 64, 32, false)
+	first, copied, resized, other := create(original), create(original), create(makePNG(t, 128, 64, false)), create(makePNG(t, 64, 32, true))
+
+	similar, err := service.Similar(ctx, first, duplicateDistance)
+	assert.NoError(t, err)
+	distances := make(map[uuid.UUID]int)
+	for _, i := range similar {
+		distances[i.Key] = i.Distance
+	}
+	assert.Len(t, distances, 2)
+	assert.Equal(t, 0, distances[copied.Key], "same content")
+	assert.Contains(t, distances, resized.Key)
+	assert.LessOrEqual(t, distances[resized.Key], duplicateDistance)
+
+	// The index is built once, then updated by writes: only the matches are read
+	uploaded := &Image{Key: uuid.New(), ContentType: "image/png", Content: bytes.NewReader(makePNG(t, 32, 16, true))}
+	assert.NoError(t, uploaded.fingerprint())
+	before := fake.stats()
+	similar, err = service.Similar(ctx, uploaded, duplicateDistance)
+	assert.NoError(t, err)
+	if assert.Len(t, similar, 1) {
+		assert.Equal(t, other.Key, similar[0].Key)
+	}
+	assert.Equal(t, 1, fake.stats()-before, "the bucket is not scanned on every upload")
+
+	assert.NoError(t, service.Delete(ctx, other.Key))
+	similar, err = service.Similar(ctx, uploaded, duplicateDistance)
+	assert.NoError(t, err)
+	assert.Empty(t, similar)
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	_ "image/gif"  // register GIF decoder, animated files are stored untouched
+	_ "image/jpeg" // register JPEG decoder
+	_ "image/png"  // register PNG decoder
+	"os"
+	"strings"
+
+	_ "github.com/SkYNewZ/images-server/internal/avif" // register AVIF dimensions reader
+	_ "golang.org/x/image/bmp"                         // register BMP decoder
+	_ "golang.org/x/image/tiff"                        // register TIFF decoder
+	_ "golang.org/x/image/webp"                        // register WebP decoder, animated files are stored untouched
+)
+
+// defaultContentTypes lists content types accepted when nothing is configured
+var defaultContentTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/svg+xml",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"image/bmp",
+	"image/tiff",
+}
+
+// contentTypesFromEnv reads the comma separated list of accepted content types from $IMAGES_CONTENT_TYPES.
+// contentTypes is returned when the variable is not set.
+func contentTypesFromEnv(contentTypes []string) []string {
+	v, ok := os.LookupEnv("IMAGES_CONTENT_TYPES")
+	if !ok {
+		return contentTypes
+	}
+
+	contentTypes = make([]string, 0)
+	for _, c := range strings.Split(v, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			contentTypes = append(contentTypes, strings.ToLower(c))
+		}
+	}
+
+	return contentTypes
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_contentTypesFromEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		value *string
+		want  []string
+	}{
+		{
+			name:  "Not set",
+			value: nil,
+			want:  defaultContentTypes,
+		},
+		{
+			name:  "Custom list",
+			value: func() *string { s := " image/png, IMAGE/GIF ,,"; return &s }(),
+			want:  []string{"image/png", "image/gif"},
+		},
+		{
+			name:  "Empty list",
+			value: func() *string { s := ""; return &s }(),
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.value != nil {
+				_ = os.Setenv("IMAGES_CONTENT_TYPES", *tt.value)
+				defer os.Unsetenv("IMAGES_CONTENT_TYPES")
+			}
+
+			assert.Equal(t, tt.want, contentTypesFromEnv(defaultContentTypes))
+		})
+	}
+}
+
+func TestImage_validateContentType_custom(t *testing.T) {
+	i := &Image{ContentType: "image/gif"}
+
+	assert.NoError(t, i.validateContentType([]string{"image/gif"}))
+	assert.ErrorIs(t, i.validateContentType([]string{"image/png"}), ErrUnsupportedContentType)
+}
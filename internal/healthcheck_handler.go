@@ -6,6 +6,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// handleHealthCheck is a cheap liveness probe, dependencies are checked by handleReadiness
 func (s *server) handleHealthCheck(c *gin.Context) {
 	data := map[string]interface{}{
 		"ok":      true,
@@ -14,3 +15,14 @@ func (s *server) handleHealthCheck(c *gin.Context) {
 
 	c.JSON(http.StatusOK, data)
 }
+
+// handleReadiness reports the result of each dependency check, with an HTTP 503 response when one fails
+func (s *server) handleReadiness(c *gin.Context) {
+	report := s.readiness.report()
+	if !report.OK {
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -22,3 +22,25 @@ func Test_server_handleHealthCheck(t *testing.T) {
 	assert.Equal(t, 200, rr.Code)
 	assert.Equal(t, `{"ok":true,"version":"foo"}`, rr.Body.String())
 }
+
+func Test_server_handleReadiness(t *testing.T) {
+	s := &server{router: gin.New(), connecting: 1}
+	s.readiness = newReadiness(defaultReadinessConfig(), s.readinessChecks(defaultReadinessConfig()))
+	s.routes()
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_ready", nil)
+	s.ServeHTTP(rr, req)
+
+	assert.Equal(t, 503, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"storage":{"ok":false,"error":"storage is not available yet"`)
+
+	// Connected, without buckets to check
+	s.connecting = 0
+	s.readiness.last = nil
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	assert.Equal(t, 200, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"ok":true`)
+}
@@ -1,8 +1,6 @@
 package internal
 
 import (
-	"net/http"
-
 	"github.com/gin-gonic/gin"
 )
 
@@ -14,17 +12,15 @@ func (s *server) handleErrors(c *gin.Context) {
 		return
 	}
 
-	err := detectedErrors[0].Err
-	var e *Error
-	switch v := err.(type) {
-	case *Error:
-		e = v
-	default:
-		e = &Error{
-			Code:    http.StatusInternalServerError,
-			Message: err.Error(),
-		}
-	}
+	s.writeError(c, toError(c, detectedErrors[0].Err))
+}
+
+// handleNoRoute answers requests matching no route
+func (s *server) handleNoRoute(c *gin.Context) {
+	s.abortWithError(c, newNotFoundError(ErrRouteNotFound))
+}
 
-	c.JSON(e.Code, e)
+// handleNoMethod answers requests whose route does not accept the method
+func (s *server) handleNoMethod(c *gin.Context) {
+	s.abortWithError(c, newMethodNotAllowedError(ErrMethodNotAllowed))
 }
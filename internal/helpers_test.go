@@ -37,7 +37,7 @@ func Test_server_handleErrors(t *testing.T) {
 					_ = c.Error(fmt.Errorf("oops"))
 				},
 			},
-			want:     `{"code":500,"message":"oops"}`,
+			want:     `{"code":500,"error":"internal_error","message":"Unexpected error occurred. Check logs for more details"}`,
 			wantCode: 500,
 		},
 		{
@@ -50,7 +50,7 @@ func Test_server_handleErrors(t *testing.T) {
 					_ = c.Error(err)
 				},
 			},
-			want:     `{"code":400,"message":"argh"}`,
+			want:     `{"code":400,"error":"bad_request","message":"argh"}`,
 			wantCode: 400,
 		},
 	}
@@ -7,26 +7,26 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/SkYNewZ/images-server/internal/minio"
 	"github.com/google/uuid"
 	s3 "github.com/minio/minio-go"
-	log "github.com/sirupsen/logrus"
 )
 
 var _ ImageService = (*imageService)(nil)
 
-var supportedContentTypes = []string{"image/jpeg", "image/png", "image/svg+xml"}
-
 var (
 	// ErrImageNotFound file not found
 	ErrImageNotFound = errors.New("image not found")
 
-	// ErrUnsupportedContentType file content type not supported. See supportedContentTypes
-	ErrUnsupportedContentType = fmt.Errorf("unsupported content type: [%s]", strings.Join(supportedContentTypes, ", "))
+	// ErrUnsupportedContentType file content type not in the configured allow-list
+	ErrUnsupportedContentType = errors.New("unsupported content type")
 )
 
 // Image describes our base image type
@@ -38,16 +38,46 @@ type Image struct {
 	Description string    `json:"description"`
 	DownloadURL string    `json:"download_url"`
 	Size        int64     `json:"-"`
+
+	// SHA256 is the hex encoded digest of the content
+	SHA256 string `json:"sha256,omitempty"`
+
+	// PerceptualHash is the hex encoded dHash of the content, used to find similar images
+	PerceptualHash string `json:"phash,omitempty"`
+
+	// BlurHash is a compact representation of the image used to render a blurred placeholder, see https://blurha.sh
+	BlurHash string `json:"blurhash,omitempty"`
+
+	// LQIP is a tiny low quality version of the image, as a base64 JPEG data URI
+	LQIP string `json:"lqip,omitempty"`
+
+	// DominantColor and AverageColor are CSS hex colors, e.g. #1e90ff
+	DominantColor string `json:"dominant_color,omitempty"`
+	AverageColor  string `json:"average_color,omitempty"`
+
+	// Watermark enforces the configured watermark whenever the image is served
+	Watermark bool `json:"watermark"`
+
+	// Owner is the subject of the uploading principal, empty for images uploaded anonymously
+	// or before ownership was recorded
+	Owner string `json:"owner,omitempty"`
+
+	// Grants share the image with other users or groups
+	Grants []Grant `json:"grants,omitempty"`
+
+	// Visibility is one of private, unlisted or public, see visibility.go
+	Visibility string `json:"visibility"`
 }
 
-func (i *Image) validateContentType() error {
-	for _, c := range supportedContentTypes {
+// validateContentType ensure Image content type is one of the allowed ones
+func (i *Image) validateContentType(allowed []string) error {
+	for _, c := range allowed {
 		if c == i.ContentType {
 			return nil
 		}
 	}
 
-	return ErrUnsupportedContentType
+	return fmt.Errorf("%w: [%s]", ErrUnsupportedContentType, strings.Join(allowed, ", "))
 }
 
 // newImage create a new Image
@@ -88,53 +118,81 @@ type ImageService interface {
 	// List returns a set of all images
 	List(ctx context.Context) ([]*Image, error)
 
+	// Update writes the metadata of an existing Image, its content is left untouched
+	Update(ctx context.Context, image *Image) (*Image, error)
+
 	// Delete deletes Image matching given uuid
 	Delete(ctx context.Context, ids ...uuid.UUID) error
+
+	// Similar returns the images having the content of the given one, or looking like it within maxDistance,
+	// closest first and without their content. The given image is excluded.
+	Similar(ctx context.Context, image *Image, maxDistance int) ([]*similarImage, error)
 }
 
 // TODO: Use interface for testing
+// imageService stores image bytes in content-addressed blobs, see blobs.go.
+// Each Image is a metadata only record keyed by its uuid and referencing a blob.
 type imageService struct {
-	Minio *minio.Client //  Minio is S3 compatible so we can safely use it
+	Minio        *minio.Client //  Minio is S3 compatible so we can safely use it
+	ContentTypes []string      // ContentTypes is the allow-list of accepted content types
+	Prefix       string        // Prefix of every key, isolates tenants sharing a bucket
+
+	locks  [256]sync.Mutex // serialize reference counting per digest, see lock
+	hashes hashIndex       // perceptual hashes of the images, see Similar
 }
 
 func (i *imageService) Create(ctx context.Context, image *Image) (*Image, error) {
-	if err := image.validateContentType(); err != nil {
+	if err := image.validateContentType(i.ContentTypes); err != nil {
 		return nil, err
 	}
 
-	_, err := i.Minio.PutObjectWithContext(ctx, i.Minio.BucketName, image.Key.String(), image.Content, image.Size, s3.PutObjectOptions{
-		ContentType: image.ContentType,
-		UserMetadata: map[string]string{
-			"description": image.Description,
-			"name":        image.Name,
-		},
-	})
-	if err != nil {
+	if image.SHA256 == "" {
+		if err := image.fingerprint(); err != nil {
+			return nil, err
+		}
+	}
+
+	if image.SHA256 == "" {
+		return nil, ErrMissingDigest
+	}
+
+	unlock := i.lock(image.SHA256)
+	defer unlock()
+
+	if err := i.putBlob(ctx, image); err != nil {
+		return nil, err
+	}
+
+	if err := i.putRef(ctx, image.SHA256, image.Key); err != nil {
+		return nil, err
+	}
+
+	if err := i.putRecord(ctx, image); err != nil {
 		return nil, err
 	}
+	i.index(image)
 
-	image.DownloadURL = i.mustMakeDownloadURL(image.Key.String())
 	return image, nil
 }
 
 func (i *imageService) Get(ctx context.Context, id uuid.UUID) (*Image, error) {
-	object, err := i.Minio.GetObjectWithContext(ctx, i.Minio.BucketName, id.String(), s3.GetObjectOptions{})
+	image, info, err := i.stat(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	info, err := object.Stat()
+	key := id.String()
+	if digest := info.Metadata.Get(metadataBlob); digest != "" {
+		key = blobKey(digest)
+	}
+
+	ctx, span := i.startSpan(ctx, "GetObjectWithContext", i.key(key))
+	object, err := i.Minio.GetObjectWithContext(ctx, i.Minio.BucketName, i.key(key), s3.GetObjectOptions{})
+	endSpan(span, err)
 	if err != nil {
-		e := s3.ToErrorResponse(err)
-		switch e.StatusCode {
-		case http.StatusNotFound:
-			return nil, ErrImageNotFound
-		default:
-			return nil, err
-		}
+		return nil, err
 	}
 
-	image := i.makeImage(&info)
 	image.Content = object
 	return image, nil
 }
@@ -145,14 +203,25 @@ func (i *imageService) List(ctx context.Context) ([]*Image, error) {
 
 	go func() {
 		defer close(done)
-		for object := range i.Minio.ListObjectsV2(i.Minio.BucketName, "", false, done) {
+
+		_, span := i.startSpan(ctx, "ListObjectsV2", i.Prefix)
+		defer span.End()
+
+		for object := range i.Minio.ListObjectsV2(i.Minio.BucketName, i.Prefix, false, done) {
 			if err := object.Err; err != nil {
-				log.Errorln(err)
+				logger(ctx).Errorln(err)
+				span.RecordError(err)
+				continue
+			}
+
+			// Skip blobs and references
+			id, err := uuid.Parse(strings.TrimPrefix(object.Key, i.Prefix))
+			if err != nil {
 				continue
 			}
 
 			// Get the real object for metadata
-			image, err := i.Get(ctx, uuid.MustParse(object.Key))
+			image, _, err := i.stat(ctx, id)
 			if err == nil { // no error, use it
 				images = append(images, image)
 				continue
@@ -171,42 +240,253 @@ func (i *imageService) List(ctx context.Context) ([]*Image, error) {
 	}
 }
 
+func (i *imageService) Update(ctx context.Context, image *Image) (*Image, error) {
+	_, info, err := i.stat(ctx, image.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Legacy objects hold their content, convert them first so that only metadata is rewritten
+	if info.Metadata.Get(metadataBlob) == "" {
+		if _, err := i.migrate(ctx, image.Key); err != nil {
+			return nil, err
+		}
+
+		if _, info, err = i.stat(ctx, image.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Concurrent deletions must not leave a record without its reference or its blob, see blobs.go
+	digest := info.Metadata.Get(metadataBlob)
+	unlock := i.lock(digest)
+	defer unlock()
+
+	current, _, err := i.stat(ctx, image.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := i.statObject(ctx, i.key(blobKey(digest))); err != nil {
+		if s3.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: blob %s of record %s", ErrImageNotFound, digest, image.Key)
+		}
+		return nil, err
+	}
+
+	// Content related fields are not updatable
+	updated := *image
+	updated.SHA256, updated.Size, updated.ContentType = digest, current.Size, current.ContentType
+
+	if err := i.putRecord(ctx, &updated); err != nil {
+		return nil, err
+	}
+
+	updated.Content = nil
+	return &updated, nil
+}
+
 func (i *imageService) Delete(ctx context.Context, ids ...uuid.UUID) error {
+	for _, id := range ids {
+		if err := i.delete(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delete removes the Image record and its reference, then the blob when it is not referenced anymore
+func (i *imageService) delete(ctx context.Context, id uuid.UUID) error {
+	_, info, err := i.stat(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrImageNotFound) {
+			return nil // deleting a missing object is not an error on S3
+		}
+		return err
+	}
+
+	digest := info.Metadata.Get(metadataBlob)
+	if digest == "" { // legacy object holding its own content
+		i.hashes.remove(id)
+		return i.removeObjects(ctx, i.key(id.String()))
+	}
+
+	unlock := i.lock(digest)
+	defer unlock()
+
+	if err := i.removeObjects(ctx, i.key(id.String()), i.key(refKey(digest, id))); err != nil {
+		return err
+	}
+
+	count, err := i.refCount(ctx, digest)
+	if err != nil {
+		return err
+	}
+
+	i.hashes.remove(id)
+	if count > 0 {
+		return nil
+	}
+
+	return i.removeObjects(ctx, i.key(blobKey(digest)))
+}
+
+// Similar finds exact duplicates by the references of the blob, and near duplicates with the perceptual hash index
+func (i *imageService) Similar(ctx context.Context, image *Image, maxDistance int) ([]*similarImage, error) {
+	distances := make(map[uuid.UUID]int)
+	if h, ok := parseHash(image.PerceptualHash); ok {
+		matches, err := i.hashes.within(ctx, h, maxDistance, i.perceptualHashes)
+		if err != nil {
+			return nil, err
+		}
+		distances = matches
+	}
+
+	if image.SHA256 != "" {
+		ids, err := i.refs(ctx, image.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			distances[id] = 0
+		}
+	}
+	delete(distances, image.Key)
+
+	similar := make([]*similarImage, 0, len(distances))
+	for id, d := range distances {
+		found, _, err := i.stat(ctx, id)
+		if errors.Is(err, ErrImageNotFound) { // deleted by another replica
+			i.hashes.remove(id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		similar = append(similar, &similarImage{Image: found, Distance: d})
+	}
+
+	sort.Slice(similar, func(a, b int) bool {
+		if similar[a].Distance != similar[b].Distance {
+			return similar[a].Distance < similar[b].Distance
+		}
+		return similar[a].Key.String() < similar[b].Key.String()
+	})
+	return similar, nil
+}
+
+// perceptualHashes lists the perceptual hashes of the stored images, see hashIndex
+func (i *imageService) perceptualHashes(ctx context.Context) (map[uuid.UUID]uint64, error) {
+	images, err := i.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[uuid.UUID]uint64, len(images))
+	for _, image := range images {
+		if h, ok := parseHash(image.PerceptualHash); ok {
+			hashes[image.Key] = h
+		}
+	}
+
+	return hashes, nil
+}
+
+// index records the perceptual hash of a written image, see Similar
+func (i *imageService) index(image *Image) {
+	if h, ok := parseHash(image.PerceptualHash); ok {
+		i.hashes.set(image.Key, h)
+	}
+}
+
+// removeObjects deletes given keys and returns the first error
+func (i *imageService) removeObjects(ctx context.Context, keys ...string) error {
 	toDelete := make(chan string)
 	go func() {
 		defer close(toDelete)
-		for _, id := range ids {
-			toDelete <- id.String()
+		for _, k := range keys {
+			toDelete <- k
 		}
 	}()
 
+	ctx, span := i.startSpan(ctx, "RemoveObjectsWithContext", strings.Join(keys, ","))
 	for err := range i.Minio.RemoveObjectsWithContext(ctx, i.Minio.BucketName, toDelete) {
+		endSpan(span, err.Err)
 		return err.Err
 	}
 
+	endSpan(span, nil)
 	return nil
 }
 
+// stat returns the Image metadata without opening its content, reading the record body when there is one
+func (i *imageService) stat(ctx context.Context, id uuid.UUID) (*Image, *s3.ObjectInfo, error) {
+	info, err := i.statObject(ctx, i.key(id.String()))
+	if err != nil {
+		e := s3.ToErrorResponse(err)
+		switch e.StatusCode {
+		case http.StatusNotFound:
+			return nil, nil, ErrImageNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	image := i.makeImage(&info)
+	if info.Metadata.Get(metadataBlob) != "" && info.Size > 0 {
+		if err := i.getRecord(ctx, image); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return image, &info, nil
+}
+
+// statObject returns the metadata of the object
+func (i *imageService) statObject(ctx context.Context, key string) (s3.ObjectInfo, error) {
+	_, span := i.startSpan(ctx, "StatObject", key)
+	info, err := i.Minio.StatObject(i.Minio.BucketName, key, s3.StatObjectOptions{})
+	endSpan(span, err)
+	return info, err
+}
+
+// makeImage returns the Image described by the object user metadata, see record for the records having a body
 func (i *imageService) makeImage(object *s3.ObjectInfo) *Image {
-	return &Image{
-		Key:         uuid.MustParse(object.Key),
+	image := &Image{
+		Key:         uuid.MustParse(strings.TrimPrefix(object.Key, i.Prefix)),
 		Name:        object.Metadata.Get("X-Amz-Meta-Name"),
 		Content:     nil,
 		ContentType: object.ContentType,
 		Description: object.Metadata.Get("X-Amz-Meta-Description"),
-		DownloadURL: i.mustMakeDownloadURL(object.Key),
 		Size:        object.Size,
+
+		SHA256:         object.Metadata.Get("X-Amz-Meta-Sha256"),
+		PerceptualHash: object.Metadata.Get("X-Amz-Meta-Phash"),
+
+		BlurHash:      object.Metadata.Get("X-Amz-Meta-Blurhash"),
+		LQIP:          object.Metadata.Get("X-Amz-Meta-Lqip"),
+		DominantColor: object.Metadata.Get("X-Amz-Meta-Dominant-Color"),
+		AverageColor:  object.Metadata.Get("X-Amz-Meta-Average-Color"),
+	}
+	image.Watermark, _ = strconv.ParseBool(object.Metadata.Get("X-Amz-Meta-Watermark"))
+	image.Owner, _ = url.PathUnescape(object.Metadata.Get("X-Amz-Meta-Owner"))
+	if grants := object.Metadata.Get("X-Amz-Meta-Grants"); grants != "" {
+		image.Grants = parseGrants(grants)
 	}
-}
 
-// mustMakeDownloadURL use the native Minio feature to generate download links
-// each URLs will be available 7 days.
-func (i *imageService) mustMakeDownloadURL(name string) string {
-	d, _ := time.ParseDuration("604800s") // 7 days
-	u, err := i.Minio.PresignedGetObject(i.Minio.BucketName, name, d, nil)
-	if err != nil {
-		log.Panicf("cannot generate presigned URL: %v", err)
+	// Unknown values fall back to the most restrictive visibility
+	if v, err := parseVisibility(object.Metadata.Get("X-Amz-Meta-Visibility")); err == nil {
+		image.Visibility = v
+	} else {
+		image.Visibility = visibilityPrivate
+	}
+
+	// Records do not hold the content, see blobs.go
+	if object.Metadata.Get(metadataBlob) != "" {
+		image.Size, _ = strconv.ParseInt(object.Metadata.Get(metadataSize), 10, 64)
 	}
 
-	return u.String()
+	return image
 }
@@ -74,8 +74,7 @@ func TestImage_validateContentType(t *testing.T) {
 
 	invalidContentTypes := []string{
 		"image/x-icon",
-		"image/bmp",
-		"image/tiff",
+		"image/heic",
 		"application/zip",
 		"video/mpeg",
 	}
@@ -84,6 +83,11 @@ func TestImage_validateContentType(t *testing.T) {
 		"image/jpeg",
 		"image/png",
 		"image/svg+xml",
+		"image/gif",
+		"image/webp",
+		"image/avif",
+		"image/bmp",
+		"image/tiff",
 	}
 
 	// Populate tests
@@ -131,7 +135,7 @@ func TestImage_validateContentType(t *testing.T) {
 				DownloadURL: tt.fields.DownloadURL,
 				Size:        tt.fields.Size,
 			}
-			if err := i.validateContentType(); (err != nil) != tt.wantErr {
+			if err := i.validateContentType(defaultContentTypes); (err != nil) != tt.wantErr {
 				t.Errorf("validateContentType() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -2,6 +2,9 @@ package internal
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 
@@ -10,6 +13,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// imageContentSecurityPolicy forbids images served by the API, e.g. SVG documents, to load or run anything
+const imageContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
 var (
 	// ErrCannotFindFile describes error when request form does not contains the 'file' key
 	ErrCannotFindFile = errors.New("cannot find 'file'")
@@ -21,37 +27,77 @@ type uploadImageForm struct {
 	Name        string                `form:"name" binding:"-"`
 	Description string                `form:"description" binding:"-"`
 	Header      *multipart.FileHeader `form:"file" binding:"required"`
+	OnDuplicate string                `form:"on_duplicate" binding:"omitempty,oneof=allow reject return_existing"`
+	Watermark   bool                  `form:"watermark" binding:"-"`
+	Visibility  string                `form:"visibility" binding:"omitempty,oneof=private unlisted public"`
+}
+
+// updateImageForm describes the fields of an image which can be updated, missing fields are left untouched.
+// Changing the visibility requires the owner permission.
+type updateImageForm struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Visibility  *string `json:"visibility" binding:"omitempty,oneof=private unlisted public"`
 }
 
 func (s *server) handleImagesList(c *gin.Context) {
-	images, err := s.Image.List(c.Request.Context())
+	images, err := s.tenant(c).Image.List(c.Request.Context())
 	if err != nil {
 		_ = c.Error(err)
 		return
 	}
 
-	c.JSON(http.StatusOK, images)
+	images = s.visible(c, images)
+	s.setDownloadURL(c, images...)
+	s.renderImages(c, http.StatusOK, images)
 }
 
 func (s *server) handleImagesGet(c *gin.Context) {
+	image, err := s.getImage(c, permissionRead)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	if closer, ok := image.Content.(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	s.setDownloadURL(c, image)
+	s.renderImage(c, http.StatusOK, image)
+}
 
+// getImage returns the Image of the route, when the caller has the permission on it
+func (s *server) getImage(c *gin.Context, want permission) (*Image, error) {
 	id, _ := c.Get(UUIDContextKey)
-	image, err := s.Image.Get(c.Request.Context(), id.(uuid.UUID))
+	image, err := s.tenant(c).Image.Get(c.Request.Context(), id.(uuid.UUID))
 	if err != nil {
 		if errors.Is(err, ErrImageNotFound) {
 			err = newNotFoundError(err)
 		}
+		return nil, err
+	}
 
-		_ = c.Error(err)
-		return
+	if err := s.authorize(c, image, want); err != nil {
+		if closer, ok := image.Content.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return nil, err
 	}
 
-	c.JSON(http.StatusOK, image)
+	return image, nil
 }
 
 func (s *server) handleImagesCreate(c *gin.Context) {
+	t := s.tenant(c)
+
 	var form uploadImageForm
 	if err := c.ShouldBindWith(&form, binding.FormMultipart); err != nil {
+		if requestBodyTooLarge(c, err) {
+			_ = c.Error(newLimitError(t.limits.errTooLarge()))
+			return
+		}
+
 		_ = c.Error(newBadRequestError(err))
 		return
 	}
@@ -66,10 +112,61 @@ func (s *server) handleImagesCreate(c *gin.Context) {
 		_ = c.Error(err)
 		return
 	}
+	image.Watermark = form.Watermark
+	image.Owner = principal(c).subject()
+	image.Visibility, _ = parseVisibility(form.Visibility) // validated by binding
+
+	// check size and dimensions before storing anything
+	if err := image.validateContentType(t.contentTypes); err != nil {
+		_ = c.Error(newUnsupportedMediaType(err))
+		return
+	}
+
+	if err := t.limits.validate(image); err != nil {
+		_ = c.Error(newLimitError(err))
+		return
+	}
+
+	// look for an existing copy of this image
+	if err := image.fingerprint(); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	if form.OnDuplicate != "" && form.OnDuplicate != onDuplicateAllow {
+		duplicates, err := t.Image.Similar(c.Request.Context(), image, duplicateDistance)
+		if err != nil {
+			_ = c.Error(err)
+			return
+		}
+
+		var existing *Image
+		if visible := s.visibleSimilar(c, duplicates); len(visible) > 0 {
+			existing = visible[0].Image
+		}
+
+		switch {
+		case existing == nil:
+		case form.OnDuplicate == onDuplicateReject:
+			_ = c.Error(newConflictError(fmt.Errorf("%w: %s", ErrDuplicateImage, existing.Key)))
+			return
+		case form.OnDuplicate == onDuplicateReturnExisting:
+			s.setDownloadURL(c, existing)
+			s.renderImage(c, http.StatusOK, existing)
+			return
+		}
+	}
+
+	release, err := t.usage.reserve(c.Request.Context(), t.quotas, image.Owner, image.Size)
+	if err != nil {
+		_ = c.Error(newQuotaError(err))
+		return
+	}
 
 	// upload it!
-	image, err = s.Image.Create(c.Request.Context(), image)
+	image, err = t.Image.Create(c.Request.Context(), image)
 	if err != nil {
+		release()
 		if errors.Is(err, ErrUnsupportedContentType) {
 			err = newUnsupportedMediaType(err)
 		}
@@ -78,15 +175,248 @@ func (s *server) handleImagesCreate(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, image)
+	s.setDownloadURL(c, image)
+	s.renderImage(c, http.StatusCreated, image)
 }
 
 func (s *server) handleImagesDelete(c *gin.Context) {
-	id, _ := c.Get(UUIDContextKey)
-	if err := s.Image.Delete(c.Request.Context(), id.(uuid.UUID)); err != nil {
+	image, err := s.getImage(c, permissionOwner)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	if closer, ok := image.Content.(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	t := s.tenant(c)
+	if err := t.Image.Delete(c.Request.Context(), image.Key); err != nil {
 		_ = c.Error(err)
 		return
 	}
+	t.usage.remove(image.Owner, image.Size)
 
 	c.Status(http.StatusNoContent)
 }
+
+// handleImagesUpdate changes the name, the description or the visibility of an image, it requires the write permission
+func (s *server) handleImagesUpdate(c *gin.Context) {
+	var form updateImageForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		_ = c.Error(newBadRequestError(err))
+		return
+	}
+
+	image, err := s.getImage(c, permissionWrite)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	if closer, ok := image.Content.(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	if form.Name != nil {
+		image.Name = *form.Name
+	}
+	if form.Description != nil {
+		image.Description = *form.Description
+	}
+	if form.Visibility != nil && *form.Visibility != image.Visibility {
+		if err := s.authorize(c, image, permissionOwner); err != nil {
+			_ = c.Error(err)
+			return
+		}
+		image.Visibility = *form.Visibility
+	}
+
+	s.updateImage(c, image)
+}
+
+// handleImagesGrants replaces the sharing grants of an image, only its owner can do it
+func (s *server) handleImagesGrants(c *gin.Context) {
+	var grants []Grant
+	if err := c.ShouldBindJSON(&grants); err != nil {
+		_ = c.Error(newBadRequestError(err))
+		return
+	}
+
+	if err := validateGrants(grants); err != nil {
+		_ = c.Error(newBadRequestError(err))
+		return
+	}
+
+	image, err := s.getImage(c, permissionOwner)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	if closer, ok := image.Content.(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	image.Grants = grants
+	s.updateImage(c, image)
+}
+
+func (s *server) updateImage(c *gin.Context, image *Image) {
+	image, err := s.tenant(c).Image.Update(c.Request.Context(), image)
+	if err != nil {
+		if errors.Is(err, ErrImageNotFound) {
+			err = newNotFoundError(err)
+		}
+
+		_ = c.Error(err)
+		return
+	}
+
+	s.setDownloadURL(c, image)
+	s.renderImage(c, http.StatusOK, image)
+}
+
+// handleImagesDownload serves the image content, converted according to ?format= or the Accept header.
+// The watermark is composited when enforced by the image or requested with ?watermark=true.
+func (s *server) handleImagesDownload(c *gin.Context) {
+	image, err := s.getImage(c, permissionRead)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	s.serveImage(c, image)
+}
+
+// handlePublicDownload serves public and unlisted images without credentials through a stable link,
+// and private images to holders of a valid signed link, see setDownloadURL.
+func (s *server) handlePublicDownload(c *gin.Context) {
+	id, _ := c.Get(UUIDContextKey)
+	signed, err := s.signed(c, id.(uuid.UUID))
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	image, err := s.tenant(c).Image.Get(c.Request.Context(), id.(uuid.UUID))
+	if err != nil {
+		if errors.Is(err, ErrImageNotFound) {
+			err = newNotFoundError(err)
+		}
+
+		_ = c.Error(err)
+		return
+	}
+
+	if !signed && !image.anonymous() {
+		if closer, ok := image.Content.(io.Closer); ok {
+			_ = closer.Close()
+		}
+
+		_ = c.Error(newNotFoundError(ErrImageNotFound))
+		return
+	}
+
+	if signed {
+		c.Header("Cache-Control", "private, no-store")
+	}
+
+	s.serveImage(c, image)
+}
+
+// serveImage writes the image content, converted according to ?format= or the Accept header
+func (s *server) serveImage(c *gin.Context, image *Image) {
+	if closer, ok := image.Content.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Representation depends on the Accept header, even when the original is served
+	c.Header("Vary", "Accept")
+
+	// Images are served from the API origin: browsers must neither sniff them nor run the scripts of SVG documents
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", imageContentSecurityPolicy)
+
+	conv, err := parseConversion(c.Request, image)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotAcceptable):
+			err = newNotAcceptableError(err)
+		case errors.Is(err, ErrUnknownFormat), errors.Is(err, ErrInvalidConversion):
+			err = newBadRequestError(err)
+		}
+
+		_ = c.Error(err)
+		return
+	}
+
+	if conv.Watermark, err = s.watermarkFor(c, image); err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	image, err = s.variants.apply(conv, image)
+	if err != nil {
+		if errors.Is(err, ErrCannotConvert) {
+			err = newUnprocessableEntityError(err)
+		}
+
+		_ = c.Error(err)
+		return
+	}
+
+	// SVG documents are downloaded rather than rendered, unless rasterized
+	disposition, params := "inline", make(map[string]string)
+	if image.ContentType == "image/svg+xml" {
+		disposition = "attachment"
+	}
+	if image.Name != "" {
+		params["filename"] = image.Name
+	}
+
+	headers := map[string]string{"Content-Disposition": mime.FormatMediaType(disposition, params)}
+
+	c.DataFromReader(http.StatusOK, image.Size, image.ContentType, image.Content, headers)
+}
+
+// handleImagesSimilar lists images looking like the given one, closest first.
+// ?distance= is the maximum Hamming distance between perceptual hashes, from 0 to 64.
+func (s *server) handleImagesSimilar(c *gin.Context) {
+	var query struct {
+		Distance *int `form:"distance" binding:"omitempty,min=0,max=64"`
+	}
+
+	if err := c.ShouldBindQuery(&query); err != nil {
+		_ = c.Error(newBadRequestError(err))
+		return
+	}
+
+	distance := defaultSimilarDistance
+	if query.Distance != nil {
+		distance = *query.Distance
+	}
+
+	image, err := s.getImage(c, permissionRead)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	if closer, ok := image.Content.(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	similar, err := s.tenant(c).Image.Similar(c.Request.Context(), image, distance)
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	similar = s.visibleSimilar(c, similar)
+	for _, i := range similar {
+		s.setDownloadURL(c, i.Image)
+	}
+
+	s.renderSimilar(c, http.StatusOK, similar)
+}
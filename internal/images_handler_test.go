@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"bytes"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"golang.org/x/net/context"
@@ -80,7 +82,7 @@ func Test_server_handleImagesDelete(t *testing.T) {
 			}
 
 			// Make the fake route
-			s.router.GET("/foo/:image", readErrorHandler, s.BindUUID, s.handleImagesDelete)
+			s.router.GET("/foo/:image", readErrorHandler, withPrincipal(admin), s.BindUUID, s.handleImagesDelete)
 
 			// Run test
 			rw := httptest.NewRecorder()
@@ -152,6 +154,7 @@ func Test_server_handleImagesList(t *testing.T) {
 			s := &server{
 				router: gin.New(),
 				Image:  tt.fields.Image,
+				links:  testingLinks,
 			}
 
 			// basic middleware to read received error
@@ -166,7 +169,7 @@ func Test_server_handleImagesList(t *testing.T) {
 				c.Status(500)
 			}
 
-			s.router.GET("/foo", readErrorHandler, s.handleImagesList)
+			s.router.GET("/foo", readErrorHandler, withPrincipal(admin), s.handleImagesList)
 			rw := httptest.NewRecorder()
 			req := httptest.NewRequest("GET", "/foo", nil)
 			req = req.WithContext(tt.args.ctx)
@@ -177,3 +180,79 @@ func Test_server_handleImagesList(t *testing.T) {
 		})
 	}
 }
+
+func Test_server_handleImagesDownload(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		url             string
+		accept          string
+		wantCode        int
+		wantContentType string
+	}{
+		{
+			name:            "Original",
+			url:             "",
+			wantCode:        200,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "Explicit format",
+			url:             "?format=jpeg",
+			wantCode:        200,
+			wantContentType: "image/jpeg",
+		},
+		{
+			name:            "Original not acceptable",
+			accept:          "image/jpeg",
+			wantCode:        200,
+			wantContentType: "image/jpeg",
+		},
+		{
+			name:     "Unknown format",
+			url:      "?format=tiff",
+			wantCode: 400,
+		},
+		{
+			name:     "Not acceptable",
+			accept:   "text/html",
+			wantCode: 406,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := new(testingImageService)
+			image, _ := service.Create(context.TODO(), &Image{
+				Key:         uuid.New(),
+				Name:        "gopher.png",
+				Content:     bytes.NewReader(gopher),
+				ContentType: "image/png",
+				Size:        int64(len(gopher)),
+			})
+
+			s := &server{
+				router: gin.New(),
+				Image:  service,
+			}
+			s.router.GET("/foo/:image", s.handleErrors, withPrincipal(admin), s.BindUUID, s.handleImagesDownload)
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/foo/"+image.Key.String()+tt.url, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			s.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantCode, rw.Code)
+			assert.Equal(t, "Accept", rw.Header().Get("Vary"))
+			if tt.wantContentType != "" {
+				assert.Equal(t, tt.wantContentType, rw.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
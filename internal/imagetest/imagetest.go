@@ -0,0 +1,72 @@
+// Package imagetest provides the images shared by the tests of the codecs.
+package imagetest
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Gopher decodes testdata/gopher.png
+func Gopher(t testing.TB) image.Image {
+	t.Helper()
+
+	_, file, _, _ := runtime.Caller(0)
+	f, err := os.Open(filepath.Join(filepath.Dir(file), "..", "testdata", "gopher.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Noise returns an image of random pixels, always the same ones, transparent or not
+func Noise(w, h int, alpha bool) image.Image {
+	r := rand.New(rand.NewSource(42))
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	r.Read(m.Pix)
+	if !alpha {
+		for i := 3; i < len(m.Pix); i += 4 {
+			m.Pix[i] = 0xff
+		}
+	}
+	return m
+}
+
+// Uniform returns an image of the color c
+func Uniform(w, h int, c color.Color) image.Image {
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(m, m.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return m
+}
+
+// AssertSamePixels fails the test when got does not have the size and the pixels of want
+func AssertSamePixels(t testing.TB, want, got image.Image) {
+	t.Helper()
+
+	wb, gb := want.Bounds(), got.Bounds()
+	if wb.Size() != gb.Size() {
+		t.Fatalf("size mismatch: want %v, got %v", wb.Size(), gb.Size())
+	}
+
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			w := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			if w != g {
+				t.Fatalf("pixel (%d, %d) mismatch: want %v, got %v", x, y, w, g)
+			}
+		}
+	}
+}
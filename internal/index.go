@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// hashIndexTTL is how long the perceptual hash index is used before being rebuilt from the storage,
+// picking up the images written by other replicas
+const hashIndexTTL = 10 * time.Minute
+
+// hashIndex keeps the perceptual hash of every image in memory, so that near duplicates are found
+// without reading the metadata of every image, see imageService.Similar.
+// It is built from the storage on first use and when outdated, and updated by every write in between.
+type hashIndex struct {
+	mu     sync.Mutex
+	hashes map[uuid.UUID]uint64
+	built  time.Time
+
+	// building is closed when the running build ends, nil when not building
+	building chan struct{}
+	// changes are the writes seen during the running build, applied to its result, nil for deletions
+	changes map[uuid.UUID]*uint64
+}
+
+// within returns the distance to hash of the images within maxDistance of it.
+// build lists the hashes of the storage, it runs without holding the lock: stale hashes are used meanwhile,
+// only the first build is waited for.
+func (x *hashIndex) within(ctx context.Context, hash uint64, maxDistance int, build func(context.Context) (map[uuid.UUID]uint64, error)) (map[uuid.UUID]int, error) {
+	if err := x.refresh(ctx, build); err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	matches := make(map[uuid.UUID]int)
+	for id, h := range x.hashes {
+		if d := bits.OnesCount64(hash ^ h); d <= maxDistance {
+			matches[id] = d
+		}
+	}
+
+	return matches, nil
+}
+
+// refresh builds the index when missing or outdated
+func (x *hashIndex) refresh(ctx context.Context, build func(context.Context) (map[uuid.UUID]uint64, error)) error {
+	x.mu.Lock()
+	if x.hashes != nil && time.Since(x.built) < hashIndexTTL {
+		x.mu.Unlock()
+		return nil
+	}
+
+	if building := x.building; building != nil {
+		x.mu.Unlock()
+		if x.ready() {
+			return nil // stale hashes are good enough while rebuilding
+		}
+
+		select {
+		case <-building:
+			return x.refresh(ctx, build)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	x.building = make(chan struct{})
+	x.changes = make(map[uuid.UUID]*uint64)
+	x.mu.Unlock()
+
+	hashes, err := build(ctx)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err == nil {
+		for id, h := range x.changes {
+			if h == nil {
+				delete(hashes, id)
+			} else {
+				hashes[id] = *h
+			}
+		}
+		x.hashes, x.built = hashes, time.Now()
+	}
+
+	close(x.building)
+	x.building, x.changes = nil, nil
+	return err
+}
+
+// ready tells whether the index was built once
+func (x *hashIndex) ready() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.hashes != nil
+}
+
+// set records the perceptual hash of a written image
+func (x *hashIndex) set(id uuid.UUID, hash uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.hashes != nil {
+		x.hashes[id] = hash
+	}
+	if x.changes != nil {
+		x.changes[id] = &hash
+	}
+}
+
+// remove forgets a deleted image
+func (x *hashIndex) remove(id uuid.UUID) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.hashes, id)
+	if x.changes != nil {
+		x.changes[id] = nil
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hashIndex_within(t *testing.T) {
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	var x hashIndex
+
+	builds := 0
+	build := func(context.Context) (map[uuid.UUID]uint64, error) {
+		builds++
+		return map[uuid.UUID]uint64{a: 0x0, b: 0xff}, nil
+	}
+
+	got, err := x.within(context.Background(), 0x1, 2, build)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uuid.UUID]int{a: 1}, got)
+
+	x.set(c, 0x3)
+	x.remove(a)
+	got, err = x.within(context.Background(), 0x1, 2, build)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uuid.UUID]int{c: 1}, got, "writes update the index")
+	assert.Equal(t, 1, builds, "the index is built once")
+
+	// Outdated indexes are rebuilt, keeping the writes seen meanwhile
+	x.built = time.Now().Add(-hashIndexTTL)
+	got, err = x.within(context.Background(), 0x1, 2, func(ctx context.Context) (map[uuid.UUID]uint64, error) {
+		x.set(c, 0x3)
+		x.remove(a)
+		return build(ctx)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[uuid.UUID]int{c: 1}, got)
+	assert.Equal(t, 2, builds)
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jwksMinRefreshInterval throttles refreshes triggered by unknown key ids
+const jwksMinRefreshInterval = time.Minute
+
+var (
+	// ErrUnknownKey no key of the JWKS matches the token key id
+	ErrUnknownKey = errors.New("unknown signing key")
+
+	// ErrInvalidJWKS the JWKS cannot be read
+	ErrInvalidJWKS = errors.New("invalid JWKS")
+)
+
+// jsonWebKey is a public key of a JWKS, see RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key material
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(v string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(v)
+		return new(big.Int).SetBytes(b)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		if k.N == "" || k.E == "" {
+			return nil, fmt.Errorf("%w: RSA key %q without modulus or exponent", ErrInvalidJWKS, k.Kid)
+		}
+		return &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: unsupported curve %q", ErrInvalidJWKS, k.Crv)
+		}
+
+		key := &ecdsa.PublicKey{Curve: curve, X: decode(k.X), Y: decode(k.Y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("%w: EC key %q is not on its curve", ErrInvalidJWKS, k.Kid)
+		}
+		return key, nil
+
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid OKP key %q", ErrInvalidJWKS, k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %q", ErrInvalidJWKS, k.Kty)
+	}
+}
+
+// keySet is a cached JWKS read from an URL or a local file.
+// Keys are refreshed when the cache expires, and when a token is signed by an unknown key
+// so that rotated keys are picked up without waiting for the expiration.
+type keySet struct {
+	url    string
+	file   string
+	ttl    time.Duration
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key id
+	fetched time.Time                   // last successful refresh
+	tried   time.Time                   // last refresh, successful or not
+	err     error                       // error of the last refresh
+	now     func() time.Time
+
+	// refreshing is closed when the running refresh ends, nil when not refreshing
+	refreshing chan struct{}
+}
+
+func newKeySet(url, file string, ttl time.Duration) *keySet {
+	return &keySet{
+		url:    url,
+		file:   file,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+// key returns the public key matching the key id. An empty key id is accepted when the JWKS holds a single key.
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	expired := s.keys == nil || s.now().Sub(s.fetched) > s.ttl
+	s.mu.Unlock()
+
+	if expired {
+		if err := s.refresh(ctx); err != nil && !s.loaded() {
+			return nil, err
+		}
+	}
+
+	if k, ok := s.lookup(kid); ok {
+		return k, nil
+	}
+
+	// The key may have been rotated
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if k, ok := s.lookup(kid); ok {
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+}
+
+func (s *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k, true
+		}
+	}
+
+	k, ok := s.keys[kid]
+	return k, ok
+}
+
+// loaded tells whether the JWKS was read once
+func (s *keySet) loaded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys != nil
+}
+
+// refresh reads the JWKS, at most once per jwksMinRefreshInterval: it returns the error of the last refresh
+// meanwhile. The JWKS is read in the background, without holding the lock, concurrent callers wait for the
+// running refresh. Stale keys are kept when it fails.
+func (s *keySet) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	refreshing := s.refreshing
+	if refreshing == nil {
+		if !s.tried.IsZero() && s.now().Sub(s.tried) < jwksMinRefreshInterval {
+			defer s.mu.Unlock()
+			return s.err
+		}
+
+		s.tried = s.now()
+		refreshing = make(chan struct{})
+		s.refreshing = refreshing
+		go s.update(refreshing)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-refreshing:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update runs a refresh and closes done. It does not depend on the context of any caller, so that a caller
+// giving up neither fails the refresh for the others nor throttles the next ones: the client timeout applies.
+func (s *keySet) update(done chan struct{}) {
+	keys, err := s.fetch(context.Background())
+	if err != nil {
+		log.Errorf("cannot refresh JWKS: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.keys, s.fetched = keys, s.now()
+	}
+	s.err = err
+	close(done)
+	s.refreshing = nil
+}
+
+// fetch reads and decodes the JWKS
+func (s *keySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	data, err := s.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJWKS, err)
+	}
+
+	var jwks struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJWKS, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnln(err) // skip keys we do not understand
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (s *keySet) read(ctx context.Context) ([]byte, error) {
+	if s.file != "" {
+		return os.ReadFile(s.file)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", s.url, res.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
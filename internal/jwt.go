@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	// ErrInvalidToken bearer token signature or claims are invalid
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrInvalidOIDCConfig OIDC configuration is incomplete or malformed
+	ErrInvalidOIDCConfig = errors.New("invalid OIDC configuration")
+)
+
+// OIDCConfig describes how bearer tokens issued by an identity provider are verified
+type OIDCConfig struct {
+	Issuer       string        `yaml:"issuer"`         // expected "iss" claim
+	Audience     string        `yaml:"audience"`       // expected in the "aud" claim
+	JWKSURL      string        `yaml:"jwks_url"`       // JWKS location, e.g. https://sso.example.com/.well-known/jwks.json
+	JWKSFile     string        `yaml:"jwks_file"`      // local JWKS, used instead of JWKSURL when set
+	JWKSCacheTTL time.Duration `yaml:"jwks_cache_ttl"` // how long keys are cached
+	Leeway       time.Duration `yaml:"leeway"`         // tolerated clock skew when checking exp, nbf and iat
+	Algorithms   []string      `yaml:"algorithms"`     // accepted signing algorithms
+
+	// ScopesClaim holds granted scopes, as a space separated string or an array.
+	// Nested claims are addressed with dots, e.g. "realm_access.roles".
+	ScopesClaim string `yaml:"scopes_claim"`
+
+	// GroupsClaim holds the groups of the caller, images can be shared with them
+	GroupsClaim string `yaml:"groups_claim"`
+
+	// TenantClaim holds the tenant the caller belongs to
+	TenantClaim string `yaml:"tenant_claim"`
+
+	// RolesClaim holds roles mapped to scopes with RoleScopes
+	RolesClaim string              `yaml:"roles_claim"`
+	RoleScopes map[string][]string `yaml:"role_scopes"`
+}
+
+// enabled tells whether bearer tokens are accepted
+func (o OIDCConfig) enabled() bool {
+	return o.JWKSURL != "" || o.JWKSFile != ""
+}
+
+// defaultOIDCConfig returns the options used when nothing is configured
+func defaultOIDCConfig() OIDCConfig {
+	return OIDCConfig{
+		JWKSCacheTTL: time.Hour,
+		Leeway:       30 * time.Second,
+		Algorithms:   []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"},
+		ScopesClaim:  "scope",
+		GroupsClaim:  "groups",
+		TenantClaim:  "tenant",
+		RoleScopes:   make(map[string][]string),
+	}
+}
+
+// oidcFromEnv reads OIDCConfig from $OIDC_* environment variables, starting from o.
+// $OIDC_ROLE_SCOPES maps roles to scopes, e.g. "admin=images:read,images:write;viewer=images:read".
+func oidcFromEnv(o OIDCConfig) (OIDCConfig, error) {
+	strs := map[string]*string{
+		"OIDC_ISSUER":       &o.Issuer,
+		"OIDC_AUDIENCE":     &o.Audience,
+		"OIDC_JWKS_URL":     &o.JWKSURL,
+		"OIDC_JWKS_FILE":    &o.JWKSFile,
+		"OIDC_SCOPES_CLAIM": &o.ScopesClaim,
+		"OIDC_ROLES_CLAIM":  &o.RolesClaim,
+		"OIDC_GROUPS_CLAIM": &o.GroupsClaim,
+		"OIDC_TENANT_CLAIM": &o.TenantClaim,
+	}
+	for k, p := range strs {
+		if v, ok := os.LookupEnv(k); ok {
+			*p = v
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"OIDC_JWKS_CACHE_TTL": &o.JWKSCacheTTL,
+		"OIDC_LEEWAY":         &o.Leeway,
+	}
+	for k, p := range durations {
+		if v, ok := os.LookupEnv(k); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return o, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = d
+		}
+	}
+
+	if v, ok := os.LookupEnv("OIDC_ALGORITHMS"); ok {
+		o.Algorithms = splitScopes(v)
+	}
+
+	for _, entry := range strings.Split(os.Getenv("OIDC_ROLE_SCOPES"), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return o, fmt.Errorf("invalid $OIDC_ROLE_SCOPES: expected <role>=<scopes>, got %q", entry)
+		}
+
+		if o.RoleScopes == nil {
+			o.RoleScopes = make(map[string][]string)
+		}
+		o.RoleScopes[parts[0]] = splitScopes(parts[1])
+	}
+
+	return o, nil
+}
+
+func (o OIDCConfig) validate() error {
+	if !o.enabled() {
+		return nil
+	}
+
+	// Without these checks, any token signed by the provider would be accepted, whatever its recipient
+	if o.Issuer == "" || o.Audience == "" {
+		return fmt.Errorf("%w: issuer and audience are required", ErrInvalidOIDCConfig)
+	}
+
+	for _, alg := range o.Algorithms {
+		if alg == "none" || strings.HasPrefix(alg, "HS") {
+			return fmt.Errorf("%w: algorithm %q cannot be verified with a JWKS", ErrInvalidOIDCConfig, alg)
+		}
+	}
+
+	return nil
+}
+
+// tokenVerifier validates JWT bearer tokens against a JWKS
+type tokenVerifier struct {
+	config OIDCConfig
+	keys   *keySet
+	now    func() time.Time
+}
+
+func newTokenVerifier(config OIDCConfig) *tokenVerifier {
+	return &tokenVerifier{
+		config: config,
+		keys:   newKeySet(config.JWKSURL, config.JWKSFile, config.JWKSCacheTTL),
+		now:    time.Now,
+	}
+}
+
+// isJWT tells whether the bearer credential looks like a JWT rather than an API key
+func isJWT(credential string) bool {
+	return strings.Count(credential, ".") == 2
+}
+
+// verify checks the token signature, issuer, audience and validity period, and returns its Principal
+func (v *tokenVerifier) verify(ctx context.Context, raw string) (*Principal, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(v.config.Algorithms), jwt.WithoutClaimsValidation())
+
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.key(ctx, kid)
+	})
+	if err != nil {
+		if errors.Is(err, ErrInvalidJWKS) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if err := v.validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	p := &Principal{Subject: sub, Scopes: v.scopes(claims)}
+	if v.config.GroupsClaim != "" {
+		p.Groups = claimStrings(claims, v.config.GroupsClaim)
+	}
+
+	if v.config.TenantClaim != "" {
+		if tenant := claimStrings(claims, v.config.TenantClaim); len(tenant) == 1 {
+			p.Tenant = tenant[0]
+		}
+	}
+
+	return p, nil
+}
+
+// validate checks registered claims, exp is required
+func (v *tokenVerifier) validate(claims jwt.MapClaims) error {
+	now := v.now()
+
+	if !claims.VerifyIssuer(v.config.Issuer, true) {
+		return errors.New("unexpected issuer")
+	}
+
+	if !claims.VerifyAudience(v.config.Audience, true) {
+		return errors.New("unexpected audience")
+	}
+
+	if !claims.VerifyExpiresAt(now.Add(-v.config.Leeway).Unix(), true) {
+		return errors.New("token is expired")
+	}
+
+	if !claims.VerifyNotBefore(now.Add(v.config.Leeway).Unix(), false) {
+		return errors.New("token is not valid yet")
+	}
+
+	if !claims.VerifyIssuedAt(now.Add(v.config.Leeway).Unix(), false) {
+		return errors.New("token used before issued")
+	}
+
+	return nil
+}
+
+// scopes maps the token claims to granted scopes
+func (v *tokenVerifier) scopes(claims jwt.MapClaims) []string {
+	scopes := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(values ...string) {
+		for _, s := range values {
+			if !seen[s] {
+				seen[s] = true
+				scopes = append(scopes, s)
+			}
+		}
+	}
+
+	if v.config.ScopesClaim != "" {
+		add(claimStrings(claims, v.config.ScopesClaim)...)
+	}
+
+	if v.config.RolesClaim != "" {
+		for _, role := range claimStrings(claims, v.config.RolesClaim) {
+			add(v.config.RoleScopes[role]...)
+		}
+	}
+
+	return scopes
+}
+
+// claimStrings reads a claim holding a space separated string or an array of strings.
+// Nested claims are addressed with dots.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,448 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testingJWKS is a local identity provider stand-in serving a JWKS
+type testingJWKS struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     []map[string]string
+	requests int
+	down     bool
+}
+
+func newTestingJWKS(t *testing.T) *testingJWKS {
+	j := new(testingJWKS)
+	j.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		j.requests++
+		if j.down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": j.keys})
+	}))
+	t.Cleanup(j.Close)
+	return j
+}
+
+func (j *testingJWKS) publish(kid string, key interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		j.keys = append(j.keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N), "e": b64(big.NewInt(int64(k.E)))})
+	case *ecdsa.PublicKey:
+		j.keys = append(j.keys, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X), "y": b64(k.Y)})
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func Test_tokenVerifier_verify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwks := newTestingJWKS(t)
+	jwks.publish("rsa", &rsaKey.PublicKey)
+	jwks.publish("ec", &ecKey.PublicKey)
+
+	config := defaultOIDCConfig()
+	config.Issuer, config.Audience, config.JWKSURL = "https://sso.example.com", "images", jwks.URL
+	config.RolesClaim = "realm_access.roles"
+	config.RoleScopes = map[string][]string{"admin": {scopeImagesRead, scopeImagesWrite, scopeImagesDelete}}
+
+	now := time.Now()
+	claims := func(override jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":   "https://sso.example.com",
+			"aud":   []string{"images", "other"},
+			"sub":   "alice",
+			"exp":   now.Add(time.Minute).Unix(),
+			"iat":   now.Unix(),
+			"scope": "openid images:read",
+		}
+		for k, v := range override {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		token      func() string
+		wantScopes []string
+		wantErr    error
+	}{
+		{
+			name:       "RS256",
+			token:      func() string { return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)) },
+			wantScopes: []string{"openid", scopeImagesRead},
+		},
+		{
+			name:       "ES256",
+			token:      func() string { return signToken(t, jwt.SigningMethodES256, "ec", ecKey, claims(nil)) },
+			wantScopes: []string{"openid", scopeImagesRead},
+		},
+		{
+			name: "Roles",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{
+					"scope":        nil,
+					"realm_access": map[string]interface{}{"roles": []string{"admin", "unknown"}},
+				}))
+			},
+			wantScopes: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete},
+		},
+		{
+			name: "Clock skew",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()}))
+			},
+			wantScopes: []string{"openid", scopeImagesRead},
+		},
+		{
+			name: "Expired",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()}))
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "Missing expiration",
+			token: func() string {
+				c := claims(nil)
+				delete(c, "exp")
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, c)
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "Not yet valid",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()}))
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "Wrong issuer",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"iss": "https://evil.example.com"}))
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "Wrong audience",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"aud": "other"}))
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "Unknown key",
+			token:   func() string { return signToken(t, jwt.SigningMethodRS256, "rotated", rotated, claims(nil)) },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "Wrong signature",
+			token:   func() string { return signToken(t, jwt.SigningMethodRS256, "rsa", rotated, claims(nil)) },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "HMAC signed with the public key",
+			token: func() string {
+				der, _ := json.Marshal(rsaKey.PublicKey)
+				return signToken(t, jwt.SigningMethodHS256, "rsa", der, claims(nil))
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "Unsigned",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, claims(nil))
+			},
+			wantErr: ErrInvalidToken,
+		},
+	}
+
+	v := newTokenVerifier(config)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.verify(context.TODO(), tt.token())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "alice", got.Subject)
+			assert.Equal(t, tt.wantScopes, got.Scopes)
+		})
+	}
+}
+
+func Test_keySet_rotation(t *testing.T) {
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwks := newTestingJWKS(t)
+	jwks.publish("first", &first.PublicKey)
+
+	now := time.Now()
+	keys := newKeySet(jwks.URL, "", time.Hour)
+	keys.now = func() time.Time { return now }
+
+	k, err := keys.key(context.TODO(), "first")
+	assert.NoError(t, err)
+	assert.Equal(t, &first.PublicKey, k)
+
+	// Cached
+	_, _ = keys.key(context.TODO(), "first")
+	assert.Equal(t, 1, jwks.requests)
+
+	// Unknown keys do not hammer the identity provider
+	jwks.publish("second", &second.PublicKey)
+	_, err = keys.key(context.TODO(), "second")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.Equal(t, 1, jwks.requests)
+
+	// Rotated keys are picked up after jwksMinRefreshInterval
+	now = now.Add(2 * jwksMinRefreshInterval)
+	k, err = keys.key(context.TODO(), "second")
+	assert.NoError(t, err)
+	assert.Equal(t, &second.PublicKey, k)
+	assert.Equal(t, 2, jwks.requests)
+
+	// Stale keys are used while the identity provider is down
+	jwks.down = true
+	now = now.Add(2 * time.Hour)
+	_, err = keys.key(context.TODO(), "first")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, jwks.requests)
+}
+
+func Test_keySet_failure(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newTestingJWKS(t)
+	jwks.publish("ec", &key.PublicKey)
+	jwks.down = true
+
+	now := time.Now()
+	keys := newKeySet(jwks.URL, "", time.Hour)
+	keys.now = func() time.Time { return now }
+
+	// Concurrent callers share the same refresh
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.key(context.TODO(), "ec")
+			assert.ErrorIs(t, err, ErrInvalidJWKS)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, jwks.requests)
+
+	// Failures are retried after jwksMinRefreshInterval, not after the cache expiration
+	jwks.mu.Lock()
+	jwks.down = false
+	jwks.mu.Unlock()
+	_, err := keys.key(context.TODO(), "ec")
+	assert.ErrorIs(t, err, ErrInvalidJWKS)
+
+	now = now.Add(2 * jwksMinRefreshInterval)
+	k, err := keys.key(context.TODO(), "ec")
+	assert.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, k)
+	assert.Equal(t, 2, jwks.requests)
+}
+
+func Test_keySet_canceled(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newTestingJWKS(t)
+	jwks.publish("ec", &key.PublicKey)
+
+	keys := newKeySet(jwks.URL, "", time.Hour)
+
+	// The identity provider answers once the caller gave up
+	jwks.mu.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := keys.key(ctx, "ec")
+	assert.ErrorIs(t, err, context.Canceled)
+	jwks.mu.Unlock()
+
+	// The refresh went on, a canceled caller is not a failed refresh
+	k, err := keys.key(context.TODO(), "ec")
+	assert.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, k)
+
+	jwks.mu.Lock()
+	defer jwks.mu.Unlock()
+	assert.Equal(t, 1, jwks.requests)
+}
+
+func Test_server_Authenticate_jwt(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := newTestingJWKS(t)
+	jwks.publish("ec", &key.PublicKey)
+
+	config := defaultOIDCConfig()
+	config.Issuer, config.Audience, config.JWKSURL = "https://sso.example.com", "images", jwks.URL
+
+	token := func(scope string) string {
+		return signToken(t, jwt.SigningMethodES256, "ec", key, jwt.MapClaims{
+			"iss":   "https://sso.example.com",
+			"aud":   "images",
+			"sub":   "alice",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"scope": scope,
+		})
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		down     bool
+		wantCode int
+	}{
+		{
+			name:     "Valid",
+			token:    token("images:read"),
+			wantCode: 200,
+		},
+		{
+			name:     "Insufficient scope",
+			token:    token("openid"),
+			wantCode: 403,
+		},
+		{
+			name:     "Invalid",
+			token:    token("images:read")[:20] + ".foo.bar",
+			wantCode: 401,
+		},
+		{
+			name:     "Identity provider down",
+			token:    token("images:read"),
+			down:     true,
+			wantCode: 503,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwks.down = tt.down
+
+			s := &server{
+				router: gin.New(),
+				Image:  new(testingImageService),
+				auth:   &authenticator{apiKeys: make(map[string]*APIKey), tokens: newTokenVerifier(config)},
+				links:  testingLinks,
+			}
+			s.routes()
+
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/images", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			s.ServeHTTP(rw, req)
+
+			assert.Equal(t, tt.wantCode, rw.Code)
+		})
+	}
+}
+
+func Test_oidcFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{
+			name: "Disabled",
+			env:  map[string]string{},
+		},
+		{
+			name: "Valid",
+			env: map[string]string{
+				"OIDC_JWKS_URL":    "https://sso.example.com/jwks.json",
+				"OIDC_ISSUER":      "https://sso.example.com",
+				"OIDC_AUDIENCE":    "images",
+				"OIDC_ROLE_SCOPES": "admin=images:read,images:write;viewer=images:read",
+			},
+		},
+		{
+			name:    "Missing audience",
+			env:     map[string]string{"OIDC_JWKS_URL": "https://sso.example.com/jwks.json", "OIDC_ISSUER": "https://sso.example.com"},
+			wantErr: true,
+		},
+		{
+			name: "Symmetric algorithm",
+			env: map[string]string{
+				"OIDC_JWKS_FILE":  "jwks.json",
+				"OIDC_ISSUER":     "https://sso.example.com",
+				"OIDC_AUDIENCE":   "images",
+				"OIDC_ALGORITHMS": "RS256,HS256",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid role mapping",
+			env:     map[string]string{"OIDC_ROLE_SCOPES": "images:read"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				_ = os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			got, err := oidcFromEnv(defaultOIDCConfig())
+			if err == nil {
+				err = got.validate()
+			}
+			assert.Equal(t, tt.wantErr, err != nil, err)
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead is the extra room given to the request body on top of UploadLimits.MaxBytes
+// to account for the multipart envelope and the other form fields
+const multipartOverhead = 1 << 20 // 1MB
+
+var (
+	// ErrImageTooLarge file exceeds UploadLimits.MaxBytes
+	ErrImageTooLarge = errors.New("image is too large")
+
+	// ErrImageDimensions file dimensions do not match UploadLimits
+	ErrImageDimensions = errors.New("invalid image dimensions")
+
+	// ErrCannotReadDimensions file is not a decodable image
+	ErrCannotReadDimensions = errors.New("cannot read image dimensions")
+)
+
+// UploadLimits describes constraints applied on uploaded images.
+// A zero value disables the corresponding check.
+type UploadLimits struct {
+	MaxBytes       int64   `json:"max_bytes" yaml:"max_bytes"`               // maximum file size in bytes
+	MaxPixels      int64   `json:"max_pixels" yaml:"max_pixels"`             // maximum width * height, protects against decompression bombs
+	MinWidth       int     `json:"min_width" yaml:"min_width"`               // minimum width in pixels
+	MaxWidth       int     `json:"max_width" yaml:"max_width"`               // maximum width in pixels
+	MinHeight      int     `json:"min_height" yaml:"min_height"`             // minimum height in pixels
+	MaxHeight      int     `json:"max_height" yaml:"max_height"`             // maximum height in pixels
+	MinAspectRatio float64 `json:"min_aspect_ratio" yaml:"min_aspect_ratio"` // minimum width / height
+	MaxAspectRatio float64 `json:"max_aspect_ratio" yaml:"max_aspect_ratio"` // maximum width / height
+}
+
+// defaultUploadLimits returns limits used when nothing is configured
+func defaultUploadLimits() UploadLimits {
+	return UploadLimits{
+		MaxBytes:  20 << 20,   // 20MB
+		MaxPixels: 50_000_000, // 50 megapixels
+	}
+}
+
+// uploadLimitsFromEnv reads UploadLimits from environment variables, starting from l
+func uploadLimitsFromEnv(l UploadLimits) (UploadLimits, error) {
+	ints := map[string]*int{
+		"UPLOAD_MIN_WIDTH":  &l.MinWidth,
+		"UPLOAD_MAX_WIDTH":  &l.MaxWidth,
+		"UPLOAD_MIN_HEIGHT": &l.MinHeight,
+		"UPLOAD_MAX_HEIGHT": &l.MaxHeight,
+	}
+	for k, p := range ints {
+		if v, ok := os.LookupEnv(k); ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return l, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = i
+		}
+	}
+
+	int64s := map[string]*int64{
+		"UPLOAD_MAX_BYTES":  &l.MaxBytes,
+		"UPLOAD_MAX_PIXELS": &l.MaxPixels,
+	}
+	for k, p := range int64s {
+		if v, ok := os.LookupEnv(k); ok {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return l, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = i
+		}
+	}
+
+	floats := map[string]*float64{
+		"UPLOAD_MIN_ASPECT_RATIO": &l.MinAspectRatio,
+		"UPLOAD_MAX_ASPECT_RATIO": &l.MaxAspectRatio,
+	}
+	for k, p := range floats {
+		if v, ok := os.LookupEnv(k); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return l, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = f
+		}
+	}
+
+	return l, nil
+}
+
+// errTooLarge describes a MaxBytes violation
+func (l UploadLimits) errTooLarge() error {
+	return fmt.Errorf("%w: maximum allowed size is %d bytes", ErrImageTooLarge, l.MaxBytes)
+}
+
+// checkSize ensure given size does not exceed MaxBytes
+func (l UploadLimits) checkSize(size int64) error {
+	if l.MaxBytes > 0 && size > l.MaxBytes {
+		return l.errTooLarge()
+	}
+
+	return nil
+}
+
+// checkDimensions ensure given image configuration matches configured limits
+func (l UploadLimits) checkDimensions(cfg image.Config) error {
+	w, h := cfg.Width, cfg.Height
+	if l.MaxPixels > 0 && int64(w)*int64(h) > l.MaxPixels {
+		return fmt.Errorf("%w: image has %d pixels, maximum allowed is %d", ErrImageTooLarge, int64(w)*int64(h), l.MaxPixels)
+	}
+
+	switch {
+	case l.MinWidth > 0 && w < l.MinWidth:
+		return fmt.Errorf("%w: width %d is below minimum of %d", ErrImageDimensions, w, l.MinWidth)
+	case l.MaxWidth > 0 && w > l.MaxWidth:
+		return fmt.Errorf("%w: width %d is above maximum of %d", ErrImageDimensions, w, l.MaxWidth)
+	case l.MinHeight > 0 && h < l.MinHeight:
+		return fmt.Errorf("%w: height %d is below minimum of %d", ErrImageDimensions, h, l.MinHeight)
+	case l.MaxHeight > 0 && h > l.MaxHeight:
+		return fmt.Errorf("%w: height %d is above maximum of %d", ErrImageDimensions, h, l.MaxHeight)
+	}
+
+	if h == 0 || (l.MinAspectRatio <= 0 && l.MaxAspectRatio <= 0) {
+		return nil
+	}
+
+	ratio := float64(w) / float64(h)
+	switch {
+	case l.MinAspectRatio > 0 && ratio < l.MinAspectRatio:
+		return fmt.Errorf("%w: aspect ratio %.2f is below minimum of %.2f", ErrImageDimensions, ratio, l.MinAspectRatio)
+	case l.MaxAspectRatio > 0 && ratio > l.MaxAspectRatio:
+		return fmt.Errorf("%w: aspect ratio %.2f is above maximum of %.2f", ErrImageDimensions, ratio, l.MaxAspectRatio)
+	}
+
+	return nil
+}
+
+// validate checks the given Image against configured limits.
+// Only the image header is decoded, pixels are never loaded in memory.
+// Decoders are registered in formats.go
+func (l UploadLimits) validate(i *Image) error {
+	if err := l.checkSize(i.Size); err != nil {
+		return err
+	}
+
+	// Vector images do not have intrinsic pixel dimensions
+	if i.ContentType == "image/svg+xml" {
+		return nil
+	}
+
+	r, ok := i.Content.(io.ReadSeeker)
+	if !ok {
+		return nil
+	}
+
+	cfg, _, err := image.DecodeConfig(r)
+	if _, seekErr := r.Seek(0, io.SeekStart); seekErr != nil {
+		return seekErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCannotReadDimensions, err)
+	}
+
+	return l.checkDimensions(cfg)
+}
+
+// limitedBody wraps a request body and fails once more than limit bytes have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+// Read implements io.Reader
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		b.exceeded = true
+		return 0, ErrImageTooLarge
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining+1] // read one more byte to detect overflow
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.exceeded = true
+		return n, ErrImageTooLarge
+	}
+
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// LimitUploadSize rejects request bodies larger than the configured UploadLimits.
+// The body is checked while it is streamed, so oversized uploads are never fully read.
+func (s *server) LimitUploadSize(c *gin.Context) {
+	limits := s.tenant(c).limits
+	if limits.MaxBytes <= 0 {
+		return
+	}
+
+	limit := limits.MaxBytes + multipartOverhead
+	if c.Request.ContentLength > limit {
+		_ = c.Error(newLimitError(limits.errTooLarge()))
+		c.Abort()
+		return
+	}
+
+	c.Request.Body = &limitedBody{ReadCloser: c.Request.Body, remaining: limit}
+}
+
+// requestBodyTooLarge reports whether the request body has been cut by LimitUploadSize
+func requestBodyTooLarge(c *gin.Context, err error) bool {
+	if errors.Is(err, ErrImageTooLarge) {
+		return true
+	}
+
+	b, ok := c.Request.Body.(*limitedBody)
+	return ok && b.exceeded
+}
+
+// newLimitError returns an HTTP 413 error for size violations, HTTP 422 otherwise
+func newLimitError(err error) *Error {
+	if errors.Is(err, ErrImageTooLarge) {
+		return newRequestEntityTooLargeError(err)
+	}
+
+	return newUnprocessableEntityError(err)
+}
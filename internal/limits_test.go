@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadLimits_checkDimensions(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   UploadLimits
+		cfg      image.Config
+		wantErr  error
+		wantCode int
+	}{
+		{
+			name:   "No limits",
+			limits: UploadLimits{},
+			cfg:    image.Config{Width: 100000, Height: 100000},
+		},
+		{
+			name:     "Too many pixels",
+			limits:   UploadLimits{MaxPixels: 100},
+			cfg:      image.Config{Width: 11, Height: 10},
+			wantErr:  ErrImageTooLarge,
+			wantCode: 413,
+		},
+		{
+			name:     "Too narrow",
+			limits:   UploadLimits{MinWidth: 100},
+			cfg:      image.Config{Width: 99, Height: 100},
+			wantErr:  ErrImageDimensions,
+			wantCode: 422,
+		},
+		{
+			name:     "Too high",
+			limits:   UploadLimits{MaxHeight: 100},
+			cfg:      image.Config{Width: 100, Height: 101},
+			wantErr:  ErrImageDimensions,
+			wantCode: 422,
+		},
+		{
+			name:     "Aspect ratio too wide",
+			limits:   UploadLimits{MaxAspectRatio: 2},
+			cfg:      image.Config{Width: 300, Height: 100},
+			wantErr:  ErrImageDimensions,
+			wantCode: 422,
+		},
+		{
+			name:   "Aspect ratio in range",
+			limits: UploadLimits{MinAspectRatio: 0.5, MaxAspectRatio: 2},
+			cfg:    image.Config{Width: 150, Height: 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.checkDimensions(tt.cfg)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantCode, newLimitError(err).Code)
+		})
+	}
+}
+
+func TestUploadLimits_validate(t *testing.T) {
+	file, header := makeFileHeader(t, "gopher.png") // 1300x1392
+
+	tests := []struct {
+		name    string
+		limits  UploadLimits
+		image   *Image
+		wantErr error
+	}{
+		{
+			name:   "Default limits",
+			limits: defaultUploadLimits(),
+			image:  &Image{Content: file, ContentType: "image/png", Size: header.Size},
+		},
+		{
+			name:    "File too large",
+			limits:  UploadLimits{MaxBytes: 1024},
+			image:   &Image{Content: file, ContentType: "image/png", Size: header.Size},
+			wantErr: ErrImageTooLarge,
+		},
+		{
+			name:    "Dimensions too small",
+			limits:  UploadLimits{MinWidth: 2000},
+			image:   &Image{Content: file, ContentType: "image/png", Size: header.Size},
+			wantErr: ErrImageDimensions,
+		},
+		{
+			name:    "Not an image",
+			limits:  defaultUploadLimits(),
+			image:   &Image{Content: strings.NewReader("foo"), ContentType: "image/png", Size: 3},
+			wantErr: ErrCannotReadDimensions,
+		},
+		{
+			name:   "SVG is not decoded",
+			limits: UploadLimits{MinWidth: 2000},
+			image:  &Image{Content: strings.NewReader("<svg/>"), ContentType: "image/svg+xml", Size: 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.validate(tt.image)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+
+			// content must be rewound for the upload
+			if r, ok := tt.image.Content.(io.Seeker); ok {
+				pos, _ := r.Seek(0, io.SeekCurrent)
+				assert.Equal(t, int64(0), pos)
+			}
+		})
+	}
+}
+
+func Test_server_LimitUploadSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          []byte
+		contentLength bool
+		wantCode      int
+	}{
+		{
+			name:          "Small body",
+			body:          []byte("foo"),
+			contentLength: true,
+			wantCode:      200,
+		},
+		{
+			name:          "Too large Content-Length",
+			body:          bytes.Repeat([]byte("a"), 10+multipartOverhead+1),
+			contentLength: true,
+			wantCode:      413,
+		},
+		{
+			name:          "Too large streamed body",
+			body:          bytes.Repeat([]byte("a"), 10+multipartOverhead+1),
+			contentLength: false,
+			wantCode:      413,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := new(server)
+			s.router = gin.New()
+			s.limits = UploadLimits{MaxBytes: 10}
+
+			s.router.POST("/foo", s.handleErrors, s.LimitUploadSize, func(c *gin.Context) {
+				if _, err := io.ReadAll(c.Request.Body); err != nil {
+					if requestBodyTooLarge(c, err) {
+						_ = c.Error(newLimitError(s.limits.errTooLarge()))
+						return
+					}
+				}
+
+				c.Status(200)
+			})
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/foo", bytes.NewReader(tt.body))
+			if !tt.contentLength {
+				req.ContentLength = -1
+			}
+			s.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantCode, rr.Code)
+		})
+	}
+}
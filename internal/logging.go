@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats, see LogConfig
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+const (
+	// RequestIDHeader carries the ID of a request, assigned by us or by the caller
+	RequestIDHeader = "X-Request-ID"
+
+	// RequestIDContextKey holds the ID of the request, see Log
+	RequestIDContextKey = "request_id"
+
+	// maxRequestIDLength bounds the IDs accepted from callers
+	maxRequestIDLength = 128
+)
+
+// ErrInvalidLogConfig logging configuration is invalid
+var ErrInvalidLogConfig = errors.New("invalid log configuration")
+
+// requestLoggerKey holds the logger of a request in its context.Context, see logger
+type requestLoggerKey struct{}
+
+// LogConfig describes the logs
+type LogConfig struct {
+	Level  string `yaml:"level"`  // e.g. "debug", the current level when empty: info, or trace with the dev build tag
+	Format string `yaml:"format"` // "json" or "text"
+}
+
+// defaultLogConfig returns the options used when nothing is configured
+func defaultLogConfig() LogConfig {
+	return LogConfig{Format: logFormatJSON}
+}
+
+// logFromEnv reads LogConfig from $LOG_LEVEL and $LOG_FORMAT, starting from l
+func logFromEnv(l LogConfig) LogConfig {
+	if v, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		l.Level = v
+	}
+
+	if v, ok := os.LookupEnv("LOG_FORMAT"); ok {
+		l.Format = v
+	}
+
+	return l
+}
+
+func (l LogConfig) validate() error {
+	if l.Level != "" {
+		if _, err := log.ParseLevel(l.Level); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidLogConfig, err)
+		}
+	}
+
+	if l.Format != logFormatJSON && l.Format != logFormatText {
+		return fmt.Errorf("%w: unknown format %q, expected %q or %q", ErrInvalidLogConfig, l.Format, logFormatJSON, logFormatText)
+	}
+
+	return nil
+}
+
+// setupLogging applies the LogConfig to the global logger
+func setupLogging(config LogConfig) {
+	if level, err := log.ParseLevel(config.Level); err == nil {
+		log.SetLevel(level)
+	}
+
+	if config.Format == logFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+}
+
+// logger returns the logger of the request running in ctx, its entries carry the request ID, see Log
+func logger(ctx context.Context) *log.Entry {
+	if entry, ok := ctx.Value(requestLoggerKey{}).(*log.Entry); ok {
+		return entry
+	}
+
+	return log.NewEntry(log.StandardLogger())
+}
+
+// requestID returns the ID sent by the caller, or a new one when missing or unreasonable
+func requestID(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		return uuid.New().String()
+	}
+
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e { // printable ASCII, without spaces
+			return uuid.New().String()
+		}
+	}
+
+	return id
+}
+
+// Log logs every request once it is served. The request ID is propagated from the X-Request-ID header
+// or assigned, returned in the response, and carried by the logger of the request context, see logger.
+func (s *server) Log(c *gin.Context) {
+	start := time.Now()
+
+	id := requestID(c.Request)
+	c.Set(RequestIDContextKey, id)
+	c.Header(RequestIDHeader, id)
+
+	entry := log.WithField("request_id", id)
+	if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+		entry = entry.WithField("trace_id", span.TraceID().String())
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestLoggerKey{}, entry))
+
+	c.Next()
+
+	entry = entry.WithFields(log.Fields{
+		"method":      c.Request.Method,
+		"path":        c.Request.URL.Path,
+		"route":       c.FullPath(),
+		"status":      c.Writer.Status(),
+		"bytes":       c.Writer.Size(),
+		"duration_ms": time.Since(start).Milliseconds(),
+		"client_ip":   s.proxies.clientIP(c.Request),
+		"user_agent":  c.Request.UserAgent(),
+	})
+	if len(c.Errors) > 0 {
+		entry = entry.WithField("errors", c.Errors.Errors())
+	}
+
+	switch status := c.Writer.Status(); {
+	case status >= http.StatusInternalServerError:
+		entry.Error("request served")
+	case status >= http.StatusBadRequest:
+		entry.Warn("request served")
+	default:
+		entry.Info("request served")
+	}
+}
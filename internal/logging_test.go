@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_logFromEnv(t *testing.T) {
+	os.Setenv("LOG_LEVEL", "debug")
+	defer os.Unsetenv("LOG_LEVEL")
+
+	got := logFromEnv(defaultLogConfig())
+	assert.NoError(t, got.validate())
+	assert.Equal(t, LogConfig{Level: "debug", Format: logFormatJSON}, got)
+
+	os.Setenv("LOG_LEVEL", "verbose")
+	assert.ErrorIs(t, logFromEnv(defaultLogConfig()).validate(), ErrInvalidLogConfig)
+}
+
+func Test_requestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "Propagated", header: "abc-123", want: "abc-123"},
+		{name: "Missing", header: ""},
+		{name: "Too long", header: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "Not printable", header: "abc\x01"},
+		{name: "With spaces", header: "a b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(RequestIDHeader, tt.header)
+
+			got := requestID(req)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, got)
+				return
+			}
+			assert.Len(t, got, 36, "a new UUID is assigned")
+		})
+	}
+}
+
+func Test_server_Log(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer log.SetOutput(io.Discard)
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	s := &server{router: gin.New()}
+	s.router.Use(s.Log)
+	s.router.GET("/images", func(c *gin.Context) {
+		logger(c.Request.Context()).Errorln("storage failure")
+		c.Status(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest("GET", "/images", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	assert.Equal(t, "abc-123", rr.Header().Get(RequestIDHeader))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+
+	var storage, request map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &storage))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &request))
+
+	assert.Equal(t, "storage failure", storage["msg"])
+	assert.Equal(t, "abc-123", storage["request_id"], "logs of the request are correlated")
+
+	assert.Equal(t, "abc-123", request["request_id"])
+	assert.Equal(t, "error", request["level"])
+	assert.Equal(t, "/images", request["route"])
+	assert.Equal(t, float64(http.StatusBadGateway), request["status"])
+	assert.Equal(t, "192.0.2.1", request["client_ip"], "X-Forwarded-For is only trusted from proxies")
+
+	// IDs are assigned to other requests
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest("GET", "/images", nil))
+	assert.Len(t, rr.Header().Get(RequestIDHeader), 36)
+}
@@ -3,47 +3,148 @@ package internal
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
-	"time"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 var buildNumber = "dev"
 
-// Run starts our server
-func Run() {
-	var port = "8080"
-	if v, ok := os.LookupEnv("PORT"); ok {
-		port = v
+// Run starts our server, configured by args, see LoadConfig. The server listens at once and connects to
+// the storage in the background, an error is returned when it cannot within the startup timeout.
+func Run(args []string) error {
+	config, err := LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	setupLogging(config.Log)
+
+	shutdownTracing, err := setupTracing(config.Tracing)
+	if err != nil {
+		return err
+	}
+
+	s, err := newServer(config)
+	if err != nil {
+		return err
 	}
 
 	srv := &http.Server{
-		Addr:         ":" + port,
-		Handler:      newServer(),
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
+		Addr:         ":" + strconv.Itoa(config.Server.Port),
+		Handler:      s,
+		WriteTimeout: config.Server.WriteTimeout,
+		ReadTimeout:  config.Server.ReadTimeout,
+		IdleTimeout:  config.Server.IdleTimeout,
 	}
 
+	errs := make(chan error, 2)
 	go func() {
 		log.Printf("listening on %s", srv.Addr)
 		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Errorln(err)
+			errs <- err
+		}
+	}()
+
+	// A zero startup timeout retries until shutdown
+	connectCtx, stopConnecting := context.WithCancel(context.Background())
+	if config.Server.StartupTimeout > 0 {
+		connectCtx, stopConnecting = context.WithTimeout(context.Background(), config.Server.StartupTimeout)
+	}
+	defer stopConnecting()
+
+	go func() {
+		if err := s.connect(connectCtx); err != nil {
+			errs <- err
 		}
 	}()
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	<-c // wait for this signal
+	select {
+	case <-c: // wait for this signal
+	case err = <-errs:
+	}
+	stopConnecting()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
 	defer cancel()
 
 	defer log.Println("Bye!")
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Errorln(err)
+	if serr := srv.Shutdown(ctx); serr != nil {
+		log.Errorln(serr)
+	}
+
+	// Export the remaining spans
+	if serr := shutdownTracing(ctx); serr != nil {
+		log.Errorln(serr)
+	}
+
+	return err
+}
+
+// Migrate converts images stored before content-addressed storage, see imageService.Migrate.
+// The images of every configured tenant are converted.
+func Migrate(args []string) error {
+	config, err := LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	setupLogging(config.Log)
+
+	tenants := config.Tenancy.Tenants
+	if !config.Tenancy.enabled() {
+		tenants = []TenantConfig{{Bucket: config.Storage.Bucket}}
+	}
+
+	clients := newTenantImages(config.Storage.Config)
+	for _, t := range tenants {
+		client, err := clients.client(t.Bucket)
+		if err != nil {
+			return err
+		}
+
+		images := &imageService{
+			Minio:  client,
+			Prefix: t.Prefix,
+		}
+
+		count, err := images.Migrate(context.Background())
+		if err != nil {
+			return err
+		}
+
+		log.Printf("migrated %d images of bucket %s, prefix %q", count, t.Bucket, t.Prefix)
+	}
+
+	return nil
+}
+
+// PrintConfig prints the configuration loaded from args as YAML, secrets are redacted.
+// Invalid settings are reported after the configuration.
+func PrintConfig(args []string) error {
+	config, err := LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+
+	out, merr := yaml.Marshal(config.redacted())
+	if merr != nil {
+		return merr
+	}
+	fmt.Print(string(out))
+
+	return err
 }
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of latency histograms
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// metrics measures the server, exposed by handleMetrics
+type metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+	uploadedBytes   prometheus.Counter
+	downloadedBytes prometheus.Counter
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+
+	// handler serves the metrics and the Go runtime statistics in the Prometheus formats
+	handler http.Handler
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "images_server_http_requests_total",
+			Help: "HTTP requests by route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "images_server_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route and status.",
+			Buckets: latencyBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "images_server_http_requests_in_flight",
+			Help: "HTTP requests being served.",
+		}),
+		uploadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "images_server_uploaded_bytes_total",
+			Help: "Bytes received by image uploads.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "images_server_downloaded_bytes_total",
+			Help: "Bytes sent by image downloads.",
+		}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "images_server_storage_operation_duration_seconds",
+			Help:    "Latency of storage operations by ImageService method.",
+			Buckets: latencyBuckets,
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "images_server_storage_operation_errors_total",
+			Help: "Failed storage operations by ImageService method, missing images excluded.",
+		}, []string{"operation"}),
+	}
+
+	// Every server has its own registry, so that servers of the tests do not share their metrics
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		m.requests, m.requestDuration, m.inFlight,
+		m.uploadedBytes, m.downloadedBytes,
+		m.storageDuration, m.storageErrors,
+		collectors.NewGoCollector(),
+	)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+
+	return m
+}
+
+// images records the latency, errors and spans of every operation of images
+func (m *metrics) images(images ImageService) ImageService {
+	return &instrumentedImages{ImageService: images, metrics: m}
+}
+
+// Metrics measures every request, see handleMetrics. Routes are labelled by their pattern,
+// requests matching no route by "unmatched", bounding the number of series.
+func (s *server) Metrics(c *gin.Context) {
+	start := time.Now()
+	s.metrics.inFlight.Inc()
+	defer s.metrics.inFlight.Dec()
+
+	route := c.FullPath()
+	category := rateLimitCategory(c.Request.Method, route)
+
+	var body *countingReader
+	if category == rateLimitUpload && c.Request.Body != nil {
+		body = &countingReader{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+	}
+
+	c.Next()
+
+	if route == "" {
+		route = "unmatched"
+	}
+
+	status := strconv.Itoa(c.Writer.Status())
+	s.metrics.requests.WithLabelValues(c.Request.Method, route, status).Inc()
+	s.metrics.requestDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+
+	switch {
+	case body != nil:
+		s.metrics.uploadedBytes.Add(float64(body.n))
+	case category == rateLimitDownload && c.Writer.Size() > 0:
+		s.metrics.downloadedBytes.Add(float64(c.Writer.Size()))
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// handleMetrics exposes the metrics in the Prometheus formats, negotiated with the Accept header
+func (s *server) handleMetrics(c *gin.Context) {
+	s.metrics.handler.ServeHTTP(c.Writer, c.Request)
+}
+
+// instrumentedImages records the latency, errors and spans of every operation of an ImageService
+type instrumentedImages struct {
+	ImageService
+	metrics *metrics
+}
+
+func (i *instrumentedImages) Create(ctx context.Context, image *Image) (_ *Image, err error) {
+	ctx, span := tracer().Start(ctx, "ImageService.Create")
+	defer i.observe("Create", time.Now(), span, &err)
+	return i.ImageService.Create(ctx, image)
+}
+
+func (i *instrumentedImages) Get(ctx context.Context, id uuid.UUID) (_ *Image, err error) {
+	ctx, span := tracer().Start(ctx, "ImageService.Get")
+	defer i.observe("Get", time.Now(), span, &err)
+	return i.ImageService.Get(ctx, id)
+}
+
+func (i *instrumentedImages) List(ctx context.Context) (_ []*Image, err error) {
+	ctx, span := tracer().Start(ctx, "ImageService.List")
+	defer i.observe("List", time.Now(), span, &err)
+	return i.ImageService.List(ctx)
+}
+
+func (i *instrumentedImages) Update(ctx context.Context, image *Image) (_ *Image, err error) {
+	ctx, span := tracer().Start(ctx, "ImageService.Update")
+	defer i.observe("Update", time.Now(), span, &err)
+	return i.ImageService.Update(ctx, image)
+}
+
+func (i *instrumentedImages) Delete(ctx context.Context, ids ...uuid.UUID) (err error) {
+	ctx, span := tracer().Start(ctx, "ImageService.Delete")
+	defer i.observe("Delete", time.Now(), span, &err)
+	return i.ImageService.Delete(ctx, ids...)
+}
+
+func (i *instrumentedImages) Similar(ctx context.Context, image *Image, maxDistance int) (_ []*similarImage, err error) {
+	ctx, span := tracer().Start(ctx, "ImageService.Similar")
+	defer i.observe("Similar", time.Now(), span, &err)
+	return i.ImageService.Similar(ctx, image, maxDistance)
+}
+
+// observe records an operation which started at start and returned *err, and ends its span
+func (i *instrumentedImages) observe(operation string, start time.Time, span trace.Span, err *error) {
+	i.metrics.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil && !errors.Is(*err, ErrImageNotFound) {
+		i.metrics.storageErrors.WithLabelValues(operation).Inc()
+		endSpan(span, *err)
+		return
+	}
+
+	span.End()
+}
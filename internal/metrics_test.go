@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatherMetrics returns the metrics in the Prometheus text format
+func gatherMetrics(m *metrics) string {
+	rr := httptest.NewRecorder()
+	m.handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	return rr.Body.String()
+}
+
+func Test_server_Metrics(t *testing.T) {
+	s := &server{router: gin.New(), metrics: newMetrics()}
+	s.router.Use(s.Metrics)
+	s.router.POST("/images", func(c *gin.Context) {
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		c.Status(201)
+	})
+	s.router.GET("/images/:image/download", func(c *gin.Context) { c.String(200, "content") })
+	s.router.GET("/metrics", s.handleMetrics)
+
+	serveRequest(s, "POST", "/images", "12345")
+	serveRequest(s, "GET", "/images/foo/download", "")
+	serveRequest(s, "GET", "/images/bar/download", "")
+	serveRequest(s, "GET", "/unknown", "")
+
+	rr := serveRequest(s, "GET", "/metrics", "")
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	body := rr.Body.String()
+	assert.Contains(t, body, `images_server_http_requests_total{method="GET",route="/images/:image/download",status="200"} 2`)
+	assert.Contains(t, body, `images_server_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, `images_server_http_request_duration_seconds_count{method="POST",route="/images",status="201"} 1`)
+	assert.Contains(t, body, "images_server_http_requests_in_flight 1\n", "the scrape itself is in flight")
+	assert.Contains(t, body, "images_server_uploaded_bytes_total 5\n")
+	assert.Contains(t, body, "images_server_downloaded_bytes_total 14\n")
+	assert.Contains(t, body, "# TYPE go_goroutines gauge")
+}
+
+func Test_instrumentedImages(t *testing.T) {
+	m := newMetrics()
+	images := m.images(new(testingImageService))
+
+	_, _ = images.Get(context.Background(), uuid.New())
+	_, _ = images.List(context.WithValue(context.Background(), "error", true))
+	_ = images.Delete(context.Background(), uuid.New())
+
+	out := gatherMetrics(m)
+	assert.Contains(t, out, `images_server_storage_operation_errors_total{operation="Delete"} 1`)
+	assert.Contains(t, out, `images_server_storage_operation_errors_total{operation="List"} 1`)
+	assert.NotContains(t, out, `images_server_storage_operation_errors_total{operation="Get"}`, "missing images are not storage errors")
+	assert.Contains(t, out, `images_server_storage_operation_duration_seconds_count{operation="Get"} 1`)
+}
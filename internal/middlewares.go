@@ -5,27 +5,27 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
 )
 
 const UUIDContextKey = "uuid"
 
 func (s *server) Recover(c *gin.Context, err interface{}) {
-	log.Errorln(err)
+	logger(c.Request.Context()).Errorln(err)
 
 	e := new(Error)
 	e.Code = http.StatusInternalServerError
-	e.Message = "Unexpected error occurred. Check logs for more details"
+	e.ID = errorIDInternal
+	e.Message = unexpectedErrorMessage
 
 	if err, ok := err.(string); ok {
 		e.Message = err
 	}
 
-	c.AbortWithStatusJSON(e.Code, e)
+	s.abortWithError(c, e)
 }
 
 // BindUUID tries to read uuid.UUID from route param and set the value into context
-// If param is not a valid uuid.UUID, an HTTP 404 response will be send
+// If param is not a valid uuid.UUID, an HTTP 404 response will be send, as for missing images
 func (s *server) BindUUID(c *gin.Context) {
 	type r struct {
 		ID string `uri:"image" binding:"uuid4_rfc4122,required"`
@@ -33,15 +33,29 @@ func (s *server) BindUUID(c *gin.Context) {
 
 	var id r
 	if err := c.ShouldBindUri(&id); err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		s.abortWithError(c, newNotFoundError(ErrImageNotFound))
 		return
 	}
 
 	c.Set(UUIDContextKey, uuid.MustParse(id.ID))
 }
 
+// RequireStorage rejects requests with an HTTP 503 response until the storage is connected, see connect
+func (s *server) RequireStorage(c *gin.Context) {
+	if s.ready() {
+		return
+	}
+
+	c.Header("Retry-After", "1")
+	_ = c.Error(newServiceUnavailableError(ErrStorageUnavailable))
+	c.Abort()
+}
+
 func (s *server) middlewares() {
-	s.router.Use(gin.Logger())
+	s.router.Use(s.Trace)
+	s.router.Use(s.Log)
+	s.router.Use(s.Metrics)
 	s.router.Use(gin.CustomRecovery(s.Recover))
-	// TODO: use custom logger ?
+	s.router.Use(s.CORS)
+	s.router.Use(s.RateLimit)
 }
@@ -81,13 +81,13 @@ func Test_server_Recover(t *testing.T) {
 		{
 			name:     "Custom message",
 			req:      httptest.NewRequest("GET", "/foo", nil),
-			want:     `{"code":500,"message":"oops"}`,
+			want:     `{"code":500,"error":"internal_error","message":"oops"}`,
 			wantCode: 500,
 		},
 		{
 			name:     "Default message",
 			req:      httptest.NewRequest("GET", "/bar", nil),
-			want:     `{"code":500,"message":"Unexpected error occurred. Check logs for more details"}`,
+			want:     `{"code":500,"error":"internal_error","message":"Unexpected error occurred. Check logs for more details"}`,
 			wantCode: 500,
 		},
 	}
@@ -102,3 +102,19 @@ func Test_server_Recover(t *testing.T) {
 		})
 	}
 }
+
+func Test_server_RequireStorage(t *testing.T) {
+	s := &server{router: gin.New(), connecting: 1}
+	s.router.GET("/images", s.handleErrors, s.RequireStorage, func(c *gin.Context) { c.Status(200) })
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest("GET", "/images", nil))
+	assert.Equal(t, 503, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"code":503,"error":"storage_unavailable","message":"storage is not available yet"}`, rr.Body.String())
+
+	s.connecting = 0
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest("GET", "/images", nil))
+	assert.Equal(t, 200, rr.Code)
+}
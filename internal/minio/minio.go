@@ -1,12 +1,44 @@
 package minio
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/minio/minio-go"
-	log "github.com/sirupsen/logrus"
 )
 
+// ErrInvalidConfig MinIO settings are incomplete
+var ErrInvalidConfig = errors.New("invalid MinIO configuration")
+
+// Config describes how to reach MinIO
+type Config struct {
+	Endpoint   string `yaml:"endpoint"`
+	User       string `yaml:"user"`
+	Password   string `yaml:"password"`
+	DisableSSL bool   `yaml:"disable_ssl"`
+}
+
+// Validate ensures required settings are set
+func (c Config) Validate() error {
+	var missing []string
+	if c.Endpoint == "" {
+		missing = append(missing, "endpoint")
+	}
+	if c.User == "" {
+		missing = append(missing, "user")
+	}
+	if c.Password == "" {
+		missing = append(missing, "password")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s must be specified", ErrInvalidConfig, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
 type Client struct {
 	*minio.Client
 
@@ -14,22 +46,15 @@ type Client struct {
 	BucketName string
 }
 
-func validateMinioSettings() {
-	var variables = []string{"MINIO_ENDPOINT", "MINIO_USER", "MINIO_PASSWORD"}
-	for _, k := range variables {
-		if v := os.Getenv(k); v == "" {
-			log.Fatalf("you must specify $%s", k)
-		}
+// New creates a new minio.Client, and the bucket when it does not exist
+func New(config Config, bucketName string) (*Client, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
-}
 
-// New creates a new minio.Client
-func New(bucketName string) *Client {
-	validateMinioSettings()
-	useSSL := !(os.Getenv("MINIO_DISABLE_SSL") == "true")
-	minioClient, err := minio.New(os.Getenv("MINIO_ENDPOINT"), os.Getenv("MINIO_USER"), os.Getenv("MINIO_PASSWORD"), useSSL)
+	minioClient, err := minio.New(config.Endpoint, config.User, config.Password, !config.DisableSSL)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
 	c := &Client{
@@ -38,22 +63,22 @@ func New(bucketName string) *Client {
 	}
 
 	// ensure given bucket exists
-	c.makeBucket()
-	return c
+	if err := c.makeBucket(); err != nil {
+		return nil, fmt.Errorf("cannot create bucket %s: %w", bucketName, err)
+	}
+
+	return c, nil
 }
 
-func (c *Client) makeBucket() {
+func (c *Client) makeBucket() error {
 	ok, err := c.BucketExists(c.BucketName)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	switch ok {
-	case true: // bucket exist
-		return
-	case false: // bucket does not exist
-		if err := c.MakeBucket(c.BucketName, ""); err != nil {
-			log.Fatalln(err)
-		}
+	if ok {
+		return nil
 	}
+
+	return c.MakeBucket(c.BucketName, "")
 }
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	_ "embed" // openapi.json and docs.html
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec describes the routes of apiV1 and the unversioned ones, see openAPI.
+// Requests are validated against it, see ValidateRequest. The tests keep the document in sync with the routes
+// and the bindings.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage renders the OpenAPI document in browsers, see handleDocs
+//
+//go:embed docs.html
+var docsPage []byte
+
+// openAPIMethods are the operations of an OpenAPI path item
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+var openAPIDocument struct {
+	once sync.Once
+	body []byte
+	err  error
+}
+
+// openAPI returns the OpenAPI document of the server: openapi.json, completed with the deprecated
+// routes without version, which mirror the routes of apiV1, see routes
+func openAPI() ([]byte, error) {
+	openAPIDocument.once.Do(func() {
+		openAPIDocument.body, openAPIDocument.err = withDeprecatedRoutes(openAPISpec, apiV1)
+	})
+
+	return openAPIDocument.body, openAPIDocument.err
+}
+
+// withDeprecatedRoutes adds to the OpenAPI document the paths of the version v without its prefix, deprecated
+func withDeprecatedRoutes(spec []byte, v *apiVersion) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+
+	paths, ok := doc["paths"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid OpenAPI document: missing paths")
+	}
+
+	aliases := make(map[string]interface{})
+	for path, item := range paths {
+		if !strings.HasPrefix(path, v.prefix+"/") {
+			continue
+		}
+
+		alias := make(map[string]interface{})
+		for k, field := range item.(map[string]interface{}) {
+			alias[k] = field
+			op, ok := field.(map[string]interface{})
+			if !ok || !isOpenAPIMethod(k) {
+				continue
+			}
+
+			deprecated := make(map[string]interface{}, len(op)+1)
+			for name, value := range op {
+				deprecated[name] = value
+			}
+			deprecated["deprecated"] = true
+			deprecated["description"] = fmt.Sprintf("Deprecated alias of `%s %s`.", strings.ToUpper(k), path)
+			if id, ok := op["operationId"].(string); ok {
+				deprecated["operationId"] = id + "Unversioned"
+			}
+			alias[k] = deprecated
+		}
+
+		aliases[strings.TrimPrefix(path, v.prefix)] = alias
+	}
+
+	for path, alias := range aliases {
+		paths[path] = alias
+	}
+
+	return json.Marshal(doc)
+}
+
+func isOpenAPIMethod(name string) bool {
+	for _, m := range openAPIMethods {
+		if m == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleOpenAPI serves the OpenAPI document of the server
+func (s *server) handleOpenAPI(c *gin.Context) {
+	body, err := openAPI()
+	if err != nil {
+		s.abortWithError(c, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// handleDocs serves a page rendering the OpenAPI document, when enabled by APIConfig.Docs
+func (s *server) handleDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", docsPage)
+}
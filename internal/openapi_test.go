@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loadOpenAPI returns the OpenAPI document served by the server
+func loadOpenAPI(t *testing.T) map[string]interface{} {
+	body, err := openAPI()
+	require.NoError(t, err)
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &doc))
+	return doc
+}
+
+// resolveSchema follows $ref in the OpenAPI document
+func resolveSchema(doc map[string]interface{}, schema map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+
+		var node interface{} = doc
+		for _, k := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = node.(map[string]interface{})[k]
+		}
+		schema = node.(map[string]interface{})
+	}
+}
+
+// schemaProperties returns the properties of the schema, including the ones of allOf
+func schemaProperties(doc map[string]interface{}, schema map[string]interface{}) map[string]interface{} {
+	schema = resolveSchema(doc, schema)
+	properties := make(map[string]interface{})
+	own, _ := schema["properties"].(map[string]interface{})
+	for k, v := range own {
+		properties[k] = resolveSchema(doc, v.(map[string]interface{}))
+	}
+
+	allOf, _ := schema["allOf"].([]interface{})
+	for _, s := range allOf {
+		for k, v := range schemaProperties(doc, s.(map[string]interface{})) {
+			properties[k] = v
+		}
+	}
+
+	return properties
+}
+
+// fieldNames returns the names given by the tag to the fields of typ, including the ones of embedded structs
+func fieldNames(typ reflect.Type, tag string) []string {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	names := make([]string, 0)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get(tag), ",")[0]
+		switch {
+		case f.Anonymous && name == "":
+			names = append(names, fieldNames(f.Type, tag)...)
+		case name != "-" && name != "":
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func Test_server_routes_openAPI(t *testing.T) {
+	s := &server{router: gin.New(), docs: true}
+	s.routes()
+
+	routes := make([]string, 0)
+	param := regexp.MustCompile(`:(\w+)`)
+	for _, r := range s.router.Routes() {
+		if r.Path == "/docs" {
+			continue // renders the document, not part of the API
+		}
+		routes = append(routes, r.Method+" "+param.ReplaceAllString(r.Path, "{$1}"))
+	}
+
+	operations := make([]string, 0)
+	for path, item := range loadOpenAPI(t)["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			if isOpenAPIMethod(method) {
+				operations = append(operations, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(operations)
+	assert.Equal(t, routes, operations, "openapi.json must describe every route of the router, and only them")
+}
+
+func Test_openAPI_schemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	tests := []struct {
+		schema string
+		value  interface{}
+		tag    string
+	}{
+		{schema: "Image", value: Image{}, tag: "json"},
+		{schema: "SimilarImage", value: similarImage{}, tag: "json"},
+		{schema: "Grant", value: Grant{}, tag: "json"},
+		{schema: "UploadImageForm", value: uploadImageForm{}, tag: "form"},
+		{schema: "UpdateImageForm", value: updateImageForm{}, tag: "json"},
+		{schema: "UsageReport", value: usageReport{}, tag: "json"},
+		{schema: "OwnerUsage", value: ownerUsage{}, tag: "json"},
+		{schema: "Quota", value: Quota{}, tag: "json"},
+		{schema: "Error", value: Error{}, tag: "json"},
+		{schema: "Problem", value: Problem{}, tag: "json"},
+		{schema: "FieldError", value: FieldError{}, tag: "json"},
+		{schema: "Readiness", value: Readiness{}, tag: "json"},
+		{schema: "CheckResult", value: CheckResult{}, tag: "json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			properties := schemaProperties(doc, schemas[tt.schema].(map[string]interface{}))
+			names := make([]string, 0, len(properties))
+			for name := range properties {
+				names = append(names, name)
+			}
+
+			assert.ElementsMatch(t, fieldNames(reflect.TypeOf(tt.value), tt.tag), names)
+		})
+	}
+}
+
+func Test_openAPI_validation(t *testing.T) {
+	doc := loadOpenAPI(t)
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	// the enums of the document are the ones validated by binding tags
+	oneOf := regexp.MustCompile(`oneof=([\w ]+)`)
+	tests := []struct {
+		schema string
+		value  interface{}
+		tag    string
+	}{
+		{schema: "UploadImageForm", value: uploadImageForm{}, tag: "form"},
+		{schema: "UpdateImageForm", value: updateImageForm{}, tag: "json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			properties := schemaProperties(doc, schemas[tt.schema].(map[string]interface{}))
+			typ := reflect.TypeOf(tt.value)
+			for i := 0; i < typ.NumField(); i++ {
+				f := typ.Field(i)
+				m := oneOf.FindStringSubmatch(f.Tag.Get("binding"))
+				if m == nil {
+					continue
+				}
+
+				name := f.Tag.Get(tt.tag)
+				enum := properties[name].(map[string]interface{})["enum"]
+				assert.ElementsMatch(t, strings.Fields(m[1]), enum, name)
+			}
+		})
+	}
+
+	// and the formats are the ones images are converted to
+	parameters := doc["components"].(map[string]interface{})["parameters"].(map[string]interface{})
+	formats := make([]string, 0, len(outputFormats))
+	for f := range outputFormats {
+		formats = append(formats, f)
+	}
+	assert.ElementsMatch(t, formats, parameters["format"].(map[string]interface{})["schema"].(map[string]interface{})["enum"])
+}
+
+func Test_server_handleOpenAPI(t *testing.T) {
+	s := &server{router: gin.New()}
+	s.routes()
+
+	rr := serveRequest(s, "GET", "/openapi.json", "")
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "application/json; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc["openapi"])
+
+	operation := func(path, method string) map[string]interface{} {
+		return doc["paths"].(map[string]interface{})[path].(map[string]interface{})[method].(map[string]interface{})
+	}
+	assert.Equal(t, "listImages", operation("/v1/images", "get")["operationId"])
+	assert.Nil(t, operation("/v1/images", "get")["deprecated"])
+	assert.Equal(t, "listImagesUnversioned", operation("/images", "get")["operationId"])
+	assert.Equal(t, true, operation("/images", "get")["deprecated"])
+	assert.Nil(t, operation("/public/images/{image}", "get")["deprecated"], "public links have no version")
+
+	assert.Equal(t, 404, serveRequest(s, "GET", "/docs", "").Code, "docs are disabled by default")
+
+	s = &server{router: gin.New(), docs: true}
+	s.routes()
+	rr = serveRequest(s, "GET", "/docs", "")
+	assert.Equal(t, 200, rr.Code)
+	assert.Contains(t, rr.Body.String(), `fetch("openapi.json")`)
+}
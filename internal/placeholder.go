@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/SkYNewZ/images-server/internal/blurhash"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// placeholderSize is the size of the thumbnail used to compute the placeholders and colors
+	placeholderSize = 64
+
+	// lqipSize is the size of the low quality image placeholder, kept small as it is returned with the Image
+	lqipSize    = 16
+	lqipQuality = 40
+
+	// blurHashComponents is the number of components along the longest side of the image
+	blurHashComponents = 4
+)
+
+// placeholders computes the BlurHash, the low quality image placeholder and the dominant and average
+// colors of given decoded image
+func (i *Image) placeholders(m image.Image) error {
+	// JPEG and BlurHash have no alpha channel, transparent images are rendered on a white background
+	thumb := thumbnail(m, placeholderSize)
+	flat := image.NewNRGBA(thumb.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), thumb, thumb.Bounds().Min, draw.Over)
+
+	x, y := blurHashComponents, blurHashComponents
+	if b := flat.Bounds(); b.Dx() >= b.Dy() {
+		y = blurHashComponents - 1
+	} else {
+		x = blurHashComponents - 1
+	}
+
+	hash, err := blurhash.Encode(flat, x, y)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeJPEG(&buf, thumbnail(flat, lqipSize), conversion{Quality: lqipQuality}); err != nil {
+		return err
+	}
+
+	i.BlurHash = hash
+	i.LQIP = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	i.DominantColor = formatColor(dominantColor(thumb))
+	i.AverageColor = formatColor(averageColor(thumb))
+	return nil
+}
+
+// thumbnail scales m to fit in a size x size square, keeping its aspect ratio
+func thumbnail(m image.Image, size int) *image.NRGBA {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, height*size/width
+		} else {
+			width, height = width*size/height, size
+		}
+	}
+
+	// Keep at least one pixel for very thin images
+	if width == 0 {
+		width = 1
+	}
+	if height == 0 {
+		height = 1
+	}
+
+	thumb := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(thumb, thumb.Bounds(), m, b, draw.Src, nil)
+	return thumb
+}
+
+// averageColor returns the mean color of the visible pixels of m
+func averageColor(m *image.NRGBA) color.NRGBA {
+	var r, g, b, a uint64
+	for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+		for x := m.Rect.Min.X; x < m.Rect.Max.X; x++ {
+			c := m.NRGBAAt(x, y)
+			r += uint64(c.R) * uint64(c.A)
+			g += uint64(c.G) * uint64(c.A)
+			b += uint64(c.B) * uint64(c.A)
+			a += uint64(c.A)
+		}
+	}
+
+	if a == 0 {
+		return color.NRGBA{}
+	}
+
+	return color.NRGBA{R: uint8(r / a), G: uint8(g / a), B: uint8(b / a), A: 255}
+}
+
+// dominantColor returns the most frequent color of the visible pixels of m.
+// Colors are grouped in buckets of 4 bits per channel and the mean of the largest bucket is returned.
+func dominantColor(m *image.NRGBA) color.NRGBA {
+	type bucket struct {
+		r, g, b, count uint64
+	}
+
+	var buckets [1 << 12]bucket
+	best := -1
+	for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+		for x := m.Rect.Min.X; x < m.Rect.Max.X; x++ {
+			c := m.NRGBAAt(x, y)
+			if c.A < 128 {
+				continue
+			}
+
+			k := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			buckets[k].r += uint64(c.R)
+			buckets[k].g += uint64(c.G)
+			buckets[k].b += uint64(c.B)
+			buckets[k].count++
+
+			if best < 0 || buckets[k].count > buckets[best].count {
+				best = k
+			}
+		}
+	}
+
+	if best < 0 {
+		return color.NRGBA{}
+	}
+
+	d := buckets[best]
+	return color.NRGBA{R: uint8(d.r / d.count), G: uint8(d.g / d.count), B: uint8(d.b / d.count), A: 255}
+}
+
+// formatColor returns the CSS hex notation of c, or an empty string for a fully transparent image
+func formatColor(c color.NRGBA) string {
+	if c.A == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImage_placeholders(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Image{ContentType: "image/png", Content: bytes.NewReader(gopher)}
+	assert.NoError(t, i.fingerprint())
+	assert.Len(t, i.BlurHash, 2+4+2*11)
+	assert.Regexp(t, "^#[0-9a-f]{6}$", i.DominantColor)
+	assert.Regexp(t, "^#[0-9a-f]{6}$", i.AverageColor)
+
+	// S3 limits user metadata to 2KB
+	assert.Less(t, len(i.LQIP), 1024)
+	assert.True(t, strings.HasPrefix(i.LQIP, "data:image/jpeg;base64,"))
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(i.LQIP, "data:image/jpeg;base64,"))
+	assert.NoError(t, err)
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, lqipSize, config.Height, "gopher is taller than wide")
+}
+
+func Test_dominantColor(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			switch {
+			case x < 7:
+				m.SetNRGBA(x, y, color.NRGBA{R: 30, G: 144, B: 255, A: 255})
+			case x < 9:
+				m.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			default: // transparent pixels are ignored
+				m.SetNRGBA(x, y, color.NRGBA{})
+			}
+		}
+	}
+
+	assert.Equal(t, "#1e90ff", formatColor(dominantColor(m)))
+
+	// 70 blue and 20 white pixels
+	assert.Equal(t, color.NRGBA{R: (30*70 + 255*20) / 90, G: (144*70 + 255*20) / 90, B: 255, A: 255}, averageColor(m))
+
+	assert.Empty(t, formatColor(dominantColor(image.NewNRGBA(image.Rect(0, 0, 2, 2)))))
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the reverse proxies allowed to set X-Forwarded-For, see clientIP
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads addresses or CIDR, addresses are networks of a single host
+func parseTrustedProxies(values []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		proxies = append(proxies, cidr)
+	}
+
+	return proxies, nil
+}
+
+// clientIP returns the address of the client, as logged and rate limited. Behind trusted proxies,
+// it is the last address of X-Forwarded-For not belonging to a proxy, the header of others is ignored.
+func (p trustedProxies) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	if !p.trusted(host) {
+		return host
+	}
+
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+
+		host = ip
+		if !p.trusted(ip) {
+			break
+		}
+	}
+
+	return host
+}
+
+func (p trustedProxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range p {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseTrustedProxies(t *testing.T) {
+	got, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	assert.NoError(t, err)
+	assert.Len(t, got, 3)
+	assert.True(t, got.trusted("192.168.1.1"))
+	assert.False(t, got.trusted("192.168.1.2"))
+	assert.True(t, got.trusted("::1"))
+
+	_, err = parseTrustedProxies([]string{"proxy"})
+	assert.Error(t, err)
+}
+
+func Test_trustedProxies_clientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		proxies   trustedProxies
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{name: "Direct", proxies: proxies, remote: "203.0.113.7:1234", want: "203.0.113.7"},
+		{name: "Spoofed", proxies: proxies, remote: "203.0.113.7:1234", forwarded: "198.51.100.1", want: "203.0.113.7"},
+		{name: "Proxied", proxies: proxies, remote: "10.0.0.1:1234", forwarded: "198.51.100.1", want: "198.51.100.1"},
+		{name: "Proxy chain", proxies: proxies, remote: "10.0.0.1:1234", forwarded: "1.2.3.4, 198.51.100.1, 10.0.0.2", want: "198.51.100.1"},
+		{name: "Without header", proxies: proxies, remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "No trusted proxy", remote: "10.0.0.1:1234", forwarded: "198.51.100.1", want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+
+			assert.Equal(t, tt.want, tt.proxies.clientIP(req))
+		})
+	}
+}
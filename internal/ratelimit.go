@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rate limited categories of requests, see rateLimitCategory
+const (
+	rateLimitUpload   = "upload"
+	rateLimitDownload = "download"
+	rateLimitList     = "list"
+	rateLimitDelete   = "delete"
+)
+
+var (
+	// ErrRateLimited caller exceeded the rate limit of the route
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// ErrInvalidRateLimit rate limit cannot be parsed from the configuration
+	ErrInvalidRateLimit = errors.New("invalid rate limit")
+)
+
+// RateLimit allows Requests per Period. Buckets hold up to Requests tokens, so bursts of Requests are allowed.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// enabled tells whether requests are limited, zero values do not limit anything
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 && l.Period > 0
+}
+
+// rate returns the number of tokens refilled per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// String formats the RateLimit as parsed by parseRateLimit
+func (l RateLimit) String() string {
+	if !l.enabled() {
+		return "off"
+	}
+
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+// MarshalYAML implements yaml.Marshaler
+func (l RateLimit) MarshalYAML() (interface{}, error) {
+	return l.String(), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, see parseRateLimit
+func (l *RateLimit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	limit, err := parseRateLimit(v)
+	if err != nil {
+		return err
+	}
+
+	*l = limit
+	return nil
+}
+
+// parseRateLimit reads a limit formatted as <requests>/<period>, e.g. "100/1m". "off" and "0" disable the limit.
+func parseRateLimit(v string) (RateLimit, error) {
+	if v == "off" || v == "0" {
+		return RateLimit{}, nil
+	}
+
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("%w %q: expected <requests>/<period>", ErrInvalidRateLimit, v)
+	}
+
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 0 {
+		return RateLimit{}, fmt.Errorf("%w %q: requests must be a positive integer", ErrInvalidRateLimit, v)
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("%w %q: period must be a positive duration", ErrInvalidRateLimit, v)
+	}
+
+	return RateLimit{Requests: requests, Period: period}, nil
+}
+
+// RateLimitConfig describes the limits of each category of requests
+type RateLimitConfig struct {
+	Limits map[string]RateLimit `yaml:"limits"` // by category, e.g. "list": "100/1m"
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, limits are merged into the current ones
+func (r *RateLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RateLimitConfig
+	var v plain
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	limits := make(map[string]RateLimit)
+	for k, l := range r.Limits {
+		limits[k] = l
+	}
+	for k, l := range v.Limits {
+		limits[k] = l
+	}
+
+	r.Limits = limits
+	return nil
+}
+
+// defaultRateLimitConfig returns the limits used when nothing is configured, generous enough for interactive use
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Limits: map[string]RateLimit{
+			rateLimitUpload:   {Requests: 60, Period: time.Minute},
+			rateLimitDownload: {Requests: 600, Period: time.Minute},
+			rateLimitList:     {Requests: 120, Period: time.Minute},
+			rateLimitDelete:   {Requests: 60, Period: time.Minute},
+		},
+	}
+}
+
+// rateLimitFromEnv reads RateLimitConfig from $RATE_LIMIT_UPLOAD, $RATE_LIMIT_DOWNLOAD, $RATE_LIMIT_LIST
+// and $RATE_LIMIT_DELETE, see parseRateLimit, starting from r
+func rateLimitFromEnv(r RateLimitConfig) (RateLimitConfig, error) {
+	for _, category := range []string{rateLimitUpload, rateLimitDownload, rateLimitList, rateLimitDelete} {
+		k := "RATE_LIMIT_" + strings.ToUpper(category)
+		if v, ok := os.LookupEnv(k); ok {
+			l, err := parseRateLimit(v)
+			if err != nil {
+				return r, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+
+			if r.Limits == nil {
+				r.Limits = make(map[string]RateLimit)
+			}
+			r.Limits[category] = l
+		}
+	}
+
+	return r, nil
+}
+
+func (r RateLimitConfig) validate() error {
+	for category := range r.Limits {
+		switch category {
+		case rateLimitUpload, rateLimitDownload, rateLimitList, rateLimitDelete:
+		default:
+			return fmt.Errorf("%w: unknown category %q", ErrInvalidRateLimit, category)
+		}
+	}
+
+	return nil
+}
+
+// RateLimitResult is the state of a bucket after taking a token
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // tokens left in the bucket
+	RetryAfter time.Duration // until a token is available, when not allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// RateLimitStore holds the token buckets. The in-process memoryRateLimitStore is used by default,
+// replicas must share a store, e.g. backed by Redis, for the limits to apply to the whole deployment.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, which is refilled at the rate of limit
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// memoryRateLimitStore is a RateLimitStore local to the process
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket), now: time.Now}
+}
+
+// Take implements RateLimitStore
+func (m *memoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Requests), updated: now}
+		m.buckets[key] = b
+	}
+	b.refill(now, limit)
+
+	result := RateLimitResult{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / limit.rate())
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit.Requests) - b.tokens) / limit.rate())
+	return result, nil
+}
+
+// refill adds the tokens earned since the last update, up to the capacity of the bucket
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) {
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*limit.rate())
+	b.updated, b.limit = now, limit
+}
+
+// sweep forgets the buckets full by now, they are the same as new ones. m.mu must be held.
+func (m *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+
+	for k, b := range m.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.rate() >= float64(b.limit.Requests) {
+			delete(m.buckets, k)
+		}
+	}
+	m.swept = now
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// rateLimiter limits the requests of each caller, see RateLimit
+type rateLimiter struct {
+	config RateLimitConfig
+	store  RateLimitStore
+}
+
+func newRateLimiter(config RateLimitConfig, store RateLimitStore) *rateLimiter {
+	return &rateLimiter{config: config, store: store}
+}
+
+// rateLimitCategory returns the category of the route, empty when it is not limited
+func rateLimitCategory(method, route string) string {
+	switch {
+	case method == http.MethodPost && strings.HasSuffix(route, "/images"):
+		return rateLimitUpload
+	case method == http.MethodGet && (strings.HasSuffix(route, "/download") || strings.HasPrefix(route, "/public/images/")):
+		return rateLimitDownload
+	case method == http.MethodGet && (strings.HasSuffix(route, "/images") || strings.HasSuffix(route, "/similar")):
+		return rateLimitList
+	case method == http.MethodDelete && strings.HasSuffix(route, "/images/:image"):
+		return rateLimitDelete
+	default:
+		return ""
+	}
+}
+
+// RateLimit limits uploads, downloads, listings and deletes of each client address, see rateLimitCategory.
+// It runs before Authenticate: keying buckets on unverified credentials would give a fresh bucket to every
+// made up API key or token. Authenticated callers are limited again by RateLimitPrincipal.
+// Responses carry the RateLimit-* headers, rejected requests get an HTTP 429 response with Retry-After.
+// Requests are allowed when the store fails.
+func (s *server) RateLimit(c *gin.Context) {
+	if s.rateLimit == nil {
+		return
+	}
+
+	s.limit(c, "ip:"+s.proxies.clientIP(c.Request))
+}
+
+// RateLimitPrincipal applies the limits of RateLimit to the verified subject of the Principal, whatever
+// its address. It must run after Authenticate, anonymous callers are only limited by address.
+func (s *server) RateLimitPrincipal(c *gin.Context) {
+	subject := principal(c).subject()
+	if s.rateLimit == nil || subject == "" {
+		return
+	}
+
+	s.limit(c, "sub:"+subject)
+}
+
+// limit takes a token from the bucket of the caller for the category of the route.
+// The headers describe the bucket with the fewest tokens left when several apply.
+func (s *server) limit(c *gin.Context, caller string) {
+	category := rateLimitCategory(c.Request.Method, c.FullPath())
+	limit := s.rateLimit.config.Limits[category]
+	if category == "" || !limit.enabled() {
+		return
+	}
+
+	result, err := s.rateLimit.store.Take(c.Request.Context(), category+":"+caller, limit)
+	if err != nil {
+		logger(c.Request.Context()).Warnln("rate limit store:", err)
+		return
+	}
+
+	if v, err := strconv.Atoi(c.Writer.Header().Get("RateLimit-Remaining")); err == nil && v < result.Remaining && result.Allowed {
+		return
+	}
+
+	c.Header("RateLimit-Limit", strconv.Itoa(limit.Requests))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, ceilSeconds(limit.Period)))
+
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		s.abortWithError(c, newTooManyRequestsError(fmt.Errorf("%w: %s %s requests allowed", ErrRateLimited, limit, category)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
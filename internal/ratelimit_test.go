@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseRateLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{value: "100/1m", want: RateLimit{Requests: 100, Period: time.Minute}},
+		{value: "5/10s", want: RateLimit{Requests: 5, Period: 10 * time.Second}},
+		{value: "off", want: RateLimit{}},
+		{value: "0", want: RateLimit{}},
+		{value: "100", wantErr: true},
+		{value: "-1/1m", wantErr: true},
+		{value: "100/forever", wantErr: true},
+		{value: "100/0s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseRateLimit(tt.value)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_rateLimitFromEnv(t *testing.T) {
+	os.Setenv("RATE_LIMIT_LIST", "10/1s")
+	os.Setenv("RATE_LIMIT_DELETE", "off")
+	defer os.Unsetenv("RATE_LIMIT_LIST")
+	defer os.Unsetenv("RATE_LIMIT_DELETE")
+
+	got, err := rateLimitFromEnv(defaultRateLimitConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, got.validate())
+	assert.Equal(t, RateLimit{Requests: 10, Period: time.Second}, got.Limits[rateLimitList])
+	assert.False(t, got.Limits[rateLimitDelete].enabled())
+	assert.Equal(t, defaultRateLimitConfig().Limits[rateLimitUpload], got.Limits[rateLimitUpload])
+}
+
+func Test_memoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+
+	limit := RateLimit{Requests: 2, Period: 10 * time.Second}
+	ctx := context.Background()
+
+	got, _ := store.Take(ctx, "a", limit)
+	assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 1, Reset: 5 * time.Second}, got)
+
+	got, _ = store.Take(ctx, "a", limit)
+	assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 0, Reset: 10 * time.Second}, got)
+
+	got, _ = store.Take(ctx, "a", limit)
+	assert.Equal(t, RateLimitResult{Allowed: false, Remaining: 0, RetryAfter: 5 * time.Second, Reset: 10 * time.Second}, got)
+
+	got, _ = store.Take(ctx, "b", limit)
+	assert.True(t, got.Allowed, "buckets are separated by key")
+
+	// A token is refilled every 5s
+	now = now.Add(5 * time.Second)
+	got, _ = store.Take(ctx, "a", limit)
+	assert.True(t, got.Allowed)
+	got, _ = store.Take(ctx, "a", limit)
+	assert.False(t, got.Allowed)
+
+	// Full buckets are forgotten
+	now = now.Add(time.Minute)
+	_, _ = store.Take(ctx, "c", limit)
+	assert.Len(t, store.buckets, 1)
+}
+
+func Test_rateLimitCategory(t *testing.T) {
+	tests := []struct {
+		method string
+		route  string
+		want   string
+	}{
+		{method: "POST", route: "/images", want: rateLimitUpload},
+		{method: "GET", route: "/images", want: rateLimitList},
+		{method: "GET", route: "/images/:image/similar", want: rateLimitList},
+		{method: "GET", route: "/images/:image/download", want: rateLimitDownload},
+		{method: "GET", route: "/public/images/:image", want: rateLimitDownload},
+		{method: "DELETE", route: "/images/:image", want: rateLimitDelete},
+		{method: "GET", route: "/images/:image", want: ""},
+		{method: "POST", route: "/v1/images", want: rateLimitUpload},
+		{method: "GET", route: "/v1/images/:image/download", want: rateLimitDownload},
+		{method: "DELETE", route: "/v1/images/:image", want: rateLimitDelete},
+		{method: "GET", route: "/_health", want: ""},
+		{method: "GET", route: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.route, func(t *testing.T) {
+			assert.Equal(t, tt.want, rateLimitCategory(tt.method, tt.route))
+		})
+	}
+}
+
+func Test_server_RateLimit(t *testing.T) {
+	config := RateLimitConfig{Limits: map[string]RateLimit{
+		rateLimitList:   {Requests: 2, Period: time.Minute},
+		rateLimitUpload: {Requests: 1, Period: time.Minute},
+	}}
+
+	s := &server{router: gin.New(), rateLimit: newRateLimiter(config, newMemoryRateLimitStore())}
+	s.router.Use(s.RateLimit)
+	s.router.GET("/images", func(c *gin.Context) { c.Status(200) })
+	s.router.POST("/images", func(c *gin.Context) { c.Status(201) })
+	s.router.GET("/images/:image", func(c *gin.Context) { c.Status(200) })
+
+	do := func(method, target, remote, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remote
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := do("GET", "/images", "203.0.113.7:1234", "")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rw.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rw.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", rw.Header().Get("RateLimit-Policy"))
+
+	assert.Equal(t, 200, do("GET", "/images", "203.0.113.7:4321", "").Code)
+
+	rw = do("GET", "/images", "203.0.113.7:1234", "")
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "30", rw.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"code":429,"error":"rate_limited","message":"rate limit exceeded: 2/1m0s list requests allowed"}`, rw.Body.String())
+
+	assert.Equal(t, 200, do("GET", "/images", "198.51.100.1:1234", "").Code, "other addresses have their own bucket")
+	assert.Equal(t, 429, do("GET", "/images", "203.0.113.7:1234", "made-up-key").Code, "credentials do not get their own bucket")
+	assert.Equal(t, 201, do("POST", "/images", "203.0.113.7:1234", "").Code, "uploads are limited separately")
+	assert.Equal(t, 429, do("POST", "/images", "203.0.113.7:1234", "").Code)
+
+	rw = do("GET", "/images/foo", "203.0.113.7:1234", "")
+	assert.Equal(t, 200, rw.Code, "route is not limited")
+	assert.Empty(t, rw.Header().Get("RateLimit-Limit"))
+}
+
+func Test_server_RateLimitPrincipal(t *testing.T) {
+	config := RateLimitConfig{Limits: map[string]RateLimit{
+		rateLimitList: {Requests: 2, Period: time.Minute},
+	}}
+
+	s := &server{router: gin.New(), rateLimit: newRateLimiter(config, newMemoryRateLimitStore())}
+	authenticate := func(c *gin.Context) {
+		c.Set(PrincipalContextKey, &Principal{Subject: c.GetHeader("X-Subject")})
+	}
+	s.router.Use(s.RateLimit, authenticate, s.RateLimitPrincipal)
+	s.router.GET("/images", func(c *gin.Context) { c.Status(200) })
+
+	do := func(remote, subject string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/images", nil)
+		req.RemoteAddr = remote
+		if subject != "" {
+			req.Header.Set("X-Subject", subject)
+		}
+
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := do("203.0.113.7:1234", "alice")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("RateLimit-Remaining"))
+
+	rw = do("198.51.100.1:1234", "alice")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "0", rw.Header().Get("RateLimit-Remaining"), "the bucket of the subject has fewer tokens than the one of the address")
+
+	rw = do("192.0.2.1:1234", "alice")
+	assert.Equal(t, 429, rw.Code, "subjects are limited whatever their address")
+	assert.JSONEq(t, `{"code":429,"error":"rate_limited","message":"rate limit exceeded: 2/1m0s list requests allowed"}`, rw.Body.String())
+
+	assert.Equal(t, 200, do("192.0.2.1:1234", "bob").Code, "other subjects have their own bucket")
+	assert.Equal(t, 429, do("192.0.2.1:1234", "bob").Code, "addresses are still limited before authentication")
+
+	assert.Equal(t, 200, do("192.0.2.2:1234", "").Code)
+	assert.Equal(t, 200, do("192.0.2.3:1234", "").Code, "anonymous callers are only limited by address")
+}
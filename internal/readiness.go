@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	s3 "github.com/minio/minio-go"
+)
+
+// ReadinessConfig describes the dependency checks of /_ready, see handleReadiness
+type ReadinessConfig struct {
+	Timeout     time.Duration `yaml:"timeout"`       // of each check
+	CacheTTL    time.Duration `yaml:"cache_ttl"`     // results are reused meanwhile, sparing the dependencies
+	DiskPath    string        `yaml:"disk_path"`     // where uploads are spilled, the temporary directory by default
+	MinFreeDisk int64         `yaml:"min_free_disk"` // in bytes, the disk is not checked when zero
+}
+
+// defaultReadinessConfig returns the options used when nothing is configured
+func defaultReadinessConfig() ReadinessConfig {
+	return ReadinessConfig{
+		Timeout:  2 * time.Second,
+		CacheTTL: 5 * time.Second,
+	}
+}
+
+// readinessFromEnv reads ReadinessConfig from $READINESS_TIMEOUT, $READINESS_CACHE_TTL, $READINESS_DISK_PATH
+// and $READINESS_MIN_FREE_DISK, starting from r
+func readinessFromEnv(r ReadinessConfig) (ReadinessConfig, error) {
+	durations := map[string]*time.Duration{
+		"READINESS_TIMEOUT":   &r.Timeout,
+		"READINESS_CACHE_TTL": &r.CacheTTL,
+	}
+	for k, p := range durations {
+		if v, ok := os.LookupEnv(k); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return r, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = d
+		}
+	}
+
+	if v, ok := os.LookupEnv("READINESS_DISK_PATH"); ok {
+		r.DiskPath = v
+	}
+
+	if v, ok := os.LookupEnv("READINESS_MIN_FREE_DISK"); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid $READINESS_MIN_FREE_DISK: %w", err)
+		}
+		r.MinFreeDisk = i
+	}
+
+	return r, nil
+}
+
+func (r ReadinessConfig) validate() error {
+	if r.Timeout <= 0 {
+		return fmt.Errorf("invalid readiness timeout: must be positive")
+	}
+
+	if r.CacheTTL < 0 || r.MinFreeDisk < 0 {
+		return fmt.Errorf("invalid readiness cache TTL or minimum free disk: must not be negative")
+	}
+
+	return nil
+}
+
+// CheckResult is the outcome of a dependency check
+type CheckResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// Readiness reports whether the server can serve requests, see handleReadiness
+type Readiness struct {
+	OK        bool                   `json:"ok"`
+	Version   string                 `json:"version"`
+	Checks    map[string]CheckResult `json:"checks"`
+	CheckedAt time.Time              `json:"checked_at"`
+}
+
+// readinessCheck tells whether a dependency works, it should give up when ctx is done
+type readinessCheck func(ctx context.Context) error
+
+// readiness runs the dependency checks, and caches their results
+type readiness struct {
+	config ReadinessConfig
+	checks map[string]readinessCheck
+	now    func() time.Time
+
+	mu   sync.Mutex
+	last *Readiness
+}
+
+func newReadiness(config ReadinessConfig, checks map[string]readinessCheck) *readiness {
+	return &readiness{config: config, checks: checks, now: time.Now}
+}
+
+// report runs every check concurrently, unless they ran within the cache TTL
+func (r *readiness) report() Readiness {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.last != nil && now.Sub(r.last.CheckedAt) < r.config.CacheTTL {
+		return *r.last
+	}
+
+	report := Readiness{OK: true, Version: buildNumber, Checks: make(map[string]CheckResult, len(r.checks)), CheckedAt: now}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range r.checks {
+		wg.Add(1)
+		go func(name string, check readinessCheck) {
+			defer wg.Done()
+			result := r.run(check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			report.OK = report.OK && result.OK
+		}(name, check)
+	}
+	wg.Wait()
+
+	r.last = &report
+	return report
+}
+
+// run runs the check within the timeout. Checks ignoring their context are abandoned once it expires.
+func (r *readiness) run(check readinessCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", r.config.Timeout)
+	}
+
+	result := CheckResult{OK: err == nil, Duration: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// readinessChecks returns the dependency checks of the server
+func (s *server) readinessChecks(config ReadinessConfig) map[string]readinessCheck {
+	checks := map[string]readinessCheck{"storage": s.checkStorage}
+	if config.MinFreeDisk > 0 {
+		checks["disk"] = func(ctx context.Context) error { return checkDisk(config.DiskPath, config.MinFreeDisk) }
+	}
+
+	return checks
+}
+
+// checkStorage ensures every bucket is reachable with our credentials.
+// Image records are stored along their blobs, so this checks the metadata too.
+func (s *server) checkStorage(ctx context.Context) error {
+	if !s.ready() {
+		return ErrStorageUnavailable
+	}
+
+	for _, client := range s.buckets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ok, err := client.BucketExists(client.BucketName)
+		if err != nil {
+			switch s3.ToErrorResponse(err).Code {
+			case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+				return fmt.Errorf("credentials rejected by bucket %s: %w", client.BucketName, err)
+			}
+			return fmt.Errorf("bucket %s is unreachable: %w", client.BucketName, err)
+		}
+
+		if !ok {
+			return fmt.Errorf("bucket %s does not exist", client.BucketName)
+		}
+	}
+
+	return nil
+}
+
+// checkDisk ensures uploads can be spilled to the disk holding path, the temporary directory when empty
+func checkDisk(path string, min int64) error {
+	if path == "" {
+		path = os.TempDir()
+	}
+
+	free, err := freeDiskSpace(path)
+	if err != nil {
+		return err
+	}
+
+	if free < min {
+		return fmt.Errorf("%d bytes free on %s, %d required", free, path, min)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readinessFromEnv(t *testing.T) {
+	os.Setenv("READINESS_TIMEOUT", "1s")
+	os.Setenv("READINESS_MIN_FREE_DISK", "1024")
+	defer os.Unsetenv("READINESS_TIMEOUT")
+	defer os.Unsetenv("READINESS_MIN_FREE_DISK")
+
+	got, err := readinessFromEnv(defaultReadinessConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, got.validate())
+	assert.Equal(t, time.Second, got.Timeout)
+	assert.Equal(t, int64(1024), got.MinFreeDisk)
+	assert.Equal(t, defaultReadinessConfig().CacheTTL, got.CacheTTL)
+
+	os.Setenv("READINESS_TIMEOUT", "0s")
+	got, err = readinessFromEnv(defaultReadinessConfig())
+	assert.NoError(t, err)
+	assert.Error(t, got.validate())
+}
+
+func Test_readiness_report(t *testing.T) {
+	var calls int
+	checks := map[string]readinessCheck{
+		"ok": func(ctx context.Context) error {
+			calls++
+			return nil
+		},
+		"failing": func(ctx context.Context) error { return errors.New("unreachable") },
+		"slow": func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		},
+	}
+
+	now := time.Now()
+	r := newReadiness(ReadinessConfig{Timeout: 10 * time.Millisecond, CacheTTL: 5 * time.Second}, checks)
+	r.now = func() time.Time { return now }
+
+	got := r.report()
+	assert.False(t, got.OK)
+	assert.True(t, got.Checks["ok"].OK)
+	assert.Equal(t, CheckResult{OK: false, Error: "unreachable", Duration: got.Checks["failing"].Duration}, got.Checks["failing"])
+	assert.Equal(t, "timed out after 10ms", got.Checks["slow"].Error)
+
+	// Results are cached
+	r.report()
+	assert.Equal(t, 1, calls)
+
+	now = now.Add(5 * time.Second)
+	r.report()
+	assert.Equal(t, 2, calls)
+}
+
+func Test_checkDisk(t *testing.T) {
+	assert.NoError(t, checkDisk(t.TempDir(), 1))
+	assert.Error(t, checkDisk(t.TempDir(), 1<<62))
+	assert.Error(t, checkDisk("/does/not/exist", 1))
+}
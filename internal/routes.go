@@ -1,18 +1,58 @@
 package internal
 
+import "github.com/gin-gonic/gin"
+
 func (s *server) routes() {
-	// TODO: Use API versioning ?
+	// Unknown routes and methods, with the same error bodies as every route
+	s.router.NoRoute(s.handleNoRoute)
+	s.router.NoMethod(s.handleNoMethod)
 
 	// Health check
 	s.router.GET("/_health", s.handleHealthCheck)
 
-	// Images
-	imgs := s.router.Group("/images")
-	imgs.Use(s.handleErrors)
+	// Readiness, checking the dependencies
+	s.router.GET("/_ready", s.handleReadiness)
+
+	// Prometheus metrics
+	s.router.GET("/metrics", s.handleMetrics)
+
+	// API description, and its rendering for humans
+	s.router.GET("/openapi.json", s.handleOpenAPI)
+	if s.docs {
+		s.router.GET("/docs", s.handleDocs)
+	}
+
+	// Public and signed links, readable without credentials
+	s.router.GET("/public/images/:image", s.handleErrors, s.RequireStorage, s.ResolveTenant, s.BindUUID, s.ValidateRequest, s.handlePublicDownload)
+
+	// Current version, and the same routes without version, deprecated
+	s.apiRoutes(s.router.Group(apiV1.prefix), apiV1)
+	s.apiRoutes(s.router.Group("", s.Deprecated(apiV1)), apiV1)
+}
+
+// apiRoutes registers the routes of the version v of the API on the group
+func (s *server) apiRoutes(api *gin.RouterGroup, v *apiVersion) {
+	api.Use(v.bind)
+
+	// Images, requests are validated last, see ValidateRequest
+	imgs := api.Group("/images")
+	imgs.Use(s.handleErrors, s.RequireStorage, s.Authenticate, s.RateLimitPrincipal, s.ResolveTenant)
+	{
+		read := s.RequireScope(scopeImagesRead)
+		imgs.GET("", read, s.ValidateRequest, s.handleImagesList)
+		imgs.POST("", s.RequireScope(scopeImagesWrite), s.LimitUploadSize, s.ValidateRequest, s.handleImagesCreate)
+		imgs.GET("/:image", read, s.BindUUID, s.ValidateRequest, s.handleImagesGet)
+		imgs.GET("/:image/download", read, s.BindUUID, s.ValidateRequest, s.handleImagesDownload)
+		imgs.GET("/:image/similar", read, s.BindUUID, s.ValidateRequest, s.handleImagesSimilar)
+		imgs.PATCH("/:image", s.RequireScope(scopeImagesWrite), s.BindUUID, s.ValidateRequest, s.handleImagesUpdate)
+		imgs.PUT("/:image/grants", s.RequireScope(scopeImagesWrite), s.BindUUID, s.ValidateRequest, s.handleImagesGrants)
+		imgs.DELETE("/:image", s.RequireScope(scopeImagesDelete), s.BindUUID, s.ValidateRequest, s.handleImagesDelete)
+	}
+
+	// Storage consumption
+	usage := api.Group("/usage")
+	usage.Use(s.handleErrors, s.RequireStorage, s.Authenticate, s.ResolveTenant)
 	{
-		imgs.GET("", s.handleImagesList)
-		imgs.POST("", s.handleImagesCreate)
-		imgs.GET("/:image", s.BindUUID, s.handleImagesGet)
-		imgs.DELETE("/:image", s.BindUUID, s.handleImagesDelete)
+		usage.GET("", s.RequireScope(scopeImagesRead), s.ValidateRequest, s.handleUsage)
 	}
 }
@@ -1,25 +1,91 @@
 package internal
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/SkYNewZ/images-server/internal/minio"
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 )
 
 var _ http.Handler = (*server)(nil)
 
+// bucketNameImages is the default bucket, see StorageConfig
+const bucketNameImages = "images"
+
+var ginMode = gin.ReleaseMode
+
+// Delays between attempts to connect to the storage at startup, see connect
 const (
-	bucketNameImages = "images"
+	connectMinBackoff = 500 * time.Millisecond
+	connectMaxBackoff = 30 * time.Second
 )
 
-var ginMode = gin.ReleaseMode
+// ErrStorageUnavailable the storage is not connected yet
+var ErrStorageUnavailable = errors.New("storage is not available yet")
 
 // server handle our global server instance logic
 // Inspired by https://youtu.be/rWBSMsLG8po?t=613
 type server struct {
 	router *gin.Engine
 	Image  ImageService
+	limits UploadLimits
+
+	// auth resolves the caller of /images routes, see Authenticate
+	auth *authenticator
+
+	// watermark is composited onto images requiring it, see watermarkFor
+	watermark *watermarker
+
+	// links signs the download links of private images, see setDownloadURL
+	links *linkSigner
+
+	// tenants isolates the images of each tenant, nil for single tenant servers, see ResolveTenant
+	tenants *tenants
+
+	// quotas bound the storage consumption, tracked by usage, see handleUsage
+	quotas QuotaConfig
+	usage  *usageTracker
+
+	// cors allows browsers of other origins to call the API, see CORS
+	cors CORSConfig
+
+	// rateLimit limits the requests of each caller, nil when disabled, see RateLimit
+	rateLimit *rateLimiter
+
+	// proxies may set the address of clients, see clientIP
+	proxies trustedProxies
+
+	// contentTypes is the allow-list of accepted content types
+	contentTypes []string
+
+	// open connects to the storage, connecting is 1 until it succeeded, see connect
+	open       func() error
+	connecting int32
+
+	// buckets are the connected buckets, checked by readiness, see handleReadiness
+	buckets   []*minio.Client
+	readiness *readiness
+
+	// metrics measures requests and storage operations, see handleMetrics
+	metrics *metrics
+
+	// errorBodies describes the body of error responses, see writeError
+	errorBodies ErrorsConfig
+
+	// sunset is when the unversioned routes are removed, zero when not announced, see Deprecated
+	sunset time.Time
+
+	// variants caches converted images, see serveImage
+	variants *variantCache
+
+	// docs serves a page rendering the OpenAPI document, see handleDocs
+	docs bool
 }
 
 // ServeHTTP implements http.Handler
@@ -27,22 +93,153 @@ func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.router.ServeHTTP(w, req)
 }
 
-func newServer() *server {
+// newServer builds the server described by the Config, which must be valid, see LoadConfig.
+// The storage is not connected yet, see connect.
+func newServer(config Config) (*server, error) {
 	// Set default gin mode to release
 	gin.SetMode(ginMode)
 
 	s := new(server)
 	s.router = gin.New()
 	s.router.HandleMethodNotAllowed = true
-	s.router.MaxMultipartMemory = 5 << 20 // 5MB
+	s.router.MaxMultipartMemory = config.Server.MaxMultipartMemory
+
+	s.limits = config.Uploads
+	s.contentTypes = config.ContentTypes
+	s.watermark = &watermarker{config: config.Watermark}
+	s.quotas = config.Quotas
+	s.cors = config.CORS
+	s.metrics = newMetrics()
+	s.variants = newVariantCache(defaultVariantCacheSize)
+	s.errorBodies = config.Errors
+	s.sunset, _ = config.API.sunset()
+	s.docs = config.API.Docs
+
+	var err error
+	s.auth, err = newAuthenticator(config.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := config.Links.withKey()
+	if err != nil {
+		return nil, err
+	}
+	s.links = newLinkSigner(links)
+
+	s.rateLimit = newRateLimiter(config.RateLimit, newMemoryRateLimitStore())
+	s.proxies, err = parseTrustedProxies(config.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 
+	if config.Tenancy.enabled() {
+		s.auth.keyTenants = config.Tenancy.apiKeyTenants()
+	}
+
+	s.connecting = 1
+	s.open = func() error { return s.openStorage(config) }
+	s.readiness = newReadiness(config.Readiness, s.readinessChecks(config.Readiness))
+
+	s.middlewares() // declare our middlewares, before the routes they apply to
 	s.routes()      // declare our routes
-	s.middlewares() // declare our middlewares
 
-	// Inject dependencies
-	s.Image = &imageService{
-		Minio: minio.New(bucketNameImages),
+	return s, nil
+}
+
+// openStorage connects to the bucket of the images, or to the buckets of every tenant
+func (s *server) openStorage(config Config) error {
+	if config.Tenancy.enabled() {
+		images := newTenantImages(config.Storage.Config)
+		for _, t := range config.Tenancy.Tenants {
+			if _, err := images.client(t.Bucket); err != nil {
+				return err
+			}
+		}
+
+		for _, client := range images.clients {
+			s.buckets = append(s.buckets, client)
+		}
+		s.tenants = newTenants(config.Tenancy, s.tenant(nil), func(c TenantConfig, contentTypes []string) ImageService {
+			return s.metrics.images(images.open(c, contentTypes))
+		})
+		return nil
+	}
+
+	client, err := minio.New(config.Storage.Config, config.Storage.Bucket)
+	if err != nil {
+		return err
 	}
 
-	return s
+	s.Image = s.metrics.images(&imageService{
+		Minio:        client,
+		ContentTypes: s.contentTypes,
+	})
+	s.usage = newUsageTracker(s.Image)
+	s.buckets = []*minio.Client{client}
+
+	return nil
+}
+
+// connect opens the storage, retrying with an exponential backoff until it succeeds or ctx is done.
+// Requests needing the storage are rejected until then, see RequireStorage.
+func (s *server) connect(ctx context.Context) error {
+	delay := connectMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.open()
+		if err == nil {
+			atomic.StoreInt32(&s.connecting, 0)
+			log.Infoln("storage is connected")
+			return nil
+		}
+
+		log.Warnf("cannot connect to the storage (attempt %d), retrying in %s: %v", attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cannot connect to the storage after %d attempts: %w", attempt, err)
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > connectMaxBackoff {
+			delay = connectMaxBackoff
+		}
+	}
+}
+
+// ready tells whether the storage is connected, see connect
+func (s *server) ready() bool {
+	return atomic.LoadInt32(&s.connecting) == 0
+}
+
+// tenantImages opens the storage of tenants, tenants sharing a bucket share its client
+type tenantImages struct {
+	config  minio.Config
+	clients map[string]*minio.Client
+}
+
+func newTenantImages(config minio.Config) *tenantImages {
+	return &tenantImages{config: config, clients: make(map[string]*minio.Client)}
+}
+
+// client connects to the bucket, once
+func (t *tenantImages) client(bucket string) (*minio.Client, error) {
+	client, ok := t.clients[bucket]
+	if !ok {
+		var err error
+		if client, err = minio.New(t.config, bucket); err != nil {
+			return nil, err
+		}
+		t.clients[bucket] = client
+	}
+
+	return client, nil
+}
+
+// open returns the images of the tenant, its bucket must have been connected, see client
+func (t *tenantImages) open(c TenantConfig, contentTypes []string) ImageService {
+	return &imageService{
+		Minio:        t.clients[c.Bucket],
+		ContentTypes: contentTypes,
+		Prefix:       c.Prefix,
+	}
 }
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_server_connect(t *testing.T) {
+	log.SetOutput(io.Discard)
+
+	errUnreachable := errors.New("unreachable")
+
+	t.Run("Retried", func(t *testing.T) {
+		var attempts int
+		s := &server{connecting: 1}
+		s.open = func() error {
+			if attempts++; attempts < 2 {
+				return errUnreachable
+			}
+			return nil
+		}
+
+		assert.False(t, s.ready())
+		assert.NoError(t, s.connect(context.Background()))
+		assert.Equal(t, 2, attempts)
+		assert.True(t, s.ready())
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		s := &server{connecting: 1}
+		s.open = func() error { return errUnreachable }
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := s.connect(ctx)
+		assert.ErrorIs(t, err, errUnreachable)
+		assert.False(t, s.ready())
+	})
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TenantContextKey is the context key of the resolved *tenant
+const TenantContextKey = "tenant"
+
+// defaultTenantHeader is the request header naming the tenant when nothing is configured
+const defaultTenantHeader = "X-Tenant-ID"
+
+// tenantIDPattern restricts tenant ids, they appear in links and logs
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+var (
+	// ErrUnknownTenant requested tenant is not configured
+	ErrUnknownTenant = errors.New("unknown tenant")
+
+	// ErrTenantRequired request does not resolve any tenant and no default tenant is configured
+	ErrTenantRequired = errors.New("tenant is required")
+
+	// ErrTenantMismatch requested tenant differs from the tenant of the credentials, or of the hostname
+	ErrTenantMismatch = errors.New("tenant mismatch")
+
+	// ErrInvalidTenantConfig tenants configuration is invalid
+	ErrInvalidTenantConfig = errors.New("invalid tenants configuration")
+)
+
+// TenantConfig describes a tenant. The images of a tenant are isolated in their own bucket,
+// or under their own prefix of a shared bucket.
+type TenantConfig struct {
+	ID      string   `json:"id" yaml:"id"`
+	Bucket  string   `json:"bucket" yaml:"bucket"`     // defaults to the server bucket
+	Prefix  string   `json:"prefix" yaml:"prefix"`     // key prefix, e.g. "marketing/", required when the bucket is shared
+	Hosts   []string `json:"hosts" yaml:"hosts"`       // hostnames resolving to this tenant
+	APIKeys []string `json:"api_keys" yaml:"api_keys"` // names of the API keys bound to this tenant
+
+	// Limits, ContentTypes and Quotas override the server configuration when set
+	Limits       *UploadLimits `json:"limits" yaml:"limits"`
+	ContentTypes []string      `json:"content_types" yaml:"content_types"`
+	Quotas       *QuotaConfig  `json:"quotas" yaml:"quotas"`
+}
+
+// TenancyConfig describes the tenants and how requests are mapped to them
+type TenancyConfig struct {
+	Tenants []TenantConfig `json:"tenants" yaml:"tenants"`
+	Default string         `json:"default" yaml:"default"` // tenant of requests resolving none and of credentials bound to none, they are rejected when empty
+	Header  string         `json:"header" yaml:"header"`   // request header naming the tenant
+}
+
+// defaultTenancyConfig returns the options used when nothing is configured, a single implicit tenant
+func defaultTenancyConfig() TenancyConfig {
+	return TenancyConfig{Header: defaultTenantHeader}
+}
+
+// enabled tells whether tenants are configured, the server holds a single implicit tenant otherwise
+func (t TenancyConfig) enabled() bool {
+	return len(t.Tenants) > 0
+}
+
+// tenancyFromEnv reads TenancyConfig from the JSON file $TENANTS_FILE, starting from t.
+// $TENANT_HEADER and $TENANT_DEFAULT override the values of the file.
+func tenancyFromEnv(t TenancyConfig) (TenancyConfig, error) {
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return t, fmt.Errorf("invalid $TENANTS_FILE: %w", err)
+		}
+
+		if err := json.Unmarshal(data, &t); err != nil {
+			return t, fmt.Errorf("invalid $TENANTS_FILE: %w", err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("TENANT_HEADER"); ok {
+		t.Header = v
+	}
+
+	if v, ok := os.LookupEnv("TENANT_DEFAULT"); ok {
+		t.Default = v
+	}
+
+	return t, nil
+}
+
+// setDefaults stores tenants without bucket in the server bucket
+func (t TenancyConfig) setDefaults(bucket string) {
+	for k := range t.Tenants {
+		if t.Tenants[k].Bucket == "" {
+			t.Tenants[k].Bucket = bucket
+		}
+	}
+}
+
+func (t TenancyConfig) validate() error {
+	if !t.enabled() {
+		return nil
+	}
+
+	ids := make(map[string]bool)
+	hosts := make(map[string]string)
+	keys := make(map[string]string)
+	buckets := make(map[string][]TenantConfig)
+
+	for _, tenant := range t.Tenants {
+		if !tenantIDPattern.MatchString(tenant.ID) {
+			return fmt.Errorf("%w: tenant id %q must match %s", ErrInvalidTenantConfig, tenant.ID, tenantIDPattern)
+		}
+
+		if ids[tenant.ID] {
+			return fmt.Errorf("%w: duplicate tenant %q", ErrInvalidTenantConfig, tenant.ID)
+		}
+		ids[tenant.ID] = true
+
+		if p := tenant.Prefix; p != "" && (!strings.HasSuffix(p, "/") || strings.HasPrefix(p, "/")) {
+			return fmt.Errorf("%w: prefix of tenant %q must end with a slash and not start with one", ErrInvalidTenantConfig, tenant.ID)
+		}
+
+		for _, h := range tenant.Hosts {
+			if other, ok := hosts[strings.ToLower(h)]; ok {
+				return fmt.Errorf("%w: host %q is used by tenants %q and %q", ErrInvalidTenantConfig, h, other, tenant.ID)
+			}
+			hosts[strings.ToLower(h)] = tenant.ID
+		}
+
+		for _, k := range tenant.APIKeys {
+			if other, ok := keys[k]; ok {
+				return fmt.Errorf("%w: API key %q is bound to tenants %q and %q", ErrInvalidTenantConfig, k, other, tenant.ID)
+			}
+			keys[k] = tenant.ID
+		}
+
+		buckets[tenant.Bucket] = append(buckets[tenant.Bucket], tenant)
+	}
+
+	// Tenants sharing a bucket must not see each other objects
+	for bucket, shared := range buckets {
+		if len(shared) < 2 {
+			continue
+		}
+
+		for i, a := range shared {
+			if a.Prefix == "" {
+				return fmt.Errorf("%w: tenant %q shares bucket %q and requires a prefix", ErrInvalidTenantConfig, a.ID, bucket)
+			}
+
+			for _, b := range shared[i+1:] {
+				if strings.HasPrefix(a.Prefix, b.Prefix) || strings.HasPrefix(b.Prefix, a.Prefix) {
+					return fmt.Errorf("%w: prefixes of tenants %q and %q overlap", ErrInvalidTenantConfig, a.ID, b.ID)
+				}
+			}
+		}
+	}
+
+	if t.Default != "" && !ids[t.Default] {
+		return fmt.Errorf("%w: default tenant %q is not configured", ErrInvalidTenantConfig, t.Default)
+	}
+
+	return nil
+}
+
+// apiKeyTenants maps API key names to the tenant they are bound to
+func (t TenancyConfig) apiKeyTenants() map[string]string {
+	keys := make(map[string]string)
+	for _, tenant := range t.Tenants {
+		for _, k := range tenant.APIKeys {
+			keys[k] = tenant.ID
+		}
+	}
+
+	return keys
+}
+
+// tenant is an isolated set of images, along with its configuration
+type tenant struct {
+	id           string // empty for the implicit tenant of single tenant servers
+	Image        ImageService
+	limits       UploadLimits
+	contentTypes []string
+	watermark    *watermarker
+	quotas       QuotaConfig
+	usage        *usageTracker
+}
+
+// tenants resolves the tenant of requests, see resolve
+type tenants struct {
+	header   string
+	fallback string
+	byID     map[string]*tenant
+	byHost   map[string]*tenant
+}
+
+// newTenants builds the configured tenants, open returns the ImageService storing the images of a tenant.
+// Unless overridden, tenants get the limits, content types, quotas and watermark of base.
+func newTenants(config TenancyConfig, base *tenant, open func(TenantConfig, []string) ImageService) *tenants {
+	t := &tenants{
+		header:   config.Header,
+		fallback: config.Default,
+		byID:     make(map[string]*tenant),
+		byHost:   make(map[string]*tenant),
+	}
+
+	for _, c := range config.Tenants {
+		tenant := &tenant{
+			id:           c.ID,
+			limits:       base.limits,
+			contentTypes: base.contentTypes,
+			watermark:    new(watermarker),
+			quotas:       base.quotas,
+		}
+
+		// Each tenant reads the watermark image from its own storage
+		if base.watermark != nil {
+			tenant.watermark.config = base.watermark.config
+		}
+
+		if c.Limits != nil {
+			tenant.limits = *c.Limits
+		}
+
+		if len(c.ContentTypes) > 0 {
+			tenant.contentTypes = c.ContentTypes
+		}
+
+		if c.Quotas != nil {
+			tenant.quotas = *c.Quotas
+		}
+
+		tenant.Image = open(c, tenant.contentTypes)
+		tenant.usage = newUsageTracker(tenant.Image)
+
+		t.byID[c.ID] = tenant
+		for _, h := range c.Hosts {
+			t.byHost[strings.ToLower(h)] = tenant
+		}
+	}
+
+	return t
+}
+
+// resolve returns the tenant of the request. The tenant is named by the request header or the ?tenant= query
+// parameter, which links followed by browsers rely on, and by the hostname. Credentials bound to a tenant
+// cannot access another one, credentials bound to none can only access the default tenant.
+// Anonymous requests may name any tenant, anonymous scopes are granted on every tenant.
+// Requests naming no tenant get the default tenant.
+func (t *tenants) resolve(r *http.Request, p *Principal) (*tenant, error) {
+	requested := r.Header.Get(t.header)
+	if q := r.URL.Query().Get("tenant"); q != "" {
+		if requested != "" && requested != q {
+			return nil, newBadRequestError(fmt.Errorf("%w: header and query name different tenants", ErrTenantMismatch))
+		}
+		requested = q
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if tenant, ok := t.byHost[strings.ToLower(host)]; ok {
+		if requested != "" && requested != tenant.id {
+			return nil, newBadRequestError(fmt.Errorf("%w: host %s belongs to another tenant", ErrTenantMismatch, host))
+		}
+		requested = tenant.id
+	}
+
+	if p != nil && (p.Tenant != "" || p.Subject != "") {
+		bound := p.Tenant
+		if bound == "" {
+			bound = t.fallback
+		}
+
+		if bound == "" {
+			return nil, newForbiddenError(fmt.Errorf("%w: credentials are not bound to any tenant", ErrTenantMismatch))
+		}
+
+		if requested != "" && requested != bound {
+			return nil, newForbiddenError(fmt.Errorf("%w: credentials are bound to another tenant", ErrTenantMismatch))
+		}
+		requested = bound
+	}
+
+	if requested == "" {
+		requested = t.fallback
+	}
+
+	if requested == "" {
+		return nil, newBadRequestError(ErrTenantRequired)
+	}
+
+	tenant, ok := t.byID[requested]
+	if !ok {
+		return nil, newBadRequestError(fmt.Errorf("%w: %q", ErrUnknownTenant, requested))
+	}
+
+	return tenant, nil
+}
+
+// ResolveTenant sets the *tenant of the request into context, see tenants.resolve.
+// It must run after Authenticate on authenticated routes.
+func (s *server) ResolveTenant(c *gin.Context) {
+	if s.tenants == nil {
+		return
+	}
+
+	t, err := s.tenants.resolve(c.Request, principal(c))
+	if err != nil {
+		_ = c.Error(err)
+		c.Abort()
+		return
+	}
+
+	c.Set(TenantContextKey, t)
+}
+
+// tenant returns the tenant of the request, the implicit tenant of single tenant servers by default
+func (s *server) tenant(c *gin.Context) *tenant {
+	if c != nil {
+		if v, ok := c.Get(TenantContextKey); ok {
+			return v.(*tenant)
+		}
+	}
+
+	return &tenant{
+		Image:        s.Image,
+		limits:       s.limits,
+		contentTypes: s.contentTypes,
+		watermark:    s.watermark,
+		quotas:       s.quotas,
+		usage:        s.usage,
+	}
+}
@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenancyConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TenancyConfig
+		wantErr bool
+	}{
+		{name: "Disabled", config: TenancyConfig{}},
+		{
+			name: "Own buckets",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "marketing"},
+				{ID: "sales", Bucket: "sales"},
+			}, Default: "sales"},
+		},
+		{
+			name: "Shared bucket",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "images", Prefix: "marketing/"},
+				{ID: "sales", Bucket: "images", Prefix: "sales/"},
+			}},
+		},
+		{
+			name: "Shared bucket without prefix",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "images"},
+				{ID: "sales", Bucket: "images", Prefix: "sales/"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "Overlapping prefixes",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "images", Prefix: "eu/"},
+				{ID: "sales", Bucket: "images", Prefix: "eu/sales/"},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "Prefix without slash",
+			config:  TenancyConfig{Tenants: []TenantConfig{{ID: "marketing", Bucket: "images", Prefix: "marketing"}}},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid id",
+			config:  TenancyConfig{Tenants: []TenantConfig{{ID: "Marketing Team", Bucket: "images"}}},
+			wantErr: true,
+		},
+		{
+			name: "Duplicate id",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "a"},
+				{ID: "marketing", Bucket: "b"},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "Duplicate host",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "a", Hosts: []string{"img.example.com"}},
+				{ID: "sales", Bucket: "b", Hosts: []string{"IMG.example.com"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "API key bound twice",
+			config: TenancyConfig{Tenants: []TenantConfig{
+				{ID: "marketing", Bucket: "a", APIKeys: []string{"ci"}},
+				{ID: "sales", Bucket: "b", APIKeys: []string{"ci"}},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown default",
+			config:  TenancyConfig{Tenants: []TenantConfig{{ID: "marketing", Bucket: "a"}}, Default: "sales"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidTenantConfig)
+			}
+		})
+	}
+}
+
+func Test_tenancyFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	data := `{
+		"tenants": [
+			{"id": "marketing", "prefix": "marketing/", "hosts": ["img.marketing.example.com"], "limits": {"max_bytes": 1024}},
+			{"id": "sales", "prefix": "sales/", "api_keys": ["sales-ci"], "content_types": ["image/png"], "quotas": {"tenant": {"max_bytes": 2048}}}
+		],
+		"default": "marketing"
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TENANTS_FILE", path)
+	defer os.Unsetenv("TENANTS_FILE")
+
+	got, err := tenancyFromEnv(defaultTenancyConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, got.validate())
+	assert.Equal(t, defaultTenantHeader, got.Header)
+	assert.Equal(t, "marketing", got.Default)
+	assert.Len(t, got.Tenants, 2)
+
+	got.setDefaults(bucketNameImages)
+	assert.Equal(t, bucketNameImages, got.Tenants[0].Bucket)
+	assert.Equal(t, int64(1024), got.Tenants[0].Limits.MaxBytes)
+	assert.Equal(t, map[string]string{"sales-ci": "sales"}, got.apiKeyTenants())
+
+	tenants := newTenants(got, &tenant{quotas: QuotaConfig{User: Quota{MaxObjects: 10}}}, func(TenantConfig, []string) ImageService { return nil })
+	assert.Equal(t, QuotaConfig{User: Quota{MaxObjects: 10}}, tenants.byID["marketing"].quotas)
+	assert.Equal(t, QuotaConfig{Tenant: Quota{MaxBytes: 2048}}, tenants.byID["sales"].quotas, "tenant quotas replace the server ones")
+}
+
+func Test_tenants_resolve(t *testing.T) {
+	config := TenancyConfig{
+		Header: defaultTenantHeader,
+		Tenants: []TenantConfig{
+			{ID: "marketing", Hosts: []string{"img.marketing.example.com"}},
+			{ID: "sales"},
+		},
+	}
+
+	open := func(TenantConfig, []string) ImageService { return new(testingImageService) }
+	withDefault := config
+	withDefault.Default = "sales"
+
+	tests := []struct {
+		name      string
+		config    TenancyConfig
+		target    string
+		header    string
+		host      string
+		principal *Principal
+		want      string
+		wantCode  int
+	}{
+		{name: "Header", config: config, header: "sales", want: "sales"},
+		{name: "Query", config: config, target: "/?tenant=sales", want: "sales"},
+		{name: "Header and query disagree", config: config, target: "/?tenant=marketing", header: "sales", wantCode: 400},
+		{name: "Host", config: config, host: "img.marketing.example.com:8080", want: "marketing"},
+		{name: "Host and header disagree", config: config, host: "img.marketing.example.com", header: "sales", wantCode: 400},
+		{name: "Claim", config: config, principal: &Principal{Subject: "bob", Tenant: "sales"}, want: "sales"},
+		{name: "Claim and header agree", config: config, principal: &Principal{Tenant: "sales"}, header: "sales", want: "sales"},
+		{name: "Claim and header disagree", config: config, principal: &Principal{Tenant: "sales"}, header: "marketing", wantCode: 403},
+		{name: "Claim and host disagree", config: config, principal: &Principal{Tenant: "sales"}, host: "img.marketing.example.com", wantCode: 403},
+		{name: "Unbound credentials get the default tenant", config: withDefault, principal: &Principal{Subject: "bob"}, want: "sales"},
+		{name: "Unbound credentials cannot switch tenant", config: withDefault, principal: &Principal{Subject: "bob"}, header: "marketing", wantCode: 403},
+		{name: "Unbound credentials cannot switch tenant by query", config: withDefault, principal: &Principal{Subject: "bob"}, target: "/?tenant=marketing", wantCode: 403},
+		{name: "Unbound credentials without default", config: config, principal: &Principal{Subject: "bob"}, header: "sales", wantCode: 403},
+		{name: "Anonymous", config: withDefault, principal: &Principal{}, header: "marketing", want: "marketing"},
+		{name: "Default", config: withDefault, want: "sales"},
+		{name: "Required", config: config, wantCode: 400},
+		{name: "Unknown", config: config, header: "support", wantCode: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenants := newTenants(tt.config, &tenant{limits: defaultUploadLimits()}, open)
+
+			if tt.target == "" {
+				tt.target = "/"
+			}
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(defaultTenantHeader, tt.header)
+			}
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+
+			got, err := tenants.resolve(req, tt.principal)
+			if tt.wantCode != 0 {
+				if assert.IsType(t, &Error{}, err) {
+					assert.Equal(t, tt.wantCode, err.(*Error).Code)
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.id)
+		})
+	}
+}
+
+func Test_server_tenantIsolation(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, fake := newTestingMinio(t, "images")
+	config := TenancyConfig{
+		Header: defaultTenantHeader,
+		Tenants: []TenantConfig{
+			{ID: "marketing", Bucket: "images", Prefix: "marketing/"},
+			{ID: "sales", Bucket: "images", Prefix: "sales/", Limits: &UploadLimits{MaxBytes: 16}},
+		},
+	}
+
+	s := &server{
+		router: gin.New(),
+		auth:   &authenticator{anonymous: []string{scopeImagesRead, scopeImagesWrite, scopeImagesDelete, scopeImagesAdmin}},
+		links:  testingLinks,
+	}
+	s.tenants = newTenants(config, &tenant{limits: defaultUploadLimits(), contentTypes: defaultContentTypes}, func(c TenantConfig, contentTypes []string) ImageService {
+		return &imageService{Minio: client, ContentTypes: contentTypes, Prefix: c.Prefix}
+	})
+	s.routes()
+
+	do := func(method, target, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if method == "POST" {
+			req = makeUploadRequest(t, target, "gopher.png", "image/png", gopher, nil)
+		}
+		req.Header.Set(defaultTenantHeader, tenant)
+
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := do("POST", "/images", "marketing")
+	assert.Equal(t, 201, rw.Code, rw.Body.String())
+
+	var created Image
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &created))
+	for _, k := range fake.keys("images") {
+		assert.Regexp(t, "^marketing/", k, "objects are stored under the tenant prefix")
+	}
+
+	assert.Equal(t, 413, do("POST", "/images", "sales").Code, "tenants have their own limits")
+
+	assert.Equal(t, 200, do("GET", "/images/"+created.Key.String(), "marketing").Code)
+	assert.Equal(t, 404, do("GET", "/images/"+created.Key.String(), "sales").Code)
+	assert.Equal(t, 404, do("GET", "/images/"+created.Key.String()+"/download", "sales").Code)
+
+	rw = do("GET", "/images", "sales")
+	assert.Equal(t, 200, rw.Code)
+	assert.JSONEq(t, "[]", rw.Body.String())
+
+	rw = do("GET", "/images", "marketing")
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), created.Key.String())
+
+	// Signed links name the tenant, and are only valid for it
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", created.DownloadURL, nil))
+	assert.Equal(t, 200, rw.Code, created.DownloadURL)
+	assert.True(t, bytes.Equal(gopher, rw.Body.Bytes()))
+
+	rw = do("GET", created.DownloadURL, "sales")
+	assert.Equal(t, 400, rw.Code, "link tenant and header disagree")
+
+	// Deleting from another tenant does not touch the image
+	assert.Equal(t, 404, do("DELETE", "/images/"+created.Key.String(), "sales").Code)
+	_, err = s.tenants.byID["marketing"].Image.Get(context.TODO(), created.Key)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 204, do("DELETE", "/images/"+created.Key.String(), "marketing").Code)
+	assert.Empty(t, fake.keys("images"))
+}
+
+func Test_authenticator_keyTenants(t *testing.T) {
+	a := &authenticator{apiKeys: make(map[string]*APIKey), keyTenants: map[string]string{"sales-ci": "sales"}}
+	key := uuid.NewString()
+	a.apiKeys[hashKey(key)] = &APIKey{Name: "sales-ci", Scopes: []string{scopeImagesRead}}
+
+	p, err := a.authenticate(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "sales", p.Tenant)
+}
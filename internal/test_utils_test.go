@@ -1,9 +1,19 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
@@ -48,6 +58,24 @@ func (t *testingImageService) List(ctx context.Context) ([]*Image, error) {
 	return res, nil
 }
 
+func (t *testingImageService) Update(ctx context.Context, image *Image) (*Image, error) {
+	if _, ok := images[image.Key]; !ok {
+		return nil, ErrImageNotFound
+	}
+
+	images[image.Key] = image
+	return image, nil
+}
+
+func (t *testingImageService) Similar(ctx context.Context, image *Image, maxDistance int) ([]*similarImage, error) {
+	candidates, err := t.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return findSimilar(candidates, image, maxDistance), nil
+}
+
 func (t *testingImageService) Delete(ctx context.Context, ids ...uuid.UUID) error {
 	for _, id := range ids {
 		if _, ok := images[id]; !ok {
@@ -59,3 +87,77 @@ func (t *testingImageService) Delete(ctx context.Context, ids ...uuid.UUID) erro
 
 	return nil
 }
+
+// withPrincipal authenticates requests as given Principal
+func withPrincipal(p *Principal) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(PrincipalContextKey, p)
+	}
+}
+
+// testingLinks signs links with a fixed key
+var testingLinks = newLinkSigner(LinkConfig{Key: strings.Repeat("k", 32), TTL: time.Minute})
+
+// admin can access every image
+var admin = &Principal{Subject: "admin", Scopes: []string{scopeImagesAdmin}}
+
+// serveRequest serves a request to s
+func serveRequest(s *server, method, target, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rr
+}
+
+// makeUploadRequest builds a multipart request uploading given content as 'file', along with other form fields
+func makeUploadRequest(t *testing.T, target string, filename string, contentType string, content []byte, fields map[string]string) *http.Request {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for k, v := range fields {
+		if err := writer.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, filename))
+	h.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", target, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// findSimilar returns candidates having the content of given image or looking like it within maxDistance,
+// closest first, as imageService.Similar does
+func findSimilar(candidates []*Image, to *Image, maxDistance int) []*similarImage {
+	similar := make([]*similarImage, 0)
+	for _, i := range candidates {
+		if i.Key == to.Key {
+			continue
+		}
+
+		switch d, ok := hashDistance(to.PerceptualHash, i.PerceptualHash); {
+		case to.SHA256 != "" && i.SHA256 == to.SHA256:
+			similar = append(similar, &similarImage{Image: i, Distance: 0})
+		case ok && d <= maxDistance:
+			similar = append(similar, &similarImage{Image: i, Distance: d})
+		}
+	}
+
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].Distance < similar[j].Distance })
+	return similar
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span exporters, see TracingConfig
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+)
+
+// ErrInvalidTracingConfig tracing configuration is invalid
+var ErrInvalidTracingConfig = errors.New("invalid tracing configuration")
+
+// propagator reads and writes W3C trace context and baggage headers
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer starts the spans of the server, they are not recorded until setupTracing
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/SkYNewZ/images-server/internal")
+}
+
+// TracingConfig describes how spans are exported
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`     // "otlp", "stdout" for local use, spans are not recorded when empty
+	Endpoint    string  `yaml:"endpoint"`     // host:port of the OTLP/HTTP collector, $OTEL_EXPORTER_OTLP_ENDPOINT by default
+	Insecure    bool    `yaml:"insecure"`     // export to the collector without TLS
+	ServiceName string  `yaml:"service_name"` // resource of the spans
+	SampleRatio float64 `yaml:"sample_ratio"` // of traces started here, callers decide for the traces they started
+}
+
+// defaultTracingConfig returns the options used when nothing is configured
+func defaultTracingConfig() TracingConfig {
+	return TracingConfig{
+		ServiceName: "images-server",
+		SampleRatio: 1,
+	}
+}
+
+// tracingFromEnv reads TracingConfig from $TRACING_EXPORTER, $TRACING_ENDPOINT, $TRACING_INSECURE,
+// $TRACING_SERVICE_NAME and $TRACING_SAMPLE_RATIO, starting from t
+func tracingFromEnv(t TracingConfig) (TracingConfig, error) {
+	strs := map[string]*string{
+		"TRACING_EXPORTER":     &t.Exporter,
+		"TRACING_ENDPOINT":     &t.Endpoint,
+		"TRACING_SERVICE_NAME": &t.ServiceName,
+	}
+	for k, p := range strs {
+		if v, ok := os.LookupEnv(k); ok {
+			*p = v
+		}
+	}
+
+	if v, ok := os.LookupEnv("TRACING_INSECURE"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return t, fmt.Errorf("invalid $TRACING_INSECURE: %w", err)
+		}
+		t.Insecure = b
+	}
+
+	if v, ok := os.LookupEnv("TRACING_SAMPLE_RATIO"); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return t, fmt.Errorf("invalid $TRACING_SAMPLE_RATIO: %w", err)
+		}
+		t.SampleRatio = f
+	}
+
+	return t, nil
+}
+
+func (t TracingConfig) validate() error {
+	switch t.Exporter {
+	case "", tracingExporterOTLP, tracingExporterStdout:
+	default:
+		return fmt.Errorf("%w: unknown exporter %q, expected %q or %q", ErrInvalidTracingConfig, t.Exporter, tracingExporterOTLP, tracingExporterStdout)
+	}
+
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		return fmt.Errorf("%w: sample ratio must be between 0 and 1", ErrInvalidTracingConfig)
+	}
+
+	return nil
+}
+
+// setupTracing exports the spans of the server as configured, and returns the function flushing them on shutdown
+func setupTracing(config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case tracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot create %s span exporter: %w", config.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(config.ServiceName),
+			semconv.ServiceVersionKey.String(buildNumber),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Trace starts a span for every request, continuing the trace of the caller given by W3C trace context headers.
+// Handlers find the span in the request context.
+func (s *server) Trace(c *gin.Context) {
+	ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+	route := c.FullPath()
+	name := route
+	if name == "" {
+		name = "unmatched"
+	}
+
+	ctx, span := tracer().Start(ctx, c.Request.Method+" "+name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("images-server", route, c.Request)...),
+	)
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	if len(c.Errors) > 0 {
+		span.SetAttributes(attribute.String("gin.errors", c.Errors.String()))
+	}
+}
+
+// startSpan starts the span of a call to the storage about key, see endSpan
+func (i *imageService) startSpan(ctx context.Context, operation string, key string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("storage.bucket", i.Minio.BucketName),
+			attribute.String("storage.key", key),
+		),
+	)
+}
+
+// endSpan ends the span, recording err
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
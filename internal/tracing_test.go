@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans records the spans ended during the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return recorder
+}
+
+// spanNames returns the names of the spans, by end order
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	names := make([]string, 0, len(spans))
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+
+	return names
+}
+
+func Test_tracingFromEnv(t *testing.T) {
+	os.Setenv("TRACING_EXPORTER", "stdout")
+	os.Setenv("TRACING_SAMPLE_RATIO", "0.5")
+	defer os.Unsetenv("TRACING_EXPORTER")
+	defer os.Unsetenv("TRACING_SAMPLE_RATIO")
+
+	got, err := tracingFromEnv(defaultTracingConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, got.validate())
+	assert.Equal(t, TracingConfig{Exporter: "stdout", ServiceName: "images-server", SampleRatio: 0.5}, got)
+
+	os.Setenv("TRACING_EXPORTER", "jaeger")
+	got, err = tracingFromEnv(defaultTracingConfig())
+	assert.NoError(t, err)
+	assert.ErrorIs(t, got.validate(), ErrInvalidTracingConfig)
+}
+
+func Test_server_Trace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	s := &server{router: gin.New()}
+	s.router.Use(s.Trace)
+	s.router.GET("/images/:image", func(c *gin.Context) {
+		_, span := tracer().Start(c.Request.Context(), "handler")
+		span.End()
+		c.Status(404)
+	})
+
+	req := httptest.NewRequest("GET", "/images/foo", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if assert.Equal(t, []string{"handler", "GET /images/:image"}, spanNames(spans)) {
+		server := spans[1]
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String(), "the trace of the caller is continued")
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+		assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+		assert.Equal(t, server.SpanContext().SpanID(), spans[0].Parent().SpanID(), "handlers find the span in the request context")
+	}
+}
+
+func Test_instrumentedImages_spans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	client, _ := newTestingMinio(t, "images")
+	images := newMetrics().images(&imageService{Minio: client, ContentTypes: defaultContentTypes})
+
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := images.Create(context.Background(), &Image{
+		Key:         uuid.New(),
+		ContentType: "image/png",
+		Content:     bytes.NewReader(gopher),
+		Size:        int64(len(gopher)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, images.Delete(context.Background(), image.Key))
+
+	names := spanNames(recorder.Ended())
+	assert.Contains(t, names, "PutObjectWithContext")
+	assert.Contains(t, names, "RemoveObjectsWithContext")
+	assert.Contains(t, names, "ListObjectsV2")
+	assert.Contains(t, names, "StatObject")
+	assert.Contains(t, names, "ImageService.Create")
+	assert.Contains(t, names, "ImageService.Delete")
+
+	// Storage calls are children of the operation
+	for _, s := range recorder.Ended() {
+		if s.Name() == "PutObjectWithContext" || s.Name() == "StatObject" {
+			assert.True(t, s.Parent().IsValid())
+			assert.Equal(t, "images", attributeValue(s, "storage.bucket"))
+		}
+	}
+}
+
+// attributeValue returns the value of the attribute of the span
+func attributeValue(s sdktrace.ReadOnlySpan, key string) string {
+	for _, a := range s.Attributes() {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+
+	return ""
+}
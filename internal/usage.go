@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usageRefreshInterval is how often usage is recomputed from the storage.
+// Between refreshes it is updated by this process only, so replicas may see slightly outdated usage.
+const usageRefreshInterval = 5 * time.Minute
+
+var (
+	// ErrQuotaExceeded storing the image would exceed the tenant quota
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+	// ErrUserQuotaExceeded storing the image would exceed the quota of its owner
+	ErrUserQuotaExceeded = errors.New("user storage quota exceeded")
+)
+
+// Quota bounds the storage consumption, a zero value disables the corresponding check
+type Quota struct {
+	MaxBytes   int64 `json:"max_bytes" yaml:"max_bytes"`
+	MaxObjects int64 `json:"max_objects" yaml:"max_objects"`
+}
+
+// QuotaConfig describes the quotas of a tenant
+type QuotaConfig struct {
+	Tenant Quota `json:"tenant" yaml:"tenant"` // every image of the tenant
+	User   Quota `json:"user" yaml:"user"`     // images of each owner
+}
+
+// quotasFromEnv reads QuotaConfig from $QUOTA_MAX_BYTES, $QUOTA_MAX_OBJECTS, $QUOTA_USER_MAX_BYTES
+// and $QUOTA_USER_MAX_OBJECTS, starting from q. Nothing is limited by default.
+func quotasFromEnv(q QuotaConfig) (QuotaConfig, error) {
+	int64s := map[string]*int64{
+		"QUOTA_MAX_BYTES":        &q.Tenant.MaxBytes,
+		"QUOTA_MAX_OBJECTS":      &q.Tenant.MaxObjects,
+		"QUOTA_USER_MAX_BYTES":   &q.User.MaxBytes,
+		"QUOTA_USER_MAX_OBJECTS": &q.User.MaxObjects,
+	}
+	for k, p := range int64s {
+		if v, ok := os.LookupEnv(k); ok {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return q, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = i
+		}
+	}
+
+	return q, nil
+}
+
+// Usage is the storage consumption of a tenant or an owner. Bytes are the sizes of the images,
+// content stored once for several images is charged to each of them.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// add returns the usage after storing an image of the given size, or removing it when count is negative
+func (u Usage) add(size int64, count int64) Usage {
+	return Usage{Bytes: u.Bytes + count*size, Objects: u.Objects + count}
+}
+
+// allows tells whether the usage fits in the quota
+func (q Quota) allows(u Usage) bool {
+	return (q.MaxBytes <= 0 || u.Bytes <= q.MaxBytes) && (q.MaxObjects <= 0 || u.Objects <= q.MaxObjects)
+}
+
+// usageTracker keeps the usage of a tenant in memory, by owner
+type usageTracker struct {
+	images ImageService
+
+	mu       sync.Mutex
+	total    Usage
+	owners   map[string]Usage
+	computed time.Time
+	now      func() time.Time
+
+	// refreshing is closed when the running refresh ends, nil when not refreshing
+	refreshing chan struct{}
+	// changes are the reservations and removals made during the running refresh, applied to its result
+	changes []usageChange
+}
+
+// usageChange is an image accounted for, or removed when count is negative
+type usageChange struct {
+	owner string
+	size  int64
+	count int64
+}
+
+func newUsageTracker(images ImageService) *usageTracker {
+	return &usageTracker{images: images, now: time.Now}
+}
+
+// refresh recomputes the usage from the storage when it is outdated. The storage is listed without holding
+// u.mu: outdated usage is used meanwhile, only the first computation is waited for.
+func (u *usageTracker) refresh(ctx context.Context) error {
+	u.mu.Lock()
+	if u.owners != nil && u.now().Sub(u.computed) < usageRefreshInterval {
+		u.mu.Unlock()
+		return nil
+	}
+
+	if refreshing := u.refreshing; refreshing != nil {
+		computed := u.owners != nil
+		u.mu.Unlock()
+		if computed {
+			return nil // outdated usage is good enough while refreshing
+		}
+
+		select {
+		case <-refreshing:
+			return u.refresh(ctx)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	u.refreshing = make(chan struct{})
+	u.mu.Unlock()
+
+	images, err := u.images.List(ctx)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil {
+		total, owners := Usage{}, make(map[string]Usage)
+		for _, i := range images {
+			total = total.add(i.Size, 1)
+			owners[i.Owner] = owners[i.Owner].add(i.Size, 1)
+		}
+
+		for _, c := range u.changes {
+			total = total.add(c.size, c.count)
+			owners[c.owner] = owners[c.owner].add(c.size, c.count)
+		}
+
+		u.total, u.owners, u.computed = total, owners, u.now()
+	}
+
+	close(u.refreshing)
+	u.refreshing, u.changes = nil, nil
+	return err
+}
+
+// apply accounts for a change, u.mu must be held
+func (u *usageTracker) apply(c usageChange) {
+	if u.refreshing != nil {
+		u.changes = append(u.changes, c)
+	}
+
+	if u.owners == nil {
+		return // not computed yet, the running refresh applies the change
+	}
+
+	u.total = u.total.add(c.size, c.count)
+	u.owners[c.owner] = u.owners[c.owner].add(c.size, c.count)
+}
+
+// snapshot returns the usage of the tenant and of each owner
+func (u *usageTracker) snapshot(ctx context.Context) (Usage, map[string]Usage, error) {
+	if err := u.refresh(ctx); err != nil {
+		return Usage{}, nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	owners := make(map[string]Usage, len(u.owners))
+	for k, v := range u.owners {
+		owners[k] = v
+	}
+
+	return u.total, owners, nil
+}
+
+// reserve accounts for a new image of the owner, unless it would exceed the quotas.
+// The returned function cancels the reservation when the image cannot be stored.
+// A nil tracker does not account for anything.
+func (u *usageTracker) reserve(ctx context.Context, quotas QuotaConfig, owner string, size int64) (func(), error) {
+	if u == nil {
+		return func() {}, nil
+	}
+
+	if err := u.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	total, own := u.total.add(size, 1), u.owners[owner].add(size, 1)
+	if !quotas.Tenant.allows(total) {
+		return nil, fmt.Errorf("%w: %d of %d bytes and %d of %d images are used", ErrQuotaExceeded,
+			u.total.Bytes, quotas.Tenant.MaxBytes, u.total.Objects, quotas.Tenant.MaxObjects)
+	}
+
+	if owner != "" && !quotas.User.allows(own) {
+		return nil, fmt.Errorf("%w: %d of %d bytes and %d of %d images are used", ErrUserQuotaExceeded,
+			u.owners[owner].Bytes, quotas.User.MaxBytes, u.owners[owner].Objects, quotas.User.MaxObjects)
+	}
+
+	u.apply(usageChange{owner: owner, size: size, count: 1})
+	return func() { u.remove(owner, size) }, nil
+}
+
+// remove accounts for a deleted image
+func (u *usageTracker) remove(owner string, size int64) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.apply(usageChange{owner: owner, size: size, count: -1})
+}
+
+// newQuotaError returns an HTTP 507 error when the tenant is full, HTTP 403 when the owner is
+func newQuotaError(err error) error {
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return newInsufficientStorageError(err)
+	case errors.Is(err, ErrUserQuotaExceeded):
+		return newForbiddenError(err)
+	default:
+		return err
+	}
+}
+
+// usageReport is the response of handleUsage
+type usageReport struct {
+	Tenant string       `json:"tenant,omitempty"`
+	Total  quotaUsage   `json:"total"`
+	User   *ownerUsage  `json:"user,omitempty"`
+	Owners []ownerUsage `json:"owners,omitempty"` // admins only
+}
+
+type quotaUsage struct {
+	Usage
+	Limits Quota `json:"limits"`
+}
+
+type ownerUsage struct {
+	Owner string `json:"owner"`
+	quotaUsage
+}
+
+// handleUsage reports the storage consumption of the tenant and of the caller, along with their quotas.
+// Admins get the consumption of every owner.
+func (s *server) handleUsage(c *gin.Context) {
+	t := s.tenant(c)
+	total, owners, err := t.usage.snapshot(c.Request.Context())
+	if err != nil {
+		_ = c.Error(err)
+		return
+	}
+
+	report := usageReport{
+		Tenant: t.id,
+		Total:  quotaUsage{Usage: total, Limits: t.quotas.Tenant},
+	}
+
+	p := principal(c)
+	if subject := p.subject(); subject != "" {
+		report.User = &ownerUsage{Owner: subject, quotaUsage: quotaUsage{Usage: owners[subject], Limits: t.quotas.User}}
+	}
+
+	if p != nil && p.can(scopeImagesAdmin) {
+		report.Owners = make([]ownerUsage, 0, len(owners))
+		for owner, usage := range owners {
+			report.Owners = append(report.Owners, ownerUsage{Owner: owner, quotaUsage: quotaUsage{Usage: usage, Limits: t.quotas.User}})
+		}
+		sort.Slice(report.Owners, func(i, j int) bool { return report.Owners[i].Bytes > report.Owners[j].Bytes })
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota_allows(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota Quota
+		usage Usage
+		want  bool
+	}{
+		{name: "Unlimited", quota: Quota{}, usage: Usage{Bytes: 1 << 40, Objects: 1 << 20}, want: true},
+		{name: "Within", quota: Quota{MaxBytes: 100, MaxObjects: 2}, usage: Usage{Bytes: 100, Objects: 2}, want: true},
+		{name: "Too many bytes", quota: Quota{MaxBytes: 100}, usage: Usage{Bytes: 101, Objects: 1}, want: false},
+		{name: "Too many objects", quota: Quota{MaxObjects: 2}, usage: Usage{Bytes: 1, Objects: 3}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.quota.allows(tt.usage))
+		})
+	}
+}
+
+func Test_quotasFromEnv(t *testing.T) {
+	os.Setenv("QUOTA_MAX_BYTES", "1048576")
+	os.Setenv("QUOTA_USER_MAX_OBJECTS", "10")
+	defer os.Unsetenv("QUOTA_MAX_BYTES")
+	defer os.Unsetenv("QUOTA_USER_MAX_OBJECTS")
+
+	got, err := quotasFromEnv(QuotaConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaConfig{Tenant: Quota{MaxBytes: 1 << 20}, User: Quota{MaxObjects: 10}}, got)
+
+	os.Setenv("QUOTA_MAX_BYTES", "lots")
+	_, err = quotasFromEnv(QuotaConfig{})
+	assert.Error(t, err)
+}
+
+func Test_usageTracker(t *testing.T) {
+	client, _ := newTestingMinio(t, "images")
+	service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+	ctx := context.Background()
+
+	for _, owner := range []string{"alice", "alice", "bob"} {
+		if err := service.putRecord(ctx, &Image{Key: uuid.New(), ContentType: "image/png", Owner: owner, SHA256: "00"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	u := newUsageTracker(service)
+	u.now = func() time.Time { return now }
+
+	total, owners, err := u.snapshot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), total.Objects)
+	assert.Equal(t, int64(2), owners["alice"].Objects)
+	assert.Equal(t, int64(1), owners["bob"].Objects)
+
+	quotas := QuotaConfig{Tenant: Quota{MaxObjects: 5}, User: Quota{MaxObjects: 3}}
+
+	release, err := u.reserve(ctx, quotas, "alice", 10)
+	assert.NoError(t, err)
+
+	_, err = u.reserve(ctx, quotas, "alice", 10)
+	assert.ErrorIs(t, err, ErrUserQuotaExceeded)
+
+	_, err = u.reserve(ctx, quotas, "bob", 10)
+	assert.NoError(t, err)
+
+	_, err = u.reserve(ctx, quotas, "carol", 10)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	release()
+	total, owners, _ = u.snapshot(ctx)
+	assert.Equal(t, Usage{Bytes: 10, Objects: 4}, total)
+	assert.Equal(t, int64(2), owners["alice"].Objects)
+
+	u.remove("bob", 10)
+	total, _, _ = u.snapshot(ctx)
+	assert.Equal(t, Usage{Bytes: 0, Objects: 3}, total)
+
+	// Outdated usage is recomputed from the storage
+	u.total = Usage{}
+	u.now = func() time.Time { return now.Add(usageRefreshInterval) }
+	total, _, _ = u.snapshot(ctx)
+	assert.Equal(t, int64(3), total.Objects)
+}
+
+// blockingList blocks List until release is closed, once started is signaled
+type blockingList struct {
+	ImageService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingList) List(ctx context.Context) ([]*Image, error) {
+	if b.release != nil {
+		b.started <- struct{}{}
+		<-b.release
+	}
+	return b.ImageService.List(ctx)
+}
+
+func Test_usageTracker_refresh(t *testing.T) {
+	client, _ := newTestingMinio(t, "images")
+	service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+	ctx := context.Background()
+
+	if err := service.putRecord(ctx, &Image{Key: uuid.New(), ContentType: "image/png", Owner: "alice", SHA256: "00", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	list := &blockingList{ImageService: service}
+	u := newUsageTracker(list)
+	u.now = func() time.Time { return now }
+
+	total, _, err := u.snapshot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{Bytes: 10, Objects: 1}, total)
+
+	list.started, list.release = make(chan struct{}), make(chan struct{})
+	now = now.Add(usageRefreshInterval)
+	refreshed := make(chan error)
+	go func() {
+		_, _, err := u.snapshot(ctx)
+		refreshed <- err
+	}()
+	<-list.started
+
+	// Reservations do not wait for the storage to be listed, and are kept by the refresh
+	_, err = u.reserve(ctx, QuotaConfig{}, "bob", 5)
+	assert.NoError(t, err)
+
+	close(list.release)
+	assert.NoError(t, <-refreshed)
+
+	total, owners, err := u.snapshot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{Bytes: 15, Objects: 2}, total)
+	assert.Equal(t, Usage{Bytes: 5, Objects: 1}, owners["bob"])
+}
+
+func Test_server_quotas(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(gopher))
+
+	tests := []struct {
+		name     string
+		quotas   QuotaConfig
+		wantCode int
+	}{
+		{name: "Unlimited", wantCode: 201},
+		{name: "Tenant is full", quotas: QuotaConfig{Tenant: Quota{MaxBytes: size + 1}}, wantCode: 507},
+		{name: "User is full", quotas: QuotaConfig{User: Quota{MaxObjects: 1}}, wantCode: 403},
+		{name: "Room left", quotas: QuotaConfig{Tenant: Quota{MaxObjects: 2}, User: Quota{MaxBytes: 2 * size}}, wantCode: 201},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestingMinio(t, "images")
+			service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+
+			alice := &Principal{Subject: "alice", Scopes: []string{scopeImagesRead, scopeImagesWrite}}
+			s := &server{
+				router:       gin.New(),
+				Image:        service,
+				limits:       defaultUploadLimits(),
+				contentTypes: defaultContentTypes,
+				links:        testingLinks,
+				quotas:       tt.quotas,
+				usage:        newUsageTracker(service),
+			}
+			s.router.POST("/images", s.handleErrors, withPrincipal(alice), s.handleImagesCreate)
+
+			// alice already stored an image
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, makeUploadRequest(t, "/images", "gopher.png", "image/png", gopher, nil))
+			assert.Equal(t, 201, rw.Code)
+
+			rw = httptest.NewRecorder()
+			s.ServeHTTP(rw, makeUploadRequest(t, "/images", "gopher.png", "image/png", gopher, nil))
+			assert.Equal(t, tt.wantCode, rw.Code, rw.Body.String())
+
+			// Rejected uploads are not accounted for
+			total, _, _ := s.usage.snapshot(context.TODO())
+			if tt.wantCode == 201 {
+				assert.Equal(t, Usage{Bytes: 2 * size, Objects: 2}, total)
+			} else {
+				assert.Equal(t, Usage{Bytes: size, Objects: 1}, total)
+			}
+		})
+	}
+}
+
+func Test_server_handleUsage(t *testing.T) {
+	client, _ := newTestingMinio(t, "images")
+	service := &imageService{Minio: client, ContentTypes: defaultContentTypes}
+	ctx := context.Background()
+
+	for _, i := range []*Image{
+		{Key: uuid.New(), ContentType: "image/png", Owner: "alice", SHA256: "00", Size: 100},
+		{Key: uuid.New(), ContentType: "image/png", Owner: "bob", SHA256: "01", Size: 300},
+	} {
+		if err := service.putRecord(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quotas := QuotaConfig{Tenant: Quota{MaxBytes: 1000}, User: Quota{MaxObjects: 10}}
+	tests := []struct {
+		name      string
+		principal *Principal
+		want      usageReport
+	}{
+		{
+			name:      "User",
+			principal: &Principal{Subject: "alice", Scopes: []string{scopeImagesRead}},
+			want: usageReport{
+				Total: quotaUsage{Usage: Usage{Bytes: 400, Objects: 2}, Limits: quotas.Tenant},
+				User:  &ownerUsage{Owner: "alice", quotaUsage: quotaUsage{Usage: Usage{Bytes: 100, Objects: 1}, Limits: quotas.User}},
+			},
+		},
+		{
+			name:      "Admin",
+			principal: &Principal{Subject: "finance", Scopes: []string{scopeImagesRead, scopeImagesAdmin}},
+			want: usageReport{
+				Total: quotaUsage{Usage: Usage{Bytes: 400, Objects: 2}, Limits: quotas.Tenant},
+				User:  &ownerUsage{Owner: "finance", quotaUsage: quotaUsage{Limits: quotas.User}},
+				Owners: []ownerUsage{
+					{Owner: "bob", quotaUsage: quotaUsage{Usage: Usage{Bytes: 300, Objects: 1}, Limits: quotas.User}},
+					{Owner: "alice", quotaUsage: quotaUsage{Usage: Usage{Bytes: 100, Objects: 1}, Limits: quotas.User}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{router: gin.New(), Image: service, quotas: quotas, usage: newUsageTracker(service)}
+			s.router.GET("/usage", s.handleErrors, withPrincipal(tt.principal), s.handleUsage)
+
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, httptest.NewRequest("GET", "/usage", nil))
+			assert.Equal(t, 200, rw.Code)
+
+			want, _ := json.Marshal(tt.want)
+			assert.JSONEq(t, string(want), rw.Body.String())
+		})
+	}
+}
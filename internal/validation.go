@@ -0,0 +1,472 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidRequest request does not match the OpenAPI document, see ValidateRequest
+var ErrInvalidRequest = errors.New("invalid request")
+
+// openAPIParameter is a path, query or header parameter of an operation
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+// openAPISchema is the subset of JSON schemas used by openapi.json
+type openAPISchema struct {
+	Type       string                    `json:"type"`
+	Format     string                    `json:"format"`
+	Enum       []interface{}             `json:"enum"`
+	Minimum    *float64                  `json:"minimum"`
+	Maximum    *float64                  `json:"maximum"`
+	Required   []string                  `json:"required"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Items      *openAPISchema            `json:"items"`
+	AllOf      []*openAPISchema          `json:"allOf"`
+}
+
+// openAPIOperation describes the requests of a route, see openAPIOperations
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *openAPISchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+var openAPIRequests struct {
+	once       sync.Once
+	operations map[string]*openAPIOperation
+	err        error
+}
+
+// openAPIOperations returns the operations of the OpenAPI document by route, e.g. "GET /v1/images/:image",
+// with the references resolved and the parameters of their path
+func openAPIOperations() (map[string]*openAPIOperation, error) {
+	openAPIRequests.once.Do(func() {
+		openAPIRequests.operations, openAPIRequests.err = parseOpenAPIOperations()
+	})
+
+	return openAPIRequests.operations, openAPIRequests.err
+}
+
+func parseOpenAPIOperations() (map[string]*openAPIOperation, error) {
+	body, err := openAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+
+	resolved, err := json.Marshal(resolveRefs(doc, doc["paths"]))
+	if err != nil {
+		return nil, err
+	}
+
+	var paths map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(resolved, &paths); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+
+	param := regexp.MustCompile(`{(\w+)}`)
+	operations := make(map[string]*openAPIOperation)
+	for path, item := range paths {
+		var shared []*openAPIParameter
+		if v, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(v, &shared); err != nil {
+				return nil, fmt.Errorf("invalid OpenAPI parameters of %s: %w", path, err)
+			}
+		}
+
+		for method, v := range item {
+			if !isOpenAPIMethod(method) {
+				continue
+			}
+
+			op := new(openAPIOperation)
+			if err := json.Unmarshal(v, op); err != nil {
+				return nil, fmt.Errorf("invalid OpenAPI operation %s %s: %w", method, path, err)
+			}
+			op.Parameters = append(shared, op.Parameters...)
+
+			operations[strings.ToUpper(method)+" "+param.ReplaceAllString(path, ":$1")] = op
+		}
+	}
+
+	return operations, nil
+}
+
+// resolveRefs replaces the references of node by the parts of the document they point to
+func resolveRefs(doc map[string]interface{}, node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok {
+			var target interface{} = doc
+			for _, k := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+				m, _ := target.(map[string]interface{})
+				target = m[k]
+			}
+			return resolveRefs(doc, target)
+		}
+
+		resolved := make(map[string]interface{}, len(v))
+		for k, field := range v {
+			resolved[k] = resolveRefs(doc, field)
+		}
+		return resolved
+
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved[i] = resolveRefs(doc, item)
+		}
+		return resolved
+
+	default:
+		return v
+	}
+}
+
+// requestViolations are the parts of a request not matching the OpenAPI document
+type requestViolations []FieldError
+
+func (v requestViolations) Error() string {
+	fields := make([]string, len(v))
+	for i, f := range v {
+		fields[i] = f.Field + " " + f.Message
+	}
+
+	return fmt.Sprintf("%s: %s", ErrInvalidRequest, strings.Join(fields, ", "))
+}
+
+func (v requestViolations) Unwrap() error {
+	return ErrInvalidRequest
+}
+
+// ValidateRequest rejects requests not matching the operation of the route in openapi.json: the parameters,
+// the multipart form of uploads and the JSON bodies are checked against their schema, with an HTTP 400 response
+// listing the violations. Invalid path parameters get an HTTP 404 response, as unknown routes.
+// It runs after LimitUploadSize, bodies are read again by the handlers.
+func (s *server) ValidateRequest(c *gin.Context) {
+	operations, err := openAPIOperations()
+	if err != nil {
+		s.abortWithError(c, err)
+		return
+	}
+
+	op, ok := operations[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		return
+	}
+
+	var violations requestViolations
+	for _, p := range op.Parameters {
+		var values []string
+		switch p.In {
+		case "path":
+			values = []string{c.Param(p.Name)}
+		case "query":
+			values = c.Request.URL.Query()[p.Name]
+		case "header":
+			values = c.Request.Header.Values(p.Name)
+		}
+
+		if len(values) == 0 {
+			if p.Required {
+				violations = append(violations, FieldError{Field: p.Name, Message: "is required"})
+			}
+			continue
+		}
+
+		for _, v := range values {
+			if msg := p.Schema.checkString(v); msg != "" {
+				if p.In == "path" {
+					s.abortWithError(c, newNotFoundError(fmt.Errorf("%w: %s %s", ErrRouteNotFound, p.Name, msg)))
+					return
+				}
+				violations = append(violations, FieldError{Field: p.Name, Message: msg})
+			}
+		}
+	}
+
+	if op.RequestBody != nil {
+		more, err := s.validateBody(c, op)
+		if err != nil {
+			s.abortWithError(c, err)
+			return
+		}
+		violations = append(violations, more...)
+	}
+
+	if len(violations) > 0 {
+		s.abortWithError(c, newBadRequestError(violations))
+	}
+}
+
+// validateBody checks the body of the request against the schema of its content type
+func (s *server) validateBody(c *gin.Context, op *openAPIOperation) (requestViolations, error) {
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if contentType == "" && len(op.RequestBody.Content) == 1 {
+		for t := range op.RequestBody.Content {
+			contentType = t // clients may omit the only content type of the operation
+		}
+	}
+
+	content, ok := op.RequestBody.Content[contentType]
+	if !ok {
+		if c.Request.ContentLength == 0 && !op.RequestBody.Required {
+			return nil, nil
+		}
+
+		types := make([]string, 0, len(op.RequestBody.Content))
+		for t := range op.RequestBody.Content {
+			types = append(types, t)
+		}
+		return nil, newUnsupportedMediaType(fmt.Errorf("%w: %q, expected %s", ErrInvalidRequest, contentType, strings.Join(types, ", ")))
+	}
+
+	if contentType == binding.MIMEMultipartPOSTForm {
+		if err := c.Request.ParseMultipartForm(s.router.MaxMultipartMemory); err != nil {
+			if requestBodyTooLarge(c, err) {
+				return nil, newLimitError(s.tenant(c).limits.errTooLarge())
+			}
+			return nil, newBadRequestError(err)
+		}
+
+		return content.Schema.checkForm(c.Request.MultipartForm.Value, c.Request.MultipartForm.File), nil
+	}
+
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, newBadRequestError(err)
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, newBadRequestError(err)
+	}
+
+	var violations requestViolations
+	content.Schema.checkJSON("", body, &violations)
+	return violations, nil
+}
+
+// checkString checks a parameter or a form value, the message describes the violation, empty when valid
+func (schema *openAPISchema) checkString(v string) string {
+	if schema == nil {
+		return ""
+	}
+
+	var value interface{} = v
+	switch schema.Type {
+	case "integer":
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "must be an integer"
+		}
+		value = float64(i)
+	case "boolean":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return "must be a boolean"
+		}
+		value = b
+	}
+
+	return schema.checkValue(value)
+}
+
+// checkValue checks the format, the enum and the bounds of a decoded value
+func (schema *openAPISchema) checkValue(value interface{}) string {
+	if s, ok := value.(string); ok && schema.Format == "uuid" {
+		if _, err := uuid.Parse(s); err != nil {
+			return "must be an UUID"
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, e := range schema.Enum {
+			found = found || e == value
+		}
+		if !found {
+			allowed := make([]string, len(schema.Enum))
+			for i, e := range schema.Enum {
+				allowed[i] = fmt.Sprint(e)
+			}
+			return fmt.Sprintf("must be one of [%s]", strings.Join(allowed, ", "))
+		}
+	}
+
+	if f, ok := value.(float64); ok {
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return fmt.Sprintf("must be at least %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && f > *schema.Maximum {
+			return fmt.Sprintf("must be at most %v", *schema.Maximum)
+		}
+	}
+
+	return ""
+}
+
+// properties returns the properties of the schema, including the ones of allOf
+func (schema *openAPISchema) properties() (map[string]*openAPISchema, []string) {
+	properties, required := make(map[string]*openAPISchema), schema.Required
+	for k, p := range schema.Properties {
+		properties[k] = p
+	}
+
+	for _, s := range schema.AllOf {
+		more, req := s.properties()
+		for k, p := range more {
+			properties[k] = p
+		}
+		required = append(required, req...)
+	}
+
+	return properties, required
+}
+
+// checkForm checks the fields of a multipart form, binary properties are files
+func (schema *openAPISchema) checkForm(values map[string][]string, files map[string][]*multipart.FileHeader) requestViolations {
+	var violations requestViolations
+	properties, required := schema.properties()
+	for _, name := range required {
+		if len(values[name]) == 0 && len(files[name]) == 0 {
+			violations = append(violations, FieldError{Field: name, Message: "is required"})
+		}
+	}
+
+	for _, name := range sortedKeys(properties) {
+		p := properties[name]
+		if p.Format == "binary" {
+			if len(values[name]) > 0 {
+				violations = append(violations, FieldError{Field: name, Message: "must be a file"})
+			}
+			continue
+		}
+
+		for _, v := range values[name] {
+			if msg := p.checkString(v); msg != "" {
+				violations = append(violations, FieldError{Field: name, Message: msg})
+			}
+		}
+	}
+
+	return violations
+}
+
+// checkJSON checks a decoded JSON value, violations are reported with the path of the field
+func (schema *openAPISchema) checkJSON(field string, value interface{}, violations *requestViolations) {
+	name := field
+	if name == "" {
+		name = "body"
+	}
+	fail := func(msg string) {
+		*violations = append(*violations, FieldError{Field: name, Message: msg})
+	}
+
+	typ := schema.Type
+	if typ == "" && len(schema.AllOf) > 0 {
+		typ = "object"
+	}
+
+	switch typ {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+
+		properties, required := schema.properties()
+		for _, k := range required {
+			if _, ok := object[k]; !ok {
+				*violations = append(*violations, FieldError{Field: fieldPath(field, k), Message: "is required"})
+			}
+		}
+		for _, k := range sortedKeys(properties) {
+			if v, ok := object[k]; ok {
+				properties[k].checkJSON(fieldPath(field, k), v, violations)
+			}
+		}
+		return
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		for i, item := range items {
+			if schema.Items != nil {
+				schema.Items.checkJSON(fmt.Sprintf("%s[%d]", field, i), item, violations)
+			}
+		}
+		return
+
+	case "string":
+		if _, ok := value.(string); !ok {
+			fail("must be a string")
+			return
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean")
+			return
+		}
+	case "integer":
+		if f, ok := value.(float64); !ok || f != float64(int64(f)) {
+			fail("must be an integer")
+			return
+		}
+	}
+
+	if msg := schema.checkValue(value); msg != "" {
+		fail(msg)
+	}
+}
+
+// sortedKeys returns the names of the properties, so that violations are reported in a stable order
+func sortedKeys(properties map[string]*openAPISchema) []string {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fieldPath returns the path of a field of an object, e.g. "[0].permission"
+func fieldPath(field, name string) string {
+	if field == "" {
+		return name
+	}
+
+	return field + "." + name
+}
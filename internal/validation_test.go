@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_server_ValidateRequest(t *testing.T) {
+	s := &server{router: gin.New()}
+	echo := func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Data(200, "text/plain", body)
+	}
+	s.router.POST("/v1/images", s.ValidateRequest, echo)
+	s.router.PATCH("/v1/images/:image", s.ValidateRequest, echo)
+	s.router.GET("/v1/images/:image/download", s.ValidateRequest, echo)
+	s.router.GET("/v1/images/:image/similar", s.ValidateRequest, echo)
+	s.router.PUT("/v1/images/:image/grants", s.ValidateRequest, echo)
+	s.router.GET("/images/:image/download", s.ValidateRequest, echo)
+
+	id := uuid.New().String()
+	json := func(method, target, body string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	form := func(fields map[string]string) *http.Request {
+		return makeUploadRequest(t, "/v1/images", "gopher.png", "image/png", []byte("content"), fields)
+	}
+	withoutFile := func() *http.Request {
+		body := new(bytes.Buffer)
+		w := multipart.NewWriter(body)
+		_ = w.WriteField("name", "gopher")
+		_ = w.Close()
+
+		req := httptest.NewRequest("POST", "/v1/images", body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "Valid parameters",
+			req:      httptest.NewRequest("GET", "/v1/images/"+id+"/download?format=png&quality=50&watermark=true", nil),
+			wantCode: 200,
+		},
+		{
+			name:     "Unknown enum value",
+			req:      httptest.NewRequest("GET", "/v1/images/"+id+"/download?format=webp", nil),
+			wantCode: 400,
+			wantBody: `{"code":400,"error":"validation_failed","message":"validation failed","details":[{"field":"format","message":"must be one of [jpeg, jpg, png]"}]}`,
+		},
+		{
+			name:     "Out of bounds and malformed parameters",
+			req:      httptest.NewRequest("GET", "/v1/images/"+id+"/download?quality=0&watermark=maybe", nil),
+			wantCode: 400,
+			wantBody: `{"code":400,"error":"validation_failed","message":"validation failed","details":[{"field":"quality","message":"must be at least 1"},{"field":"watermark","message":"must be a boolean"}]}`,
+		},
+		{
+			name:     "Not an integer",
+			req:      httptest.NewRequest("GET", "/v1/images/"+id+"/similar?distance=far", nil),
+			wantCode: 400,
+			wantBody: `{"code":400,"error":"validation_failed","message":"validation failed","details":[{"field":"distance","message":"must be an integer"}]}`,
+		},
+		{
+			name:     "Invalid path parameter",
+			req:      httptest.NewRequest("GET", "/v1/images/foo/download", nil),
+			wantCode: 404,
+		},
+		{
+			name:     "Deprecated routes",
+			req:      httptest.NewRequest("GET", "/images/"+id+"/download?format=gif", nil),
+			wantCode: 400,
+		},
+		{
+			name:     "Valid upload",
+			req:      form(map[string]string{"visibility": "public", "on_duplicate": "reject", "watermark": "true"}),
+			wantCode: 200,
+		},
+		{
+			name:     "Invalid upload",
+			req:      form(map[string]string{"visibility": "secret", "on_duplicate": "never"}),
+			wantCode: 400,
+		},
+		{
+			name:     "Upload without file",
+			req:      withoutFile(),
+			wantCode: 400,
+			wantBody: `{"code":400,"error":"validation_failed","message":"validation failed","details":[{"field":"file","message":"is required"}]}`,
+		},
+		{
+			name:     "Upload of another content type",
+			req:      json("POST", "/v1/images", `{"name": "gopher"}`),
+			wantCode: 415,
+		},
+		{
+			name:     "Valid JSON body is read again by the handler",
+			req:      httptest.NewRequest("PATCH", "/v1/images/"+id, strings.NewReader(`{"name": "gopher", "visibility": "public"}`)),
+			wantCode: 200,
+			wantBody: `{"name": "gopher", "visibility": "public"}`,
+		},
+		{
+			name:     "Invalid JSON field",
+			req:      json("PATCH", "/v1/images/"+id, `{"name": 1, "visibility": "secret"}`),
+			wantCode: 400,
+		},
+		{
+			name:     "Malformed JSON",
+			req:      json("PATCH", "/v1/images/"+id, `{"name":`),
+			wantCode: 400,
+		},
+		{
+			name:     "Invalid array items",
+			req:      json("PUT", "/v1/images/"+id+"/grants", `[{"user": "bob", "permission": "read"}, {"user": "carol"}, {"group": "staff", "permission": "admin"}]`),
+			wantCode: 400,
+			wantBody: `{"code":400,"error":"validation_failed","message":"validation failed","details":[{"field":"[1].permission","message":"is required"},{"field":"[2].permission","message":"must be one of [read, write]"}]}`,
+		},
+		{
+			name:     "Not an array",
+			req:      json("PUT", "/v1/images/"+id+"/grants", `{"user": "bob"}`),
+			wantCode: 400,
+			wantBody: `{"code":400,"error":"validation_failed","message":"validation failed","details":[{"field":"body","message":"must be an array"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, tt.req)
+
+			assert.Equal(t, tt.wantCode, rw.Code, rw.Body.String())
+			switch {
+			case tt.wantBody == "":
+			case tt.wantCode == 200:
+				assert.Equal(t, tt.wantBody, rw.Body.String())
+			default:
+				assert.JSONEq(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
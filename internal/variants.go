@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// defaultVariantCacheSize bounds the bytes of converted images kept in memory, see variantCache
+const defaultVariantCacheSize = 64 << 20
+
+// variantKey identifies a conversion of the content of an image
+type variantKey struct {
+	image       uuid.UUID
+	sha256      string
+	contentType string
+	quality     int
+}
+
+// variant is a converted image
+type variant struct {
+	key  variantKey
+	data []byte
+}
+
+// variantCall is a conversion in progress, see variantCache.apply
+type variantCall struct {
+	done    chan struct{}
+	variant *variant
+	err     error
+}
+
+// variantCache keeps converted images, least recently used first evicted, so that each conversion runs once.
+// Concurrent requests of the same conversion wait for the first one.
+type variantCache struct {
+	max int
+
+	mu      sync.Mutex
+	size    int
+	entries map[variantKey]*list.Element
+	lru     *list.List
+	calls   map[variantKey]*variantCall
+}
+
+func newVariantCache(max int) *variantCache {
+	return &variantCache{
+		max:     max,
+		entries: make(map[variantKey]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[variantKey]*variantCall),
+	}
+}
+
+// apply returns the image converted by c, from the cache when possible.
+// Watermarked images are not cached, the watermark can change.
+func (v *variantCache) apply(c conversion, original *Image) (*Image, error) {
+	if v == nil || c.ContentType == "" || c.Watermark != nil {
+		return c.apply(original)
+	}
+
+	key := variantKey{image: original.Key, sha256: original.SHA256, contentType: c.ContentType, quality: c.Quality}
+
+	v.mu.Lock()
+	if e, ok := v.entries[key]; ok {
+		v.lru.MoveToFront(e)
+		v.mu.Unlock()
+		return e.Value.(*variant).image(original), nil
+	}
+
+	if call, ok := v.calls[key]; ok {
+		v.mu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.variant.image(original), nil
+	}
+
+	call := &variantCall{done: make(chan struct{})}
+	v.calls[key] = call
+	v.mu.Unlock()
+
+	call.variant, call.err = v.convert(key, c, original)
+
+	v.mu.Lock()
+	delete(v.calls, key)
+	if call.err == nil {
+		v.add(call.variant)
+	}
+	v.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+
+	return call.variant.image(original), nil
+}
+
+// convert runs the conversion, see conversion.apply
+func (v *variantCache) convert(key variantKey, c conversion, original *Image) (*variant, error) {
+	converted, err := c.apply(original)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(converted.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &variant{key: key, data: data}, nil
+}
+
+// add caches the variant, evicting the least recently used ones beyond the size of the cache, v must be locked
+func (v *variantCache) add(entry *variant) {
+	if len(entry.data) > v.max {
+		return
+	}
+
+	v.entries[entry.key] = v.lru.PushFront(entry)
+	v.size += len(entry.data)
+	for v.size > v.max {
+		oldest := v.lru.Back()
+		evicted := v.lru.Remove(oldest).(*variant)
+		delete(v.entries, evicted.key)
+		v.size -= len(evicted.data)
+	}
+}
+
+// image returns the original Image served as the variant
+func (e *variant) image(original *Image) *Image {
+	converted := *original
+	converted.Content = bytes.NewReader(e.data)
+	converted.ContentType = e.key.contentType
+	converted.Size = int64(len(e.data))
+	converted.Name = convertedName(original.Name, e.key.contentType)
+	return &converted
+}
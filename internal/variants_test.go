@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingContent counts the reads of the content of an image
+type countingContent struct {
+	*bytes.Reader
+	reads int
+}
+
+func (c *countingContent) Read(p []byte) (int, error) {
+	c.reads++
+	return c.Reader.Read(p)
+}
+
+func Test_variantCache_apply(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := uuid.New()
+	original := func(size int64) (*Image, *countingContent) {
+		content := &countingContent{Reader: bytes.NewReader(gopher)}
+		return &Image{Key: key, SHA256: "abc", Name: "gopher.png", ContentType: "image/png", Content: content, Size: size}, content
+	}
+
+	v := newVariantCache(defaultVariantCacheSize)
+	jpeg := conversion{ContentType: "image/jpeg", Quality: 50}
+
+	first, _ := original(int64(len(gopher)))
+	got, err := v.apply(jpeg, first)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", got.ContentType)
+	assert.Equal(t, "gopher.jpg", got.Name)
+	converted, _ := io.ReadAll(got.Content)
+
+	second, content := original(int64(len(gopher)))
+	got, err = v.apply(jpeg, second)
+	assert.NoError(t, err)
+	cached, _ := io.ReadAll(got.Content)
+	assert.Equal(t, converted, cached)
+	assert.Equal(t, int64(len(converted)), got.Size)
+	assert.Zero(t, content.reads, "cached conversions do not decode the original")
+
+	assert.Len(t, v.entries, 1)
+}
+
+func Test_variantCache_apply_concurrent(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := newVariantCache(defaultVariantCacheSize)
+	key := uuid.New()
+
+	var wg sync.WaitGroup
+	reads := make([]*countingContent, 8)
+	for i := range reads {
+		reads[i] = &countingContent{Reader: bytes.NewReader(gopher)}
+		wg.Add(1)
+		go func(content *countingContent) {
+			defer wg.Done()
+			got, err := v.apply(conversion{ContentType: "image/jpeg"}, &Image{Key: key, ContentType: "image/png", Content: content, Size: int64(len(gopher))})
+			assert.NoError(t, err)
+			assert.Equal(t, "image/jpeg", got.ContentType)
+		}(reads[i])
+	}
+	wg.Wait()
+
+	decoded := 0
+	for _, c := range reads {
+		if c.reads > 0 {
+			decoded++
+		}
+	}
+	assert.Equal(t, 1, decoded, "concurrent requests wait for the same conversion")
+}
+
+func Test_variantCache_add(t *testing.T) {
+	v := newVariantCache(10)
+	entry := func(n int) *variant {
+		return &variant{key: variantKey{image: uuid.New()}, data: make([]byte, n)}
+	}
+
+	a, b, c := entry(4), entry(4), entry(4)
+	v.add(a)
+	v.add(b)
+	v.add(c)
+	assert.NotContains(t, v.entries, a.key, "least recently used first evicted")
+	assert.Contains(t, v.entries, b.key)
+	assert.Contains(t, v.entries, c.key)
+	assert.Equal(t, 8, v.size)
+
+	v.add(entry(11))
+	assert.Len(t, v.entries, 2, "variants larger than the cache are not kept")
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIVersionContextKey holds the apiVersion of the route, see apiVersion.bind
+const APIVersionContextKey = "api_version"
+
+// sunsetLayout is the layout of APIConfig.Sunset
+const sunsetLayout = "2006-01-02"
+
+// ErrInvalidAPIConfig API configuration is invalid
+var ErrInvalidAPIConfig = errors.New("invalid API configuration")
+
+// apiV1 is the current version of the API, also served by the deprecated unversioned routes
+var apiV1 = &apiVersion{prefix: "/v1", images: imagesV1{}}
+
+// apiVersion is a version of the API, mounted under its prefix. Versions share the handlers,
+// they differ by the representation of images in responses.
+type apiVersion struct {
+	prefix string
+	images imageRepresentation
+}
+
+// imageRepresentation renders images in the responses of a version of the API
+type imageRepresentation interface {
+	image(image *Image) interface{}
+	similar(image *similarImage) interface{}
+}
+
+// imagesV1 renders images as Image is encoded
+type imagesV1 struct{}
+
+func (imagesV1) image(image *Image) interface{} {
+	return image
+}
+
+func (imagesV1) similar(image *similarImage) interface{} {
+	return image
+}
+
+// bind makes v the version of the routes it applies to, see apiRoutes and versionOf
+func (v *apiVersion) bind(c *gin.Context) {
+	c.Set(APIVersionContextKey, v)
+}
+
+// versionOf returns the version of the route, the current one for routes without version
+func versionOf(c *gin.Context) *apiVersion {
+	if v, ok := c.Get(APIVersionContextKey); ok {
+		return v.(*apiVersion)
+	}
+
+	return apiV1
+}
+
+// APIConfig describes the versions of the API
+type APIConfig struct {
+	// Sunset is the date unversioned routes are removed after, e.g. "2025-06-30", announced by their responses
+	Sunset string `yaml:"sunset"`
+
+	// Docs serves a page rendering the OpenAPI document at /docs, see handleDocs
+	Docs bool `yaml:"docs"`
+}
+
+// apiFromEnv reads APIConfig from $API_SUNSET and $API_DOCS, starting from a
+func apiFromEnv(a APIConfig) (APIConfig, error) {
+	if v, ok := os.LookupEnv("API_SUNSET"); ok {
+		a.Sunset = v
+	}
+
+	if v, ok := os.LookupEnv("API_DOCS"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return a, fmt.Errorf("invalid $API_DOCS: %w", err)
+		}
+		a.Docs = b
+	}
+
+	return a, nil
+}
+
+func (a APIConfig) validate() error {
+	if _, err := a.sunset(); err != nil {
+		return fmt.Errorf("%w: sunset must be a date such as 2025-06-30: %v", ErrInvalidAPIConfig, err)
+	}
+
+	return nil
+}
+
+// sunset returns the end of the Sunset date, zero when not set
+func (a APIConfig) sunset() (time.Time, error) {
+	if a.Sunset == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(sunsetLayout, a.Sunset)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return t.AddDate(0, 0, 1), nil
+}
+
+// Deprecated announces that unversioned routes are deprecated in favor of the version v, and when they are removed
+func (s *server) Deprecated(v *apiVersion) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		if !s.sunset.IsZero() {
+			c.Header("Sunset", s.sunset.UTC().Format(http.TimeFormat))
+		}
+		c.Header("Link", fmt.Sprintf(`<%s%s>; rel="successor-version"`, v.prefix, c.Request.URL.Path))
+	}
+}
+
+// renderImage writes the image in the representation of the version of the route, see redact
+func (s *server) renderImage(c *gin.Context, code int, image *Image) {
+	c.JSON(code, versionOf(c).images.image(s.redact(c, image)))
+}
+
+// renderImages writes the images in the representation of the version of the route, see redact
+func (s *server) renderImages(c *gin.Context, code int, images []*Image) {
+	representation := versionOf(c).images
+	out := make([]interface{}, 0, len(images))
+	for _, i := range images {
+		out = append(out, representation.image(s.redact(c, i)))
+	}
+
+	c.JSON(code, out)
+}
+
+// renderSimilar writes the similar images in the representation of the version of the route, see redact
+func (s *server) renderSimilar(c *gin.Context, code int, images []*similarImage) {
+	representation := versionOf(c).images
+	out := make([]interface{}, 0, len(images))
+	for _, i := range images {
+		out = append(out, representation.similar(&similarImage{Image: s.redact(c, i.Image), Distance: i.Distance}))
+	}
+
+	c.JSON(code, out)
+}
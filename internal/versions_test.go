@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_apiFromEnv(t *testing.T) {
+	os.Setenv("API_SUNSET", "2025-06-30")
+	defer os.Unsetenv("API_SUNSET")
+
+	os.Setenv("API_DOCS", "true")
+	defer os.Unsetenv("API_DOCS")
+
+	got, err := apiFromEnv(APIConfig{})
+	assert.NoError(t, err)
+	assert.NoError(t, got.validate())
+	assert.True(t, got.Docs)
+	sunset, err := got.sunset()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC), sunset, "routes are removed after the sunset day")
+
+	os.Setenv("API_SUNSET", "next year")
+	got, err = apiFromEnv(APIConfig{})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, got.validate(), ErrInvalidAPIConfig)
+
+	os.Setenv("API_DOCS", "sometimes")
+	_, err = apiFromEnv(APIConfig{})
+	assert.Error(t, err)
+}
+
+func Test_server_Deprecated(t *testing.T) {
+	s := &server{router: gin.New(), auth: &authenticator{}, sunset: time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)}
+	s.routes()
+
+	id := uuid.New().String()
+	tests := []struct {
+		name       string
+		target     string
+		deprecated bool
+		wantLink   string
+	}{
+		{name: "Versioned", target: "/v1/images"},
+		{name: "Versioned image", target: "/v1/images/" + id + "/download"},
+		{name: "Versioned usage", target: "/v1/usage"},
+		{name: "Unversioned", target: "/images", deprecated: true, wantLink: `</v1/images>; rel="successor-version"`},
+		{name: "Unversioned image", target: "/images/" + id + "/download", deprecated: true, wantLink: `</v1/images/` + id + `/download>; rel="successor-version"`},
+		{name: "Unversioned usage", target: "/usage", deprecated: true, wantLink: `</v1/usage>; rel="successor-version"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, httptest.NewRequest("GET", tt.target, nil))
+
+			assert.Equal(t, 401, rw.Code, "both are routed to the same handlers")
+			if !tt.deprecated {
+				assert.Empty(t, rw.Header().Get("Deprecation"))
+				assert.Empty(t, rw.Header().Get("Sunset"))
+				return
+			}
+
+			assert.Equal(t, "true", rw.Header().Get("Deprecation"))
+			assert.Equal(t, "Tue, 01 Jul 2025 00:00:00 GMT", rw.Header().Get("Sunset"))
+			assert.Equal(t, tt.wantLink, rw.Header().Get("Link"))
+		})
+	}
+}
+
+// imagesByKey renders images as their key only, as another version could
+type imagesByKey struct{}
+
+func (imagesByKey) image(image *Image) interface{} {
+	return gin.H{"id": image.Key}
+}
+
+func (imagesByKey) similar(image *similarImage) interface{} {
+	return gin.H{"id": image.Key, "distance": image.Distance}
+}
+
+func Test_server_renderImage(t *testing.T) {
+	key := uuid.MustParse("62c1a546-62b6-4cbc-bffb-03919b17dc3a")
+	v2 := &apiVersion{prefix: "/v2", images: imagesByKey{}}
+
+	s := &server{router: gin.New()}
+	handle := func(c *gin.Context) {
+		s.renderSimilar(c, 200, []*similarImage{{Image: &Image{Key: key, Name: "gopher.png"}, Distance: 3}})
+	}
+	s.router.GET("/v1/similar", apiV1.bind, handle)
+	s.router.GET("/v2/similar", v2.bind, handle)
+	s.router.GET("/similar", handle)
+
+	for _, target := range []string{"/v1/similar", "/similar"} {
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, httptest.NewRequest("GET", target, nil))
+		assert.Contains(t, rw.Body.String(), `"name":"gopher.png"`, "routes without version render the current one")
+		assert.Contains(t, rw.Body.String(), `"distance":3`)
+	}
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", "/v2/similar", nil))
+	assert.JSONEq(t, `[{"id":"62c1a546-62b6-4cbc-bffb-03919b17dc3a","distance":3}]`, rw.Body.String())
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported values of Image.Visibility
+const (
+	visibilityPrivate  = "private"  // owner, grantees and admins only
+	visibilityUnlisted = "unlisted" // anyone knowing the link, not listed to others
+	visibilityPublic   = "public"   // anyone, listed to every reader
+)
+
+var (
+	// ErrInvalidVisibility visibility is not one of the supported values
+	ErrInvalidVisibility = errors.New("invalid visibility")
+
+	// ErrInvalidSignature signed link is malformed, tampered with or expired
+	ErrInvalidSignature = errors.New("invalid or expired link")
+
+	// ErrInvalidLinkConfig signed links configuration is invalid
+	ErrInvalidLinkConfig = errors.New("invalid signed links configuration")
+)
+
+// parseVisibility validates a visibility, empty values are private
+func parseVisibility(v string) (string, error) {
+	switch v {
+	case "":
+		return visibilityPrivate, nil
+	case visibilityPrivate, visibilityUnlisted, visibilityPublic:
+		return v, nil
+	default:
+		return "", fmt.Errorf("%w: must be one of [%s, %s, %s]", ErrInvalidVisibility, visibilityPrivate, visibilityUnlisted, visibilityPublic)
+	}
+}
+
+// anonymous tells whether the Image can be read without credentials
+func (i *Image) anonymous() bool {
+	return i.Visibility == visibilityPublic || i.Visibility == visibilityUnlisted
+}
+
+// LinkConfig describes the signed links given for private images
+type LinkConfig struct {
+	Key string        `yaml:"key"` // HMAC key, links signed with another key are rejected
+	TTL time.Duration `yaml:"ttl"` // how long a signed link is valid
+}
+
+// defaultLinkConfig returns the options used when nothing is configured
+func defaultLinkConfig() LinkConfig {
+	return LinkConfig{TTL: 15 * time.Minute}
+}
+
+// linksFromEnv reads LinkConfig from $SIGNED_LINKS_KEY and $SIGNED_LINKS_TTL, starting from l
+func linksFromEnv(l LinkConfig) (LinkConfig, error) {
+	if v, ok := os.LookupEnv("SIGNED_LINKS_TTL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return l, fmt.Errorf("invalid $SIGNED_LINKS_TTL: %w", err)
+		}
+		l.TTL = d
+	}
+
+	if v, ok := os.LookupEnv("SIGNED_LINKS_KEY"); ok {
+		l.Key = v
+	}
+
+	return l, nil
+}
+
+// validate checks the LinkConfig, an empty key is replaced by withKey
+func (l LinkConfig) validate() error {
+	if l.Key != "" && len(l.Key) < 32 {
+		return fmt.Errorf("%w: key must be at least 32 bytes long", ErrInvalidLinkConfig)
+	}
+
+	if l.TTL <= 0 {
+		return fmt.Errorf("%w: TTL must be positive", ErrInvalidLinkConfig)
+	}
+
+	return nil
+}
+
+// linkSigner makes and verifies links to the public download route, see handlePublicDownload
+type linkSigner struct {
+	config LinkConfig
+	now    func() time.Time
+}
+
+// withKey returns the LinkConfig, with a random key when none is configured:
+// links are then invalidated by restarts and not shared between instances.
+func (l LinkConfig) withKey() (LinkConfig, error) {
+	if l.Key != "" {
+		return l, nil
+	}
+
+	log.Warnln("signed links key is not set, signed links will not survive a restart")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return l, err
+	}
+	l.Key = hex.EncodeToString(b)
+
+	return l, nil
+}
+
+func newLinkSigner(config LinkConfig) *linkSigner {
+	return &linkSigner{config: config, now: time.Now}
+}
+
+// publicURL is the stable link of images readable without credentials.
+// Links of images of a tenant name it, see tenants.resolve.
+func publicURL(tenant string, id uuid.UUID) string {
+	u := "/public/images/" + id.String()
+	if tenant != "" {
+		u += "?tenant=" + url.QueryEscape(tenant)
+	}
+
+	return u
+}
+
+// sign returns a link to the image of the tenant valid for the configured TTL
+func (l *linkSigner) sign(tenant string, id uuid.UUID) string {
+	expires := strconv.FormatInt(l.now().Add(l.config.TTL).Unix(), 10)
+
+	q := make(url.Values)
+	if tenant != "" {
+		q.Set("tenant", tenant)
+	}
+	q.Set("expires", expires)
+	q.Set("signature", l.signature(tenant, id, expires))
+	return publicURL("", id) + "?" + q.Encode()
+}
+
+// verify checks a signature made by sign
+func (l *linkSigner) verify(tenant string, id uuid.UUID, expires, signature string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || l.now().Unix() > exp {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(l.signature(tenant, id, expires))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func (l *linkSigner) signature(tenant string, id uuid.UUID, expires string) string {
+	mac := hmac.New(sha256.New, []byte(l.config.Key))
+	mac.Write([]byte(tenant + "\n" + id.String() + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setDownloadURL fills the link given to the caller: public and unlisted images get their stable public link,
+// private ones a short-lived signed link.
+func (s *server) setDownloadURL(c *gin.Context, images ...*Image) {
+	tenant := s.tenant(c).id
+	for _, i := range images {
+		if i.anonymous() {
+			i.DownloadURL = publicURL(tenant, i.Key)
+			continue
+		}
+
+		i.DownloadURL = s.links.sign(tenant, i.Key)
+	}
+}
+
+// signed tells whether the request holds a valid signed link to the image of the route.
+// Malformed or expired signatures are reported as errors.
+func (s *server) signed(c *gin.Context, id uuid.UUID) (bool, error) {
+	signature, ok := c.GetQuery("signature")
+	if !ok {
+		return false, nil
+	}
+
+	if err := s.links.verify(s.tenant(c).id, id, c.Query("expires"), signature); err != nil {
+		return false, newForbiddenError(err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseVisibility(t *testing.T) {
+	for _, v := range []string{visibilityPrivate, visibilityUnlisted, visibilityPublic} {
+		got, err := parseVisibility(v)
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+
+	got, err := parseVisibility("")
+	assert.NoError(t, err)
+	assert.Equal(t, visibilityPrivate, got)
+
+	_, err = parseVisibility("secret")
+	assert.ErrorIs(t, err, ErrInvalidVisibility)
+}
+
+func Test_linkSigner(t *testing.T) {
+	now := time.Now()
+	l := newLinkSigner(LinkConfig{Key: strings.Repeat("k", 32), TTL: time.Minute})
+	l.now = func() time.Time { return now }
+
+	id := uuid.New()
+	u, err := url.Parse(l.sign("", id))
+	assert.NoError(t, err)
+	assert.Equal(t, publicURL("", id), u.Path)
+
+	expires, signature := u.Query().Get("expires"), u.Query().Get("signature")
+	assert.NoError(t, l.verify("", id, expires, signature))
+	assert.ErrorIs(t, l.verify("", uuid.New(), expires, signature), ErrInvalidSignature, "signature is bound to the image")
+	assert.ErrorIs(t, l.verify("", id, expires+"0", signature), ErrInvalidSignature, "expiration cannot be extended")
+	assert.ErrorIs(t, l.verify("", id, "", signature), ErrInvalidSignature)
+	assert.ErrorIs(t, l.verify("other", id, expires, signature), ErrInvalidSignature, "signature is bound to the tenant")
+
+	other := newLinkSigner(LinkConfig{Key: strings.Repeat("o", 32), TTL: time.Minute})
+	assert.ErrorIs(t, other.verify("", id, expires, signature), ErrInvalidSignature, "links are rejected by another key")
+
+	l.now = func() time.Time { return now.Add(2 * time.Minute) }
+	assert.ErrorIs(t, l.verify("", id, expires, signature), ErrInvalidSignature, "links expire")
+}
+
+func TestLinkConfig_validate(t *testing.T) {
+	assert.NoError(t, LinkConfig{Key: strings.Repeat("k", 32), TTL: time.Minute}.validate())
+	assert.ErrorIs(t, LinkConfig{Key: "short", TTL: time.Minute}.validate(), ErrInvalidLinkConfig)
+	assert.ErrorIs(t, LinkConfig{Key: strings.Repeat("k", 32)}.validate(), ErrInvalidLinkConfig)
+}
+
+func Test_server_handlePublicDownload(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		visibility string
+		query      func(id uuid.UUID) string
+		wantCode   int
+	}{
+		{name: "Public", visibility: visibilityPublic, wantCode: 200},
+		{name: "Unlisted", visibility: visibilityUnlisted, wantCode: 200},
+		{name: "Private", visibility: visibilityPrivate, wantCode: 404},
+		{
+			name:       "Private with signed link",
+			visibility: visibilityPrivate,
+			query: func(id uuid.UUID) string {
+				return strings.TrimPrefix(testingLinks.sign("", id), publicURL("", id))
+			},
+			wantCode: 200,
+		},
+		{
+			name:       "Signed link of another image",
+			visibility: visibilityPrivate,
+			query: func(id uuid.UUID) string {
+				u, _ := url.Parse(testingLinks.sign("", uuid.New()))
+				return "?" + u.RawQuery
+			},
+			wantCode: 403,
+		},
+		{
+			name:       "Expired link",
+			visibility: visibilityPublic,
+			query: func(id uuid.UUID) string {
+				return "?expires=1&signature=" + testingLinks.signature("", id, "1")
+			},
+			wantCode: 403,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := new(testingImageService)
+			image, _ := service.Create(context.TODO(), &Image{
+				Key:         uuid.New(),
+				Content:     bytes.NewReader(gopher),
+				ContentType: "image/png",
+				Size:        int64(len(gopher)),
+				Owner:       "alice",
+				Visibility:  tt.visibility,
+			})
+
+			s := &server{router: gin.New(), Image: service, links: testingLinks}
+			s.routes()
+
+			target := publicURL("", image.Key)
+			if tt.query != nil {
+				target += tt.query(image.Key)
+			}
+
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, httptest.NewRequest("GET", target, nil))
+
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if rw.Code == 200 {
+				assert.Equal(t, gopher, rw.Body.Bytes())
+			}
+		})
+	}
+}
+
+func Test_server_handlePublicDownload_svg(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="8" height="8"><script>alert(1)</script><rect width="8" height="8"/></svg>`)
+	id := uuid.New()
+	images[id] = &Image{Key: id, Name: "logo.svg", ContentType: "image/svg+xml", Visibility: visibilityPublic, Content: bytes.NewReader(svg), Size: int64(len(svg))}
+	defer delete(images, id)
+
+	s := &server{router: gin.New(), Image: new(testingImageService), links: testingLinks}
+	s.routes()
+
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", publicURL("", id), nil))
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "image/svg+xml", rw.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=logo.svg`, rw.Header().Get("Content-Disposition"), "SVG are not rendered on our origin")
+	assert.Equal(t, "nosniff", rw.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, imageContentSecurityPolicy, rw.Header().Get("Content-Security-Policy"))
+
+	// Rasterized SVG are images like any other
+	images[id].Content = bytes.NewReader(svg)
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest("GET", publicURL("", id)+"?format=png", nil))
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "image/png", rw.Header().Get("Content-Type"))
+	assert.Equal(t, `inline; filename=logo.png`, rw.Header().Get("Content-Disposition"))
+	assert.Equal(t, imageContentSecurityPolicy, rw.Header().Get("Content-Security-Policy"))
+}
+
+func Test_server_visibility(t *testing.T) {
+	service := new(testingImageService)
+	public, _ := service.Create(context.TODO(), &Image{Key: uuid.New(), ContentType: "image/png", Owner: "bob", Visibility: visibilityPublic})
+	unlisted, _ := service.Create(context.TODO(), &Image{Key: uuid.New(), ContentType: "image/png", Owner: "bob", Visibility: visibilityUnlisted})
+	private, _ := service.Create(context.TODO(), &Image{Key: uuid.New(), ContentType: "image/png", Owner: "alice", Visibility: visibilityPrivate})
+	defer func() { _ = service.Delete(context.TODO(), public.Key, unlisted.Key, private.Key) }()
+
+	alice := &Principal{Subject: "alice", Scopes: []string{scopeImagesRead, scopeImagesWrite}}
+	s := &server{router: gin.New(), Image: service, links: testingLinks}
+	g := s.router.Group("/images", s.handleErrors, withPrincipal(alice))
+	g.GET("", s.handleImagesList)
+	g.GET("/:image", s.BindUUID, s.handleImagesGet)
+	g.PATCH("/:image", s.BindUUID, s.handleImagesUpdate)
+
+	t.Run("List", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, httptest.NewRequest("GET", "/images", nil))
+		assert.Equal(t, 200, rw.Code)
+
+		var got []*Image
+		assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &got))
+
+		links := make(map[uuid.UUID]string)
+		for _, i := range got {
+			links[i.Key] = i.DownloadURL
+		}
+
+		assert.Equal(t, publicURL("", public.Key), links[public.Key])
+		assert.NotContains(t, links, unlisted.Key, "unlisted images are not listed to others")
+		assert.Contains(t, links[private.Key], "signature=")
+	})
+
+	t.Run("Unlisted is readable", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, httptest.NewRequest("GET", "/images/"+unlisted.Key.String(), nil))
+		assert.Equal(t, 200, rw.Code)
+	})
+
+	t.Run("Only the owner changes visibility", func(t *testing.T) {
+		body := `{"visibility": "private"}`
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/images/"+public.Key.String(), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		s.ServeHTTP(rw, req)
+		assert.Equal(t, 403, rw.Code, "public images are read-only to others")
+
+		body = `{"visibility": "unlisted"}`
+		rw = httptest.NewRecorder()
+		req = httptest.NewRequest("PATCH", "/images/"+private.Key.String(), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		s.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+		assert.Contains(t, rw.Body.String(), `"download_url":"`+publicURL("", private.Key)+`"`)
+	})
+
+	t.Run("Invalid visibility", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/images/"+private.Key.String(), strings.NewReader(`{"visibility": "secret"}`))
+		req.Header.Set("Content-Type", "application/json")
+		s.ServeHTTP(rw, req)
+		assert.Equal(t, 400, rw.Code)
+	})
+}
@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Supported watermark positions
+const (
+	watermarkTopLeft     = "top-left"
+	watermarkTop         = "top"
+	watermarkTopRight    = "top-right"
+	watermarkLeft        = "left"
+	watermarkCenter      = "center"
+	watermarkRight       = "right"
+	watermarkBottomLeft  = "bottom-left"
+	watermarkBottom      = "bottom"
+	watermarkBottomRight = "bottom-right"
+	watermarkTile        = "tile" // repeat the watermark over the whole image
+)
+
+// watermarkTextSize is the font size used to render text watermarks before scaling them
+const watermarkTextSize = 96
+
+var (
+	// ErrWatermarkNotConfigured a watermark is required but neither an image nor a text is configured
+	ErrWatermarkNotConfigured = errors.New("no watermark configured")
+
+	// ErrInvalidWatermark watermark configuration is invalid
+	ErrInvalidWatermark = errors.New("invalid watermark")
+)
+
+// WatermarkConfig describes the watermark composited onto served images.
+// The original images are never modified.
+type WatermarkConfig struct {
+	Image    uuid.UUID `yaml:"image"`    // stored Image used as watermark, takes precedence over Text
+	Text     string    `yaml:"text"`     // text rendered as watermark
+	Position string    `yaml:"position"` // one of the watermark positions
+	Opacity  float64   `yaml:"opacity"`  // from 0 (invisible) to 1 (opaque)
+	Scale    float64   `yaml:"scale"`    // watermark width relative to the served image width, from 0 to 1
+}
+
+// enabled tells whether a watermark is configured
+func (w WatermarkConfig) enabled() bool {
+	return w.Image != uuid.Nil || w.Text != ""
+}
+
+// defaultWatermarkConfig returns the watermark options used when nothing is configured
+func defaultWatermarkConfig() WatermarkConfig {
+	return WatermarkConfig{
+		Position: watermarkBottomRight,
+		Opacity:  0.5,
+		Scale:    0.25,
+	}
+}
+
+// watermarkFromEnv reads WatermarkConfig from environment variables, starting from w
+func watermarkFromEnv(w WatermarkConfig) (WatermarkConfig, error) {
+	if v, ok := os.LookupEnv("WATERMARK_IMAGE"); ok && v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return w, fmt.Errorf("invalid $WATERMARK_IMAGE: %w", err)
+		}
+		w.Image = id
+	}
+
+	if v, ok := os.LookupEnv("WATERMARK_TEXT"); ok {
+		w.Text = v
+	}
+	if v, ok := os.LookupEnv("WATERMARK_POSITION"); ok {
+		w.Position = strings.ToLower(v)
+	}
+
+	floats := map[string]*float64{
+		"WATERMARK_OPACITY": &w.Opacity,
+		"WATERMARK_SCALE":   &w.Scale,
+	}
+	for k, p := range floats {
+		if v, ok := os.LookupEnv(k); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return w, fmt.Errorf("invalid $%s: %w", k, err)
+			}
+			*p = f
+		}
+	}
+
+	return w, nil
+}
+
+func (w WatermarkConfig) validate() error {
+	switch w.Position {
+	case watermarkTopLeft, watermarkTop, watermarkTopRight, watermarkLeft, watermarkCenter, watermarkRight,
+		watermarkBottomLeft, watermarkBottom, watermarkBottomRight, watermarkTile:
+	default:
+		return fmt.Errorf("%w: unknown position %q", ErrInvalidWatermark, w.Position)
+	}
+
+	if w.Opacity <= 0 || w.Opacity > 1 {
+		return fmt.Errorf("%w: opacity must be greater than 0 and at most 1", ErrInvalidWatermark)
+	}
+
+	if w.Scale <= 0 || w.Scale > 1 {
+		return fmt.Errorf("%w: scale must be greater than 0 and at most 1", ErrInvalidWatermark)
+	}
+
+	return nil
+}
+
+// watermark is a ready to use overlay
+type watermark struct {
+	mark     image.Image
+	position string
+	opacity  float64
+	scale    float64
+}
+
+// watermarker loads the configured watermark once and keeps it in memory.
+// Replacing the watermark image requires a restart.
+type watermarker struct {
+	config WatermarkConfig
+
+	mu     sync.Mutex
+	loaded *watermark
+}
+
+// load returns the configured watermark, reading the watermark image from given service
+func (w *watermarker) load(ctx context.Context, images ImageService) (*watermark, error) {
+	if w == nil || !w.config.enabled() {
+		return nil, ErrWatermarkNotConfigured
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.loaded != nil {
+		return w.loaded, nil
+	}
+
+	var mark image.Image
+	var err error
+	if w.config.Image != uuid.Nil {
+		mark, err = w.loadImage(ctx, images)
+	} else {
+		mark, err = renderText(w.config.Text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.loaded = &watermark{
+		mark:     mark,
+		position: w.config.Position,
+		opacity:  w.config.Opacity,
+		scale:    w.config.Scale,
+	}
+	return w.loaded, nil
+}
+
+func (w *watermarker) loadImage(ctx context.Context, images ImageService) (image.Image, error) {
+	i, err := images.Get(ctx, w.config.Image)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load watermark image %s: %w", w.config.Image, err)
+	}
+
+	if closer, ok := i.Content.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	m, err := decode(i)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode watermark image %s: %w", w.config.Image, err)
+	}
+
+	return m, nil
+}
+
+// watermarkFor returns the watermark to composite onto the served image, nil for none.
+// It is enforced by the Image metadata, or requested with ?watermark=true.
+func (s *server) watermarkFor(c *gin.Context, image *Image) (*watermark, error) {
+	requested := false
+	if v := c.Query("watermark"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, newBadRequestError(fmt.Errorf("%w: watermark must be a boolean", ErrInvalidConversion))
+		}
+		requested = b
+	}
+
+	if !image.Watermark && !requested {
+		return nil, nil
+	}
+
+	t := s.tenant(c)
+	w, err := t.watermark.load(c.Request.Context(), t.Image)
+	if errors.Is(err, ErrWatermarkNotConfigured) && !image.Watermark {
+		return nil, newBadRequestError(err)
+	}
+
+	// Never fall back to the original of an enforced image
+	return w, err
+}
+
+// renderText draws the text in white with a dark outline, so it stays readable on any background
+func renderText(text string) (image.Image, error) {
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: watermarkTextSize, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	const outline = 3
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil() + 2*outline
+	height := (metrics.Ascent + metrics.Descent).Ceil() + 2*outline
+
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	d := &font.Drawer{Dst: m, Face: face}
+	for _, o := range []struct {
+		dx, dy int
+		c      color.Color
+	}{
+		{-outline, 0, color.Black}, {outline, 0, color.Black}, {0, -outline, color.Black}, {0, outline, color.Black},
+		{0, 0, color.White},
+	} {
+		d.Src = image.NewUniform(o.c)
+		d.Dot = fixed.P(outline+o.dx, outline+metrics.Ascent.Ceil()+o.dy)
+		d.DrawString(text)
+	}
+
+	return m, nil
+}
+
+// draw composites the watermark onto a copy of m
+func (w *watermark) draw(m image.Image) image.Image {
+	b := m.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), m, b.Min, draw.Src)
+
+	// Scale the mark relative to the image width, keeping its aspect ratio
+	mb := w.mark.Bounds()
+	width := int(math.Round(float64(dst.Rect.Dx()) * w.scale))
+	height := int(math.Round(float64(width) * float64(mb.Dy()) / float64(mb.Dx())))
+	if width < 1 || height < 1 {
+		return dst
+	}
+
+	mark := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(mark, mark.Bounds(), w.mark, mb, draw.Src, nil)
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(w.opacity * 255))})
+
+	for _, p := range w.points(dst.Rect.Size(), mark.Rect.Size()) {
+		r := image.Rectangle{Min: p, Max: p.Add(mark.Rect.Size())}
+		draw.DrawMask(dst, r, mark, image.Point{}, mask, image.Point{}, draw.Over)
+	}
+
+	return dst
+}
+
+// points returns the top-left corners where the mark is drawn
+func (w *watermark) points(size, mark image.Point) []image.Point {
+	margin := int(math.Round(math.Min(float64(size.X), float64(size.Y)) * 0.02))
+
+	if w.position == watermarkTile {
+		points := make([]image.Point, 0)
+		stepX, stepY := mark.X+mark.X/2, mark.Y*3
+		for y, row := 0, 0; y < size.Y; y, row = y+stepY, row+1 {
+			for x := -(row % 2) * stepX / 2; x < size.X; x += stepX { // shift every other row
+				points = append(points, image.Pt(x, y))
+			}
+		}
+		return points
+	}
+
+	x, y := (size.X-mark.X)/2, (size.Y-mark.Y)/2
+	if strings.HasSuffix(w.position, "left") {
+		x = margin
+	}
+	if strings.HasSuffix(w.position, "right") {
+		x = size.X - mark.X - margin
+	}
+	if strings.HasPrefix(w.position, "top") {
+		y = margin
+	}
+	if strings.HasPrefix(w.position, "bottom") {
+		y = size.Y - mark.Y - margin
+	}
+
+	return []image.Point{image.Pt(x, y)}
+}
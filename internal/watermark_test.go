@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_watermarkFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    WatermarkConfig
+		wantErr bool
+	}{
+		{
+			name: "Defaults",
+			env:  map[string]string{},
+			want: defaultWatermarkConfig(),
+		},
+		{
+			name: "Text",
+			env:  map[string]string{"WATERMARK_TEXT": "PREVIEW", "WATERMARK_POSITION": "Tile", "WATERMARK_OPACITY": "0.3"},
+			want: WatermarkConfig{Text: "PREVIEW", Position: watermarkTile, Opacity: 0.3, Scale: 0.25},
+		},
+		{
+			name:    "Invalid image",
+			env:     map[string]string{"WATERMARK_IMAGE": "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown position",
+			env:     map[string]string{"WATERMARK_POSITION": "middle"},
+			wantErr: true,
+		},
+		{
+			name:    "Invisible",
+			env:     map[string]string{"WATERMARK_OPACITY": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "Too large",
+			env:     map[string]string{"WATERMARK_SCALE": "1.5"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				_ = os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			got, err := watermarkFromEnv(defaultWatermarkConfig())
+			if err == nil {
+				err = got.validate()
+			}
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_watermark_points(t *testing.T) {
+	size, mark := image.Pt(200, 100), image.Pt(50, 20)
+	tests := []struct {
+		position string
+		want     image.Point
+	}{
+		{watermarkTopLeft, image.Pt(2, 2)},
+		{watermarkTop, image.Pt(75, 2)},
+		{watermarkRight, image.Pt(148, 40)},
+		{watermarkCenter, image.Pt(75, 40)},
+		{watermarkBottomRight, image.Pt(148, 78)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.position, func(t *testing.T) {
+			w := &watermark{position: tt.position}
+			assert.Equal(t, []image.Point{tt.want}, w.points(size, mark))
+		})
+	}
+
+	tiles := (&watermark{position: watermarkTile}).points(size, mark)
+	assert.Greater(t, len(tiles), 4)
+}
+
+func Test_watermark_draw(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for i := range m.Pix {
+		m.Pix[i] = 255
+	}
+
+	mark := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			mark.SetNRGBA(x, y, color.NRGBA{A: 255})
+		}
+	}
+
+	w := &watermark{mark: mark, position: watermarkTopLeft, opacity: 0.5, scale: 0.2}
+	got := w.draw(m).(*image.NRGBA)
+
+	assert.Equal(t, uint8(255), m.NRGBAAt(10, 10).R, "original should be untouched")
+	assert.InDelta(t, 128, int(got.NRGBAAt(10, 10).R), 2, "black mark at 50% opacity")
+	assert.Equal(t, uint8(255), got.NRGBAAt(50, 50).R, "outside the mark")
+}
+
+func Test_server_handleImagesDownload_watermark(t *testing.T) {
+	gopher, err := os.ReadFile("testdata/gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		enforced      bool
+		config        WatermarkConfig
+		url           string
+		wantCode      int
+		wantWatermark bool
+	}{
+		{
+			name:     "Not requested",
+			config:   WatermarkConfig{Text: "PREVIEW", Position: watermarkCenter, Opacity: 1, Scale: 0.5},
+			wantCode: 200,
+		},
+		{
+			name:          "Requested",
+			config:        WatermarkConfig{Text: "PREVIEW", Position: watermarkCenter, Opacity: 1, Scale: 0.5},
+			url:           "?watermark=true",
+			wantCode:      200,
+			wantWatermark: true,
+		},
+		{
+			name:          "Enforced",
+			enforced:      true,
+			config:        WatermarkConfig{Text: "PREVIEW", Position: watermarkCenter, Opacity: 1, Scale: 0.5},
+			url:           "?watermark=false",
+			wantCode:      200,
+			wantWatermark: true,
+		},
+		{
+			name:     "Requested but not configured",
+			url:      "?watermark=true",
+			wantCode: 400,
+		},
+		{
+			name:     "Enforced but not configured",
+			enforced: true,
+			wantCode: 500,
+		},
+		{
+			name:     "Invalid",
+			url:      "?watermark=maybe",
+			wantCode: 400,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := new(testingImageService)
+			image, _ := service.Create(context.TODO(), &Image{
+				Key:         uuid.New(),
+				Name:        "gopher.png",
+				Content:     bytes.NewReader(gopher),
+				ContentType: "image/png",
+				Size:        int64(len(gopher)),
+				Watermark:   tt.enforced,
+			})
+
+			s := &server{
+				router:    gin.New(),
+				Image:     service,
+				watermark: &watermarker{config: tt.config},
+			}
+			s.router.GET("/foo/:image", s.handleErrors, withPrincipal(admin), s.BindUUID, s.handleImagesDownload)
+
+			rw := httptest.NewRecorder()
+			s.ServeHTTP(rw, httptest.NewRequest("GET", "/foo/"+image.Key.String()+tt.url, nil))
+
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if rw.Code != 200 {
+				return
+			}
+
+			assert.Equal(t, "image/png", rw.Header().Get("Content-Type"))
+			assert.Equal(t, !tt.wantWatermark, bytes.Equal(gopher, rw.Body.Bytes()))
+
+			_, err := png.DecodeConfig(rw.Body)
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -1,7 +1,33 @@
 package main
 
-import "github.com/SkYNewZ/images-server/internal"
+import (
+	"os"
+
+	"github.com/SkYNewZ/images-server/internal"
+	log "github.com/sirupsen/logrus"
+)
 
 func main() {
-	internal.Run()
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func run(args []string) error {
+	// 'images-server migrate [flags]' converts legacy objects to content-addressed storage
+	if len(args) > 0 && args[0] == "migrate" {
+		return internal.Migrate(args[1:])
+	}
+
+	// 'images-server apikey <name> <scope...>' generates an API key and its configuration entry
+	if len(args) > 1 && args[0] == "apikey" {
+		return internal.GenerateAPIKey(args[1], args[2:])
+	}
+
+	// 'images-server config print [flags]' prints the configuration, secrets are redacted
+	if len(args) > 1 && args[0] == "config" && args[1] == "print" {
+		return internal.PrintConfig(args[2:])
+	}
+
+	return internal.Run(args)
 }